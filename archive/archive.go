@@ -0,0 +1,390 @@
+// Package archive exports the transaction log to files for disaster recovery
+// and long-term retention, and imports it back.
+//
+// An archive contains the transaction log of one manifest:
+//
+//	index.json                  Index: the manifest and the list of segments
+//	segment-<offset>.jsonl.gz   gzip-compressed Record per line, the offset of
+//	                            the first record in hex
+//
+// The index is written after each segment, so an interrupted export leaves a
+// consistent archive, and the next export continues where it stopped.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/ridge/parallel"
+	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+)
+
+// DefaultSegmentSize is the default number of records per segment
+const DefaultSegmentSize = 10000
+
+const indexName = "index.json"
+
+const batchSize = 1000
+
+// Index describes the archive contents
+type Index struct {
+	Manifest   wire.Manifest
+	Generation int64 // offset of the manifest in the master topic
+	NextOffset int64 // offset in the transaction log topic to continue exporting from
+	Segments   []Segment
+}
+
+// Segment describes a segment file
+type Segment struct {
+	Name   string
+	SHA256 string // of the file, hex
+	Count  int    // number of records
+
+	// Range of the records
+	First, Last wire.Position
+	Since       time.Time
+	Until       time.Time
+}
+
+// Record is a message of the transaction log topic
+type Record struct {
+	Offset  int64
+	Time    time.Time
+	Key     string            `json:",omitempty"`
+	Headers map[string]string `json:",omitempty"`
+	Value   json.RawMessage   // marshaled wire.Transaction
+}
+
+// Find returns the segment containing the transaction at the given position
+func (idx Index) Find(pos wire.Position) (Segment, bool) {
+	for _, seg := range idx.Segments {
+		if wire.ComparePositions(seg.First, pos) <= 0 && wire.ComparePositions(pos, seg.Last) <= 0 {
+			return seg, true
+		}
+	}
+	return Segment{}, false
+}
+
+// ReadIndex reads the archive index. Returns an error wrapping fs.ErrNotExist
+// if the archive is empty.
+func ReadIndex(ctx context.Context, storage Storage) (Index, error) {
+	data, err := storage.Get(ctx, indexName)
+	if err != nil {
+		return Index{}, fmt.Errorf("failed to read archive index: %w", err)
+	}
+	var idx Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return Index{}, fmt.Errorf("failed to parse archive index: %w", err)
+	}
+	return idx, nil
+}
+
+// Export writes the transaction log of the current manifest to the archive, up
+// to the hot end. If the archive already contains a part of the log, only the
+// rest is exported.
+func Export(ctx context.Context, k kafka.Client, storage Storage, segmentSize int) (Index, error) {
+	logger := tlog.Get(ctx)
+
+	history, err := client.NewKafkaClient(k).ManifestHistory(ctx)
+	if err != nil {
+		return Index{}, err
+	}
+	if len(history) == 0 {
+		return Index{}, client.ErrNoManifest
+	}
+	current := history[len(history)-1]
+
+	idx, err := ReadIndex(ctx, storage)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		idx = Index{Manifest: current.Manifest, Generation: current.Offset}
+	case err != nil:
+		return Index{}, err
+	case idx.Generation != current.Offset:
+		return Index{}, fmt.Errorf("archive contains the transaction log of another manifest (at offset %d in the master topic, current is at %d)",
+			idx.Generation, current.Offset)
+	}
+	// Maintenance flag and audit data might have changed
+	idx.Manifest = current.Manifest
+
+	logger.Info("Exporting transaction log", zap.String("topic", idx.Manifest.Topic), zap.Int64("offset", idx.NextOffset))
+	var records []Record
+	flush := func(next int64) error {
+		if len(records) > 0 {
+			seg, data := newSegment(idx.Generation, records)
+			if err := storage.Put(ctx, seg.Name, data); err != nil {
+				return err
+			}
+			idx.Segments = append(idx.Segments, seg)
+			records = records[:0]
+		}
+		idx.NextOffset = next
+		return storage.Put(ctx, indexName, must.OK1(json.MarshalIndent(idx, "", "\t")))
+	}
+	err = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		messages := make(chan *kafka.IncomingMessage, batchSize)
+		spawn("reader", parallel.Fail, func(ctx context.Context) error {
+			return k.Read(ctx, idx.Manifest.Topic, idx.NextOffset, messages)
+		})
+		spawn("writer", parallel.Exit, func(ctx context.Context) error {
+			next := idx.NextOffset
+			for {
+				var msg *kafka.IncomingMessage
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg = <-messages:
+				}
+				if msg == nil {
+					return flush(next)
+				}
+				next = msg.Offset + 1
+				if len(msg.Value) == 0 { // tombstone/padding
+					continue
+				}
+				if !json.Valid(msg.Value) {
+					return fmt.Errorf("invalid transaction at offset %d: %q", msg.Offset, msg.Value)
+				}
+				records = append(records, Record{
+					Offset:  msg.Offset,
+					Time:    msg.Time,
+					Key:     msg.Key,
+					Headers: msg.Headers,
+					Value:   msg.Value,
+				})
+				if len(records) == segmentSize {
+					if err := flush(next); err != nil {
+						return err
+					}
+				}
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return Index{}, fmt.Errorf("failed to export transaction log: %w", err)
+	}
+	logger.Info("Exported transaction log", zap.Int("segments", len(idx.Segments)), zap.Int64("nextOffset", idx.NextOffset))
+	return idx, nil
+}
+
+func newSegment(generation int64, records []Record) (Segment, []byte) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false) // keep the transactions as is
+	for _, r := range records {
+		must.OK(enc.Encode(r))
+	}
+	must.OK(w.Close())
+
+	sum := sha256.Sum256(buf.Bytes())
+	first, last := records[0], records[len(records)-1]
+	return Segment{
+		Name:   fmt.Sprintf("segment-%016x.jsonl.gz", first.Offset),
+		SHA256: hex.EncodeToString(sum[:]),
+		Count:  len(records),
+		First:  client.KafkaPosition(generation, first.Offset),
+		Last:   client.KafkaPosition(generation, last.Offset),
+		Since:  first.Time,
+		Until:  last.Time,
+	}, buf.Bytes()
+}
+
+// ReadSegment reads the segment and verifies its checksum
+func ReadSegment(ctx context.Context, storage Storage, seg Segment) ([]Record, error) {
+	data, err := storage.Get(ctx, seg.Name)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != seg.SHA256 {
+		return nil, fmt.Errorf("segment %s is corrupted: checksum mismatch", seg.Name)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("segment %s is corrupted: %w", seg.Name, err)
+	}
+	records := make([]Record, 0, seg.Count)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("segment %s is corrupted: %w", seg.Name, err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("segment %s is corrupted: %w", seg.Name, err)
+	}
+	if len(records) != seg.Count {
+		return nil, fmt.Errorf("segment %s is corrupted: %d records instead of %d", seg.Name, len(records), seg.Count)
+	}
+	return records, nil
+}
+
+// Import restores the archive: writes the transaction log with the original
+// offsets and timestamps, then publishes the manifest unless it is already
+// the current one.
+//
+// If the transaction log topic is not empty, the records it already contains
+// are verified against the archive and skipped, so an interrupted import can be
+// repeated. Import fails if the topic contains anything else.
+//
+// The positions of the restored transactions are the same as the original
+// ones only if the master topic is restored to the same offset as well.
+func Import(ctx context.Context, k kafka.ClientBackdate, storage Storage) error {
+	logger := tlog.Get(ctx)
+
+	idx, err := ReadIndex(ctx, storage)
+	if err != nil {
+		return err
+	}
+	topic := idx.Manifest.Topic
+	next, err := k.LastOffset(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if next > idx.NextOffset {
+		return fmt.Errorf("topic %s contains %d messages, more than the archive", topic, next)
+	}
+	logger.Info("Importing transaction log", zap.String("topic", topic), zap.Int64("offset", next))
+
+	err = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		existing := make(chan *kafka.IncomingMessage, batchSize)
+		if next > 0 {
+			spawn("reader", parallel.Fail, func(ctx context.Context) error {
+				return k.Read(ctx, topic, 0, existing)
+			})
+		}
+		spawn("writer", parallel.Exit, func(ctx context.Context) error {
+			return importSegments(ctx, k, storage, idx, next, existing)
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	history, err := client.NewKafkaClient(k).ManifestHistory(ctx)
+	if err != nil {
+		return err
+	}
+	if len(history) > 0 && manifestsEqual(history[len(history)-1].Manifest, idx.Manifest) {
+		logger.Info("Manifest already published", zap.Object("manifest", idx.Manifest))
+		return nil
+	}
+	logger.Info("Publishing manifest", zap.Object("manifest", idx.Manifest))
+	return client.PublishKafkaManifest(ctx, k, idx.Manifest)
+}
+
+// importSegments writes the records starting from the offset next. The records
+// before it are verified against the messages of the topic read into existing.
+func importSegments(ctx context.Context, k kafka.ClientBackdate, storage Storage, idx Index, next int64, existing <-chan *kafka.IncomingMessage) error {
+	topic := idx.Manifest.Topic
+	end := next          // of the existing messages
+	verified := int64(0) // offset of the next existing message to verify
+	nextExisting := func() (*kafka.IncomingMessage, error) {
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case msg := <-existing:
+				if msg != nil { // not the hot end
+					verified = msg.Offset + 1
+					return msg, nil
+				}
+			}
+		}
+	}
+	verify := func(rec Record) error {
+		for {
+			msg, err := nextExisting()
+			if err != nil {
+				return err
+			}
+			switch {
+			case msg.Offset < rec.Offset && len(msg.Value) == 0: // padding
+				continue
+			case msg.Offset == rec.Offset && msg.Key == rec.Key && maps.Equal(msg.Headers, rec.Headers) && bytes.Equal(msg.Value, rec.Value):
+				return nil
+			}
+			return fmt.Errorf("topic %s does not match the archive at offset %d", topic, msg.Offset)
+		}
+	}
+
+	for _, seg := range idx.Segments {
+		records, err := ReadSegment(ctx, storage, seg)
+		if err != nil {
+			return err
+		}
+		batch := make([]kafka.IncomingMessage, 0, batchSize)
+		for _, rec := range records {
+			if rec.Offset < next {
+				if err := verify(rec); err != nil {
+					return err
+				}
+				continue
+			}
+			// pad with blank messages to maintain offset parity
+			for ; next < rec.Offset; next++ {
+				batch = append(batch, kafka.IncomingMessage{
+					Message: kafka.Message{Topic: topic},
+					Time:    rec.Time,
+				})
+			}
+			batch = append(batch, kafka.IncomingMessage{
+				Message: kafka.Message{
+					Topic:   topic,
+					Key:     rec.Key,
+					Headers: rec.Headers,
+					Value:   rec.Value,
+				},
+				Time: rec.Time,
+			})
+			next++
+			if len(batch) >= batchSize {
+				if err := k.WriteBackdated(ctx, topic, batch); err != nil {
+					return fmt.Errorf("failed to import segment %s: %w", seg.Name, err)
+				}
+				batch = batch[:0]
+			}
+		}
+		if len(batch) != 0 {
+			if err := k.WriteBackdated(ctx, topic, batch); err != nil {
+				return fmt.Errorf("failed to import segment %s: %w", seg.Name, err)
+			}
+		}
+	}
+	// Only padding may follow the last archived record
+	for verified < end {
+		msg, err := nextExisting()
+		if err != nil {
+			return err
+		}
+		if len(msg.Value) != 0 {
+			return fmt.Errorf("topic %s does not match the archive at offset %d", topic, msg.Offset)
+		}
+	}
+	return nil
+}
+
+// manifestsEqual compares the manifests, ignoring the formatting of Audit
+func manifestsEqual(m1, m2 wire.Manifest) bool {
+	return bytes.Equal(must.OK1(json.Marshal(m1)), must.OK1(json.Marshal(m2)))
+}
@@ -0,0 +1,213 @@
+package archive
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slices"
+)
+
+var testTime = time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testTxn(i int) []byte {
+	return must.OK1(json.Marshal(wire.Transaction{
+		Source: wire.Source{Producer: "foo"},
+		Changes: wire.Changes{
+			"apple": wire.KindChanges{
+				fmt.Sprintf("a%d", i): wire.Diff{"ID": json.RawMessage(fmt.Sprintf(`"a%d"`, i))},
+			},
+		},
+	}))
+}
+
+// testWrite writes n transactions and a padding message
+func testWrite(ctx context.Context, t *testing.T, k kafka.ClientBackdate, from, n int) {
+	var batch []kafka.IncomingMessage
+	for i := from; i < from+n; i++ {
+		batch = append(batch, kafka.IncomingMessage{
+			Message: kafka.Message{Topic: "txlog", Value: testTxn(i)},
+			Time:    testTime.Add(time.Duration(i) * time.Second),
+		})
+	}
+	batch = append(batch, kafka.IncomingMessage{
+		Message: kafka.Message{Topic: "txlog"},
+		Time:    testTime.Add(time.Duration(from+n) * time.Second),
+	})
+	require.NoError(t, k.WriteBackdated(ctx, "txlog", batch))
+}
+
+func testReadTopic(ctx context.Context, k kafka.Client, topic string) ([]kafka.IncomingMessage, error) {
+	var res []kafka.IncomingMessage
+	err := parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		messages := make(chan *kafka.IncomingMessage)
+		spawn("reader", parallel.Fail, func(ctx context.Context) error {
+			return k.Read(ctx, topic, 0, messages)
+		})
+		spawn("consumer", parallel.Exit, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg := <-messages:
+					if msg == nil {
+						return nil
+					}
+					res = append(res, *msg)
+				}
+			}
+		})
+		return nil
+	})
+	return res, err
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := test.Context(t)
+	storage := DirStorage(t.TempDir())
+
+	source := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(ctx, source, wire.Manifest{Version: 1, Topic: "txlog"}))
+	testWrite(ctx, t, source, 0, 3)
+
+	idx, err := Export(ctx, source, storage, 2)
+	require.NoError(t, err)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog"}, idx.Manifest)
+	require.Equal(t, int64(4), idx.NextOffset)
+	require.Len(t, idx.Segments, 2)
+	require.Equal(t, "segment-0000000000000000.jsonl.gz", idx.Segments[0].Name)
+	require.Equal(t, 2, idx.Segments[0].Count)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000001"), idx.Segments[0].Last)
+	require.Equal(t, testTime.Add(time.Second), idx.Segments[0].Until)
+	require.Equal(t, "segment-0000000000000002.jsonl.gz", idx.Segments[1].Name)
+
+	seg, ok := idx.Find("0000000000000000-0000000000000002")
+	require.True(t, ok)
+	require.Equal(t, idx.Segments[1], seg)
+	_, ok = idx.Find("0000000000000000-0000000000000003")
+	require.False(t, ok)
+
+	// Incremental export
+	testWrite(ctx, t, source, 4, 1)
+	idx, err = Export(ctx, source, storage, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(6), idx.NextOffset)
+	require.Len(t, idx.Segments, 3)
+	require.Equal(t, "segment-0000000000000004.jsonl.gz", idx.Segments[2].Name)
+
+	dest := mock.New()
+	require.NoError(t, Import(ctx, dest, storage))
+	// Repeated import does nothing
+	require.NoError(t, Import(ctx, dest, storage))
+
+	history, err := client.NewKafkaClient(dest).ManifestHistory(ctx)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog"}, history[0].Manifest)
+
+	original, err := testReadTopic(ctx, source, "txlog")
+	require.NoError(t, err)
+	restored, err := testReadTopic(ctx, dest, "txlog")
+	require.NoError(t, err)
+	// Padding is restored with the timestamp of the next transaction, the
+	// trailing padding is not restored
+	require.Len(t, restored, len(original)-1)
+	for i, msg := range restored {
+		if len(msg.Value) == 0 {
+			msg.Time = original[i].Time
+		}
+		require.Equal(t, original[i], msg)
+	}
+}
+
+func TestExportAnotherManifest(t *testing.T) {
+	ctx := test.Context(t)
+	storage := DirStorage(t.TempDir())
+
+	k := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(ctx, k, wire.Manifest{Version: 1, Topic: "txlog"}))
+	_, err := Export(ctx, k, storage, DefaultSegmentSize)
+	require.NoError(t, err)
+
+	require.NoError(t, client.PublishKafkaManifest(ctx, k, wire.Manifest{Version: 2, Topic: "txlog2"}))
+	_, err = Export(ctx, k, storage, DefaultSegmentSize)
+	require.ErrorContains(t, err, "another manifest")
+}
+
+func TestImportCorrupted(t *testing.T) {
+	ctx := test.Context(t)
+	dir := t.TempDir()
+	storage := DirStorage(dir)
+
+	_, err := ReadIndex(ctx, storage)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	k := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(ctx, k, wire.Manifest{Version: 1, Topic: "txlog"}))
+	testWrite(ctx, t, k, 0, 1)
+	idx, err := Export(ctx, k, storage, DefaultSegmentSize)
+	require.NoError(t, err)
+
+	name := filepath.Join(dir, idx.Segments[0].Name)
+	data, err := os.ReadFile(name)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xff
+	require.NoError(t, os.WriteFile(name, data, 0o644))
+
+	require.ErrorContains(t, Import(ctx, mock.New(), storage), "checksum mismatch")
+}
+
+func TestImportVerify(t *testing.T) {
+	ctx := test.Context(t)
+	storage := DirStorage(t.TempDir())
+
+	source := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(ctx, source, wire.Manifest{Version: 1, Topic: "txlog"}))
+	testWrite(ctx, t, source, 0, 3)
+	_, err := Export(ctx, source, storage, 2)
+	require.NoError(t, err)
+	original, err := testReadTopic(ctx, source, "txlog")
+	require.NoError(t, err)
+
+	// Interrupted import: the first records are already there
+	dest := mock.New()
+	require.NoError(t, dest.WriteBackdated(ctx, "txlog", original[:2]))
+	require.NoError(t, Import(ctx, dest, storage))
+	restored, err := testReadTopic(ctx, dest, "txlog")
+	require.NoError(t, err)
+	require.Equal(t, original[:3], restored)
+
+	// Another transaction log
+	dest = mock.New()
+	require.NoError(t, dest.WriteBackdated(ctx, "txlog", []kafka.IncomingMessage{original[0], {
+		Message: kafka.Message{Topic: "txlog", Value: testTxn(5)},
+		Time:    original[1].Time,
+	}}))
+	require.ErrorContains(t, Import(ctx, dest, storage), "does not match the archive at offset 1")
+
+	// The original topic with the trailing padding
+	dest = mock.New()
+	require.NoError(t, dest.WriteBackdated(ctx, "txlog", original))
+	require.NoError(t, Import(ctx, dest, storage))
+
+	// Extra messages past the archived records
+	dest = mock.New()
+	require.NoError(t, dest.WriteBackdated(ctx, "txlog", append(slices.Clone(original[:3]), kafka.IncomingMessage{
+		Message: kafka.Message{Topic: "txlog", Value: testTxn(5)},
+		Time:    original[3].Time,
+	})))
+	require.ErrorContains(t, Import(ctx, dest, storage), "does not match the archive at offset 3")
+}
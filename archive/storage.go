@@ -0,0 +1,160 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ridge/limestone/retry"
+	"github.com/ridge/must/v2"
+	"golang.org/x/oauth2/google"
+)
+
+// Storage keeps the archive files
+type Storage interface {
+	// Put stores the file, replacing the existing one if any
+	Put(ctx context.Context, name string, data []byte) error
+
+	// Get retrieves the file. Returns an error wrapping fs.ErrNotExist if
+	// there is no such file.
+	Get(ctx context.Context, name string) ([]byte, error)
+}
+
+// StorageFromURL creates a storage from an URL in one of the following
+// formats:
+//
+// file:///path
+//
+//	Local directory.
+//
+// gs://bucket/prefix
+//
+//	Google Cloud Storage objects with names starting with the prefix.
+func StorageFromURL(storageURL string) (Storage, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive storage for URL %s: %w", storageURL, err)
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" { // typical mistake: file://path instead of file:///path
+			return nil, fmt.Errorf("failed to create archive storage for URL %s: file:///... expected", storageURL)
+		}
+		return DirStorage(u.Path), nil
+	case "gs":
+		return gsStorage{bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+	default:
+		return nil, fmt.Errorf("failed to create archive storage for URL %s: file:///... or gs://... expected", storageURL)
+	}
+}
+
+// DirStorage is a Storage keeping the files in a local directory
+type DirStorage string
+
+// Put implements Storage
+func (d DirStorage) Put(ctx context.Context, name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a partial file is never seen
+	tmp := filepath.Join(string(d), "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(string(d), name))
+}
+
+// Get implements Storage
+func (d DirStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), name))
+}
+
+// recommended by Cloud Storage documentation
+var gsRetryConfig = retry.ExpConfig{
+	Min:     time.Second,
+	Max:     time.Minute,
+	Scale:   2,
+	Instant: true,
+}
+
+type gsStorage struct {
+	bucket string
+	prefix string
+}
+
+func (s gsStorage) Put(ctx context.Context, name string, data []byte) error {
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.QueryEscape(s.bucket), url.QueryEscape(s.prefix+name))
+	_, err := s.do(ctx, "https://www.googleapis.com/auth/devstorage.read_write", func() *http.Request {
+		req := must.OK1(http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data)))
+		req.Header.Set("Content-Type", "application/octet-stream")
+		return req
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload gs://%s/%s%s: %w", s.bucket, s.prefix, name, err)
+	}
+	return nil
+}
+
+func (s gsStorage) Get(ctx context.Context, name string) ([]byte, error) {
+	u := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+		url.QueryEscape(s.bucket), url.QueryEscape(s.prefix+name))
+	data, err := s.do(ctx, "https://www.googleapis.com/auth/devstorage.read_only", func() *http.Request {
+		return must.OK1(http.NewRequestWithContext(ctx, http.MethodGet, u, nil))
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download gs://%s/%s%s: %w", s.bucket, s.prefix, name, err)
+	}
+	return data, nil
+}
+
+// do performs the request with retries and returns the response body
+func (s gsStorage) do(ctx context.Context, scope string, newRequest func() *http.Request) ([]byte, error) {
+	client, err := google.DefaultClient(ctx, scope)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	err = retry.Do(ctx, gsRetryConfig, func() error {
+		resp, err := client.Do(newRequest())
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, syscall.ECONNRESET) {
+				return retry.Retriable(err)
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusNotFound:
+			return fs.ErrNotExist
+		default:
+			err := fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL, resp.Status)
+			if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+				return retry.Retriable(err)
+			}
+			return err
+		}
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNRESET) {
+				return retry.Retriable(err)
+			}
+			return err
+		}
+		return nil
+	})
+	return data, err
+}
@@ -0,0 +1,117 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func ts(s string) *time.Time {
+	t := must.OK1(time.Parse(time.RFC3339, s))
+	return &t
+}
+
+func testSetup(t *testing.T) client.KafkaClient {
+	ctx := test.Context(t)
+	k := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(ctx, k, wire.Manifest{Version: 1, Topic: "txlog"}))
+	for _, txn := range []wire.Transaction{
+		{
+			TS:     ts("2020-01-01T00:00:00Z"),
+			Source: wire.Source{Producer: "foo"},
+			Changes: wire.Changes{
+				"apple": wire.KindChanges{
+					"a": wire.Diff{"ID": json.RawMessage(`"a"`), "Color": json.RawMessage(`"red"`)},
+				},
+			},
+		},
+		{
+			TS:     ts("2020-01-01T00:00:01Z"),
+			Source: wire.Source{Producer: "bar"},
+			Changes: wire.Changes{
+				"apple": wire.KindChanges{
+					"a": wire.Diff{"Color": json.RawMessage(`"green"`)},
+				},
+				"orange": wire.KindChanges{
+					"o": wire.Diff{"ID": json.RawMessage(`"o"`), "Size": json.RawMessage(`3`)},
+				},
+			},
+		},
+	} {
+		require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", txn))
+	}
+	return client.NewKafkaClient(k)
+}
+
+func TestTail(t *testing.T) {
+	c := testSetup(t)
+
+	var out bytes.Buffer
+	require.NoError(t, tail(test.Context(t), c, tailOptions{}, &printer{out: &out}))
+	require.Equal(t, `2020-01-01T00:00:00Z 0000000000000000-0000000000000000 producer="foo"
+  apple/a Color="red" ID="a"
+2020-01-01T00:00:01Z 0000000000000000-0000000000000001 producer="bar"
+  apple/a Color="green"
+  orange/o ID="o" Size=3
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, tail(test.Context(t), c, tailOptions{kinds: []string{"orange"}}, &printer{out: &out}))
+	require.Equal(t, `2020-01-01T00:00:01Z 0000000000000000-0000000000000001 producer="bar"
+  orange/o ID="o" Size=3
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, tail(test.Context(t), c, tailOptions{producers: []meta.Producer{"foo"}}, &printer{out: &out}))
+	require.Equal(t, `2020-01-01T00:00:00Z 0000000000000000-0000000000000000 producer="foo"
+  apple/a Color="red" ID="a"
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, tail(test.Context(t), c, tailOptions{since: *ts("2020-01-01T00:00:01Z")}, &printer{out: &out}))
+	require.Contains(t, out.String(), "0000000000000000-0000000000000001")
+	require.NotContains(t, out.String(), "0000000000000000-0000000000000000")
+
+	out.Reset()
+	require.NoError(t, tail(test.Context(t), c, tailOptions{to: "0000000000000000-0000000000000000"}, &printer{out: &out}))
+	require.Contains(t, out.String(), "0000000000000000-0000000000000000")
+	require.NotContains(t, out.String(), "0000000000000000-0000000000000001")
+
+	out.Reset()
+	require.NoError(t, tail(test.Context(t), c, tailOptions{from: "0000000000000000-0000000000000000", ids: []string{"a"}}, &printer{out: &out}))
+	require.Equal(t, `2020-01-01T00:00:01Z 0000000000000000-0000000000000001 producer="bar"
+  apple/a Color="green"
+`, out.String())
+}
+
+func TestState(t *testing.T) {
+	c := testSetup(t)
+
+	var out bytes.Buffer
+	require.NoError(t, showState(test.Context(t), c, "apple", "a", wire.Beginning, &printer{out: &out}))
+	require.Equal(t, "2020-01-01T00:00:01Z apple/a Color=\"green\" ID=\"a\"\n", out.String())
+
+	out.Reset()
+	require.NoError(t, showState(test.Context(t), c, "apple", "a", "0000000000000000-0000000000000000", &printer{out: &out}))
+	require.Equal(t, "2020-01-01T00:00:00Z apple/a Color=\"red\" ID=\"a\"\n", out.String())
+
+	require.EqualError(t, showState(test.Context(t), c, "orange", "o", "0000000000000000-0000000000000000", &printer{out: &out}), "orange/o not found")
+	require.EqualError(t, showState(test.Context(t), c, "apple", "a", "0000000000000000-0000000000000005", &printer{out: &out}), "position 0000000000000000-0000000000000005 not found")
+}
+
+func TestManifest(t *testing.T) {
+	c := testSetup(t)
+
+	var out bytes.Buffer
+	require.NoError(t, showManifest(test.Context(t), c, false, &printer{out: &out}))
+	require.Regexp(t, `^\S+ manifest Offset=0 Topic="txlog" Version=1\n$`, out.String())
+}
@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/parallel"
+	"golang.org/x/exp/slices"
+)
+
+func showManifest(ctx context.Context, c client.KafkaClient, history bool, p *printer) error {
+	records, err := c.ManifestHistory(ctx)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return client.ErrNoManifest
+	}
+	if !history {
+		records = records[len(records)-1:]
+	}
+	for _, rec := range records {
+		if err := p.manifest(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tailOptions select the transactions to print. Empty values mean no
+// restriction.
+type tailOptions struct {
+	from  wire.Position // exclusive
+	to    wire.Position // inclusive
+	since time.Time
+	until time.Time
+
+	kinds     []string
+	ids       []string
+	producers []meta.Producer
+
+	follow bool // don't stop at the hot end
+}
+
+// filter returns the changes of the transaction to print, or nil if it
+// should be skipped
+func (opts tailOptions) filter(txn *wire.IncomingTransaction) wire.Changes {
+	if opts.producers != nil && !slices.Contains(opts.producers, txn.Source.Producer) {
+		return nil
+	}
+	if !opts.since.IsZero() && txn.TS.Before(opts.since) {
+		return nil
+	}
+	if opts.kinds == nil && opts.ids == nil {
+		return txn.Changes
+	}
+	var res wire.Changes
+	for kind, kindChanges := range txn.Changes {
+		if opts.kinds != nil && !slices.Contains(opts.kinds, kind) {
+			continue
+		}
+		for id, diff := range kindChanges {
+			if opts.ids != nil && !slices.Contains(opts.ids, id) {
+				continue
+			}
+			if res == nil {
+				res = wire.Changes{}
+			}
+			if res[kind] == nil {
+				res[kind] = wire.KindChanges{}
+			}
+			res[kind][id] = diff
+		}
+	}
+	return res
+}
+
+// done returns true if the transaction is past the range to print
+func (opts tailOptions) done(txn *wire.IncomingTransaction) bool {
+	return opts.to != wire.Beginning && wire.ComparePositions(txn.Position, opts.to) > 0 ||
+		!opts.until.IsZero() && txn.TS.After(opts.until)
+}
+
+func tail(ctx context.Context, c client.KafkaClient, opts tailOptions, p *printer) error {
+	manifest, err := c.RetrieveManifest(ctx, false)
+	if err != nil {
+		return err
+	}
+	return read(ctx, c.Connect(manifest.Version, opts.from, nil, false), func(txn *wire.IncomingTransaction) (bool, error) {
+		if txn == nil {
+			return !opts.follow, nil
+		}
+		if opts.done(txn) {
+			return true, nil
+		}
+		if txn.Changes = opts.filter(txn); txn.Changes == nil {
+			return false, nil
+		}
+		return false, p.transaction(txn)
+	})
+}
+
+// showState prints the state of the entity after the transaction at the given
+// position, or the current state if the position is wire.Beginning
+func showState(ctx context.Context, c client.KafkaClient, kind, id string, at wire.Position, p *printer) error {
+	manifest, err := c.RetrieveManifest(ctx, false)
+	if err != nil {
+		return err
+	}
+	active := wire.ActiveSet{}
+	reached := at == wire.Beginning
+	err = read(ctx, c.Connect(manifest.Version, wire.Beginning, nil, false), func(txn *wire.IncomingTransaction) (bool, error) {
+		if txn == nil {
+			return true, nil
+		}
+		if at != wire.Beginning && wire.ComparePositions(txn.Position, at) > 0 {
+			return true, nil
+		}
+		if diff, ok := txn.Changes[kind][id]; ok {
+			entity := txn.Transaction
+			entity.Changes = wire.Changes{kind: wire.KindChanges{id: diff}}
+			if err := active.Apply(entity, time.Time{}, nil); err != nil {
+				return false, fmt.Errorf("failed to apply transaction at %s: %w", txn.Position, err)
+			}
+		}
+		if txn.Position == at {
+			reached = true
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	if !reached {
+		return fmt.Errorf("position %s not found", at)
+	}
+	obj := active[kind][id]
+	if obj == nil {
+		return fmt.Errorf("%s/%s not found", kind, id)
+	}
+	return p.entity(kind, id, obj)
+}
+
+// read feeds the transactions from the connection (and nil at the hot end) to
+// fn until it returns true or an error
+func read(ctx context.Context, conn client.Connection, fn func(txn *wire.IncomingTransaction) (bool, error)) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		txns := make(chan *wire.IncomingTransaction)
+		spawn("upstream", parallel.Fail, func(ctx context.Context) error {
+			return conn.Run(ctx, txns)
+		})
+		spawn("consumer", parallel.Exit, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case txn := <-txns:
+					stop, err := fn(txn)
+					if err != nil || stop {
+						return err
+					}
+				}
+			}
+		})
+		return nil
+	})
+}
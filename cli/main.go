@@ -0,0 +1,140 @@
+// Package cli implements the limestone command-line tool for inspecting,
+// exporting and importing the transaction log in Kafka
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ridge/limestone/archive"
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/limestone/run"
+	"github.com/ridge/limestone/wire"
+	"github.com/spf13/pflag"
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+const usage = `Usage:
+  limestone [flags] manifest            show the current manifest (--history: all manifests)
+  limestone [flags] tail                print the transactions (see the filters below)
+  limestone [flags] state KIND ID       print the state of an entity (--at: at the given position)
+  limestone [flags] export ARCHIVE      export the transaction log to the archive (file:///... or gs://...)
+  limestone [flags] import ARCHIVE      restore the transaction log from the archive
+
+Flags:
+`
+
+// Main handles the command line and runs the tool
+func Main(args []string) {
+	run.Tool(func(ctx context.Context) error {
+		var kafkaURL, colorArg string
+		var history bool
+		var opts tailOptions
+		var from, to, at string
+		var since, until string
+		var producers []string
+		var segmentSize int
+		pflag.StringVar(&kafkaURL, "kafka-url", "", "Kafka URL")
+		pflag.StringVar(&colorArg, "color", "auto", "colored output (yes|no|auto)")
+		pflag.BoolVar(&history, "history", false, "manifest: show all the manifests published, oldest first")
+		pflag.StringVar(&from, "from", "", "tail: start after the given position")
+		pflag.StringVar(&to, "to", "", "tail: stop at the given position")
+		pflag.StringVar(&since, "since", "", "tail: skip the transactions before the given time (RFC 3339)")
+		pflag.StringVar(&until, "until", "", "tail: stop at the given time (RFC 3339)")
+		pflag.StringSliceVar(&opts.kinds, "kind", nil, "tail: show only the given kinds")
+		pflag.StringSliceVar(&opts.ids, "id", nil, "tail: show only the entities with the given IDs")
+		pflag.StringSliceVar(&producers, "producer", nil, "tail: show only the transactions by the given producers")
+		pflag.BoolVarP(&opts.follow, "follow", "f", false, "tail: wait for new transactions after reaching the end")
+		pflag.StringVar(&at, "at", "", "state: position to show the state at (default: current)")
+		pflag.IntVar(&segmentSize, "segment-size", archive.DefaultSegmentSize, "export: number of transactions per archive segment")
+		pflag.Usage = func() {
+			fmt.Fprint(os.Stderr, usage)
+			pflag.PrintDefaults()
+		}
+		if err := pflag.CommandLine.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		var color bool
+		switch colorArg {
+		case "yes":
+			color = true
+		case "no":
+		case "auto":
+			color = term.IsTerminal(unix.Stdout)
+		default:
+			return fmt.Errorf("invalid --color value %q", colorArg)
+		}
+
+		opts.from = wire.Position(from)
+		opts.to = wire.Position(to)
+		for _, p := range producers {
+			opts.producers = append(opts.producers, meta.Producer(p))
+		}
+		var err error
+		if opts.since, err = parseTime(since); err != nil {
+			return err
+		}
+		if opts.until, err = parseTime(until); err != nil {
+			return err
+		}
+
+		k, err := kafka.FromURI(kafkaURL)
+		if err != nil {
+			return err
+		}
+		c := client.NewKafkaClient(k)
+		p := &printer{out: os.Stdout, color: color}
+
+		cmd := pflag.Args()
+		if len(cmd) == 0 {
+			pflag.Usage()
+			return errors.New("no command given")
+		}
+		switch {
+		case cmd[0] == "manifest" && len(cmd) == 1:
+			return showManifest(ctx, c, history, p)
+		case cmd[0] == "tail" && len(cmd) == 1:
+			return tail(ctx, c, opts, p)
+		case cmd[0] == "state" && len(cmd) == 3:
+			return showState(ctx, c, cmd[1], cmd[2], wire.Position(at), p)
+		case cmd[0] == "export" && len(cmd) == 2:
+			storage, err := archive.StorageFromURL(cmd[1])
+			if err != nil {
+				return err
+			}
+			_, err = archive.Export(ctx, k, storage, segmentSize)
+			return err
+		case cmd[0] == "import" && len(cmd) == 2:
+			storage, err := archive.StorageFromURL(cmd[1])
+			if err != nil {
+				return err
+			}
+			kb, ok := k.(kafka.ClientBackdate)
+			if !ok {
+				return fmt.Errorf("Kafka client %s does not support writing with timestamps", kafkaURL)
+			}
+			return archive.Import(ctx, kb, storage)
+		default:
+			pflag.Usage()
+			return fmt.Errorf("invalid command %q", cmd)
+		}
+	})
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to parse time %q: %w", s, err)
+	}
+	return t, nil
+}
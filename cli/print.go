@@ -0,0 +1,95 @@
+package cli
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/tlog/formatter"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// printer pretty-prints records in the style of console logs
+type printer struct {
+	out    io.Writer
+	color  bool
+	prevTS string
+}
+
+func (p *printer) line(ts time.Time, msg string, fields map[string]any) error {
+	var tsStr string
+	if !ts.IsZero() {
+		tsStr = ts.UTC().Format(time.RFC3339Nano)
+	}
+	buf := formatter.Line(tsStr, p.prevTS, msg, fields, p.color)
+	defer buf.Free()
+	if tsStr != "" {
+		p.prevTS = tsStr
+	}
+	_, err := p.out.Write(buf.Bytes())
+	return err
+}
+
+// transaction prints the transaction header followed by a line per entity
+func (p *printer) transaction(txn *wire.IncomingTransaction) error {
+	fields := map[string]any{}
+	if txn.Source.Producer != "" {
+		fields["producer"] = string(txn.Source.Producer)
+	}
+	if txn.Source.Instance != "" {
+		fields["instance"] = txn.Source.Instance
+	}
+	if txn.Session != 0 {
+		fields["session"] = float64(txn.Session)
+	}
+	if txn.Seq != 0 {
+		fields["seq"] = float64(txn.Seq)
+	}
+	var ts time.Time
+	if txn.TS != nil {
+		ts = *txn.TS
+	}
+	if err := p.line(ts, string(txn.Position), fields); err != nil {
+		return err
+	}
+
+	kinds := maps.Keys(txn.Changes)
+	slices.Sort(kinds)
+	for _, kind := range kinds {
+		ids := maps.Keys(txn.Changes[kind])
+		slices.Sort(ids)
+		for _, id := range ids {
+			if err := p.line(time.Time{}, "  "+kind+"/"+id, diffFields(txn.Changes[kind][id])); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *printer) manifest(rec client.ManifestRecord) error {
+	var fields map[string]any
+	must.OK(json.Unmarshal(must.OK1(json.Marshal(rec.Manifest)), &fields))
+	fields["Offset"] = float64(rec.Offset)
+	return p.line(rec.Time, "manifest", fields)
+}
+
+func (p *printer) entity(kind, id string, obj *wire.ActiveObject) error {
+	return p.line(obj.TS, kind+"/"+id, diffFields(obj.Props))
+}
+
+func diffFields(diff wire.Diff) map[string]any {
+	fields := map[string]any{}
+	for k, v := range diff {
+		var value any
+		if err := json.Unmarshal(v, &value); err != nil {
+			value = string(v) // print malformed values as is
+		}
+		fields[k] = value
+	}
+	return fields
+}
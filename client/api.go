@@ -9,13 +9,15 @@ import (
 // A Connection represents a logical connection to Limestone (may or may not be
 // backed by an actual network connection).
 type Connection interface {
-	// Submit submits an outgoing transaction and waits for it to be written
-	// through.
+	// Submit submits an outgoing transaction, waits for it to be written
+	// through and returns its position. A reader of the transaction log that
+	// has reached this position has seen the transaction. The position may be
+	// wire.Beginning if the client can't determine it.
 	//
 	// If called before Run has started up, blocks until then.
 	//
 	// May return ctx.Err() or wire.ErrMismatch.
-	Submit(ctx context.Context, txn wire.Transaction) error
+	Submit(ctx context.Context, txn wire.Transaction) (wire.Position, error)
 
 	// Run executes the connection. It reads transactions from the beginning of
 	// the history and writes them into the sink. Each time the hot end of the
@@ -38,7 +40,10 @@ type Client interface {
 	//
 	// The client may, but is not obligated to, take the specified filter into
 	// account. Entities and properties not matching the filter may or may not
-	// be filtered out.
+	// be filtered out. A transaction whose changes are filtered out entirely
+	// may be skipped or delivered as wire.PositionOnly; it is always delivered
+	// one way or another if it is the last one before the hot end or comes
+	// after it.
 	//
 	// If compact is true, the consumer is willing to accept compacted history.
 	// All or some of the transactions before the first hot end may be
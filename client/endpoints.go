@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpointCooldown is the time a server is avoided for after a failure, unless
+// all the servers have failed
+const endpointCooldown = 30 * time.Second
+
+// srvTTL is the time the result of an SRV lookup is reused for
+const srvTTL = 30 * time.Second
+
+// resolveFn returns the current list of server:port endpoints
+type resolveFn func(ctx context.Context) ([]string, error)
+
+func staticEndpoints(servers []string) resolveFn {
+	if len(servers) == 0 {
+		panic("no Limestone servers given")
+	}
+	return func(ctx context.Context) ([]string, error) {
+		return servers, nil
+	}
+}
+
+func srvEndpoints(name string) resolveFn {
+	var mu sync.Mutex
+	var cached []string
+	var expires time.Time
+
+	return func(ctx context.Context) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if time.Now().Before(expires) {
+			return cached, nil
+		}
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil && len(cached) == 0 {
+			return nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		if err == nil {
+			// LookupSRV sorts the records by priority and randomizes them by weight
+			servers := make([]string, 0, len(records))
+			for _, r := range records {
+				servers = append(servers, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+			}
+			if len(servers) == 0 {
+				return nil, fmt.Errorf("no SRV records for %s", name)
+			}
+			cached = servers
+		}
+		// On a lookup failure, keep using the last known endpoints
+		expires = time.Now().Add(srvTTL)
+		return cached, nil
+	}
+}
+
+// endpoints picks the servers to talk to, spreading the requests across the
+// healthy ones
+type endpoints struct {
+	resolve resolveFn
+
+	mu          sync.Mutex
+	next        int
+	failedUntil map[string]time.Time
+}
+
+func newEndpoints(resolve resolveFn) *endpoints {
+	return &endpoints{
+		resolve:     resolve,
+		failedUntil: map[string]time.Time{},
+	}
+}
+
+// pick returns the next healthy server in round-robin order. If all servers
+// have failed recently, the one that failed first is returned.
+func (e *endpoints) pick(ctx context.Context) (string, error) {
+	servers, err := e.resolve(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", errors.New("no Limestone servers available")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	start := e.next
+	e.next++
+	best := servers[start%len(servers)]
+	for i := range servers {
+		server := servers[(start+i)%len(servers)]
+		if !now.Before(e.failedUntil[server]) {
+			return server, nil
+		}
+		if e.failedUntil[server].Before(e.failedUntil[best]) {
+			best = server
+		}
+	}
+	return best, nil
+}
+
+// failed marks the server as unhealthy
+func (e *endpoints) failed(server string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.failedUntil[server] = time.Now().Add(endpointCooldown)
+}
+
+// succeeded marks the server as healthy
+func (e *endpoints) succeeded(server string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.failedUntil, server)
+}
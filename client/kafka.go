@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"time"
 
 	"github.com/ridge/limestone/kafka"
 	"github.com/ridge/limestone/tlog"
@@ -31,8 +32,9 @@ type kafkaConnection struct {
 	client      kafka.Client
 	maintenance bool
 
-	version int
-	pos     *kafkaPosition // position just before the next message to read
+	version    int
+	pos        *kafkaPosition // position just before the next message to read
+	generation int64          // of pos, for Submit
 
 	manifest      wire.Manifest
 	manifestErr   error
@@ -70,6 +72,13 @@ func formatPosition(pos *kafkaPosition) wire.Position {
 	return wire.Position(fmt.Sprintf("%016x-%016x", pos.generation, pos.offset))
 }
 
+// KafkaPosition returns the position of the message at the given offset in the
+// transaction log topic of the manifest at the given offset (generation) in
+// the master topic
+func KafkaPosition(generation, offset int64) wire.Position {
+	return formatPosition(&kafkaPosition{generation: generation, offset: offset})
+}
+
 // Connect implements interface Client
 func (kc KafkaClient) Connect(version int, pos wire.Position, filter wire.Filter, compact bool) Connection {
 	return &kafkaConnection{
@@ -173,6 +182,48 @@ func (kc KafkaClient) RetrieveManifest(ctx context.Context, waitForManifest bool
 	return res, nil
 }
 
+// ManifestRecord is a manifest as published in the master topic
+type ManifestRecord struct {
+	Offset   int64     // in the master topic, serves as the generation of positions
+	Time     time.Time // of publication
+	Manifest wire.Manifest
+}
+
+// ManifestHistory retrieves all the manifests published so far, oldest first,
+// including the maintenance ones
+func (kc KafkaClient) ManifestHistory(ctx context.Context) ([]ManifestRecord, error) {
+	var res []ManifestRecord
+	err := parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		messages := make(chan *kafka.IncomingMessage)
+		spawn("client", parallel.Fail, func(ctx context.Context) error {
+			return kc.client.Read(ctx, masterTopic, 0, messages)
+		})
+		spawn("consumer", parallel.Exit, func(ctx context.Context) error {
+			for {
+				var msg *kafka.IncomingMessage
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg = <-messages:
+				}
+				if msg == nil { // reached hot end
+					return nil
+				}
+				rec := ManifestRecord{Offset: msg.Offset, Time: msg.Time}
+				if err := json.Unmarshal(msg.Value, &rec.Manifest); err != nil {
+					return fmt.Errorf("failed to parse manifest %q", msg.Value)
+				}
+				res = append(res, rec)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve manifest history: %w", err)
+	}
+	return res, nil
+}
+
 func (kc *kafkaConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) error {
 	logger := tlog.Get(ctx)
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
@@ -203,6 +254,7 @@ func (kc *kafkaConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTr
 				kc.manifestErr = wire.ErrContinuityBroken
 			}
 		}
+		kc.generation = kc.pos.generation
 		close(kc.manifestReady)
 		if kc.manifestErr != nil {
 			return kc.manifestErr
@@ -254,34 +306,42 @@ func (kc *kafkaConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTr
 	})
 }
 
-func (kc *kafkaConnection) Submit(ctx context.Context, txn wire.Transaction) error {
+func (kc *kafkaConnection) Submit(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return wire.Beginning, ctx.Err()
 	case <-kc.manifestReady:
 		if kc.manifestErr != nil {
-			return kc.manifestErr
+			return wire.Beginning, kc.manifestErr
 		}
 	}
-	return PublishKafkaTransaction(ctx, kc.client, kc.manifest.Topic, txn)
+
+	topic := kc.manifest.Topic
+	offset, err := kc.client.Write(ctx, topic, []kafka.Message{{Topic: topic, Value: must.OK1(json.Marshal(txn))}})
+	if err != nil {
+		return wire.Beginning, err
+	}
+	return formatPosition(&kafkaPosition{generation: kc.generation, offset: offset}), nil
 }
 
 // PublishKafkaTransaction publishes a transaction in the given topic.
 // For use in database initialization/maintenance/conversion tools only.
 func PublishKafkaTransaction(ctx context.Context, client kafka.Client, topic string, txn wire.Transaction) error {
-	return client.Write(ctx, topic, []kafka.Message{{
+	_, err := client.Write(ctx, topic, []kafka.Message{{
 		Topic: topic,
 		Value: must.OK1(json.Marshal(txn)),
 	}})
+	return err
 }
 
 // PublishKafkaManifest publishes a new manifest into the master Kafka topic.
 // For use in database initialization/maintenance/conversion tools only.
 func PublishKafkaManifest(ctx context.Context, client kafka.Client, manifest wire.Manifest) error {
-	return client.Write(ctx, masterTopic, []kafka.Message{{
+	_, err := client.Write(ctx, masterTopic, []kafka.Message{{
 		Topic: masterTopic,
 		Value: must.OK1(json.Marshal(manifest)),
 	}})
+	return err
 }
 
 // PredictPosition figures out the wire.Position that will describe the Kafka
@@ -75,6 +75,25 @@ func TestKafkaClientRetrieveManifest(t *testing.T) {
 	require.Equal(t, wire.Manifest{Version: 2, Topic: "txlog2"}, m)
 }
 
+func TestKafkaClientManifestHistory(t *testing.T) {
+	env := kafkaTestSetup(t)
+
+	history, err := env.client.ManifestHistory(env.group.Context())
+	require.NoError(t, err)
+	require.Empty(t, history)
+
+	require.NoError(t, PublishKafkaManifest(env.group.Context(), env.kafka, wire.Manifest{Version: 1, Topic: "txlog"}))
+	require.NoError(t, PublishKafkaManifest(env.group.Context(), env.kafka, wire.Manifest{Version: 1, Topic: "txlog", Maintenance: true}))
+	history, err = env.client.ManifestHistory(env.group.Context())
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, int64(0), history[0].Offset)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog"}, history[0].Manifest)
+	require.NotZero(t, history[0].Time)
+	require.Equal(t, int64(1), history[1].Offset)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog", Maintenance: true}, history[1].Manifest)
+}
+
 func TestKafkaClientRead(t *testing.T) {
 	env := kafkaTestSetup(t)
 
@@ -147,7 +166,8 @@ func TestKafkaClientSubmit(t *testing.T) {
 	})
 
 	require.Nil(t, <-msg)
-	require.NoError(t, conn.Submit(env.group.Context(), testTxn1))
+	_, err := conn.Submit(env.group.Context(), testTxn1)
+	require.NoError(t, err)
 	raw := <-msg
 	var in wire.Transaction
 	require.NoError(t, json.Unmarshal(raw.Value, &in))
@@ -161,7 +181,9 @@ func TestKafkaClientEcho(t *testing.T) {
 	require.NoError(t, PublishKafkaManifest(env.group.Context(), env.kafka, wire.Manifest{Version: 1, Topic: "txlog"}))
 	require.Nil(t, <-incoming)
 
-	require.NoError(t, conn.Submit(env.group.Context(), testTxn1))
+	pos, err := conn.Submit(env.group.Context(), testTxn1)
+	require.NoError(t, err)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000000"), pos)
 	in := <-incoming
 	require.Equal(t, wire.Position("0000000000000000-0000000000000000"), in.Position)
 	require.NotZero(t, in.TS)
@@ -176,7 +198,8 @@ func TestKafkaClientDerail(t *testing.T) {
 	conn, incoming, res := env.spawnConnectionFail(1, wire.Beginning, nil)
 	require.NoError(t, PublishKafkaManifest(env.group.Context(), env.kafka, wire.Manifest{Version: 1, Topic: "txlog"}))
 	require.Nil(t, <-incoming)
-	require.NoError(t, conn.Submit(env.group.Context(), testTxn1))
+	_, err := conn.Submit(env.group.Context(), testTxn1)
+	require.NoError(t, err)
 	in := <-incoming
 	require.Equal(t, wire.Position("0000000000000000-0000000000000000"), in.Position)
 	require.NotZero(t, in.TS)
@@ -194,7 +217,8 @@ func TestKafkaClientDerail(t *testing.T) {
 
 	conn, incoming = env.spawnConnection(1, wire.Beginning, nil)
 	require.Nil(t, <-incoming)
-	require.NoError(t, conn.Submit(env.group.Context(), testTxn2))
+	_, err = conn.Submit(env.group.Context(), testTxn2)
+	require.NoError(t, err)
 	in = <-incoming
 	require.Equal(t, wire.Position("0000000000000001-0000000000000000"), in.Position)
 	require.NotZero(t, in.TS)
@@ -213,5 +237,6 @@ func TestKafkaClientMismatch(t *testing.T) {
 	require.NoError(t, PublishKafkaManifest(env.group.Context(), env.kafka, wire.Manifest{Version: 3, Topic: "txlog"}))
 	require.Equal(t, wire.ErrVersionMismatch(2, 3), <-res)
 
-	require.EqualError(t, conn.Submit(env.group.Context(), testTxn1), wire.ErrVersionMismatch(2, 3).Error())
+	_, err := conn.Submit(env.group.Context(), testTxn1)
+	require.EqualError(t, err, wire.ErrVersionMismatch(2, 3).Error())
 }
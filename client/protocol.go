@@ -3,76 +3,224 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/ridge/limestone/meta"
 	"github.com/ridge/limestone/retry"
 	"github.com/ridge/limestone/thttp"
 	"github.com/ridge/limestone/tlog"
 	"github.com/ridge/limestone/tws"
 	"github.com/ridge/limestone/wire"
 	"github.com/ridge/must/v2"
+	"github.com/ridge/parallel"
 	"go.uber.org/zap"
-	"time"
+	"golang.org/x/oauth2"
 )
 
-const retryInterval = 5 * time.Second
+// DefaultRetry is the default backoff between reconnection and push attempts
+var DefaultRetry = retry.ExpConfig{
+	Min:    100 * time.Millisecond,
+	Max:    10 * time.Second,
+	Scale:  2.0,
+	Jitter: 0.2,
+}
 
 type protocolClient struct {
-	server        string
-	retryInterval time.Duration
+	endpoints *endpoints
+	options   Options
+}
+
+// Options are the connection options of a server-based Limestone client
+type Options struct {
+	// TLS enables wss:// and https:// with the given configuration (see
+	// run.TLSConfig). Nil means plaintext.
+	TLS *tls.Config
+
+	// TokenSource, if not nil, provides the bearer tokens sent with every
+	// request
+	TokenSource oauth2.TokenSource
+
+	// Retry configures the backoff between reconnection and push attempts.
+	// Zero value means DefaultRetry.
+	Retry retry.ExpConfig
+}
+
+// StaticToken returns a token source for a fixed bearer token
+func StaticToken(token string) oauth2.TokenSource {
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token, TokenType: "Bearer"})
 }
 
 // New creates a new server-based Limestone client for the given server:port
 func New(server string) Client {
-	return newProtocolClient(server, retryInterval)
+	return NewWithOptions(server, Options{})
+}
+
+// NewWithOptions creates a new server-based Limestone client for the given
+// server:port with the given options
+func NewWithOptions(server string, options Options) Client {
+	return NewMulti([]string{server}, options)
+}
+
+// NewMulti creates a new server-based Limestone client for a set of
+// equivalent servers given as server:port.
+//
+// Connections fail over to the next server on errors, resuming from the last
+// received position. The servers that have failed recently are avoided.
+func NewMulti(servers []string, options Options) Client {
+	return newProtocolClient(staticEndpoints(servers), options)
+}
+
+// NewSRV creates a new server-based Limestone client for the servers listed in
+// DNS SRV records under the given name (e.g. _limestone._tcp.example.com).
+// Otherwise it behaves like NewMulti.
+func NewSRV(name string, options Options) Client {
+	return newProtocolClient(srvEndpoints(name), options)
 }
 
-func newProtocolClient(server string, retryInterval time.Duration) protocolClient {
+func newProtocolClient(resolve resolveFn, options Options) protocolClient {
+	if options.Retry == (retry.ExpConfig{}) {
+		options.Retry = DefaultRetry
+	}
 	return protocolClient{
-		server:        server,
-		retryInterval: retryInterval,
+		endpoints: newEndpoints(resolve),
+		options:   options,
+	}
+}
+
+func (pc protocolClient) url(scheme, server, path string) string {
+	if pc.options.TLS != nil {
+		scheme += "s"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, server, path)
+}
+
+// newHTTPClient returns the HTTP client for pushing transactions to older
+// servers
+func (pc protocolClient) newHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if pc.options.TLS != nil {
+		transport.TLSClientConfig = pc.options.TLS.Clone()
+	}
+	var rt http.RoundTripper = transport
+	if pc.options.TokenSource != nil {
+		rt = &oauth2.Transport{Source: pc.options.TokenSource, Base: transport}
 	}
+	return thttp.WithRequestsLogging(&http.Client{Transport: rt})
+}
+
+// dialHeaders returns the headers for the WebSocket handshake
+func (pc protocolClient) dialHeaders() (http.Header, error) {
+	if pc.options.TokenSource == nil {
+		return nil, nil
+	}
+	token, err := pc.options.TokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain token: %w", err)
+	}
+	headers := http.Header{}
+	token.SetAuthHeader(&http.Request{Header: headers})
+	return headers, nil
 }
 
 type protocolConnection struct {
-	client     protocolClient
-	version    int
-	pos        wire.Position
-	filter     wire.Filter
-	compact    bool
-	httpClient *http.Client
-	sink       chan<- *wire.IncomingTransaction
-	ready      chan struct{}
+	client    protocolClient
+	version   int
+	pos       wire.Position
+	resume    *wire.HotStartChunk // the last hot start message received, if the hot start is in progress
+	filter    wire.Filter
+	where     wire.Where
+	local     *wire.RowFilter // set if the server does not support predicates
+	skipTo    wire.Position   // with local predicates: the last position delivered before switching to them
+	compact   bool
+	sink      chan<- *wire.IncomingTransaction
+	ready     chan struct{}
+	server    string // of the current session
+	connected bool   // the current session has been established
+	http      *http.Client
+	submits   chan *submission
+	submitID  atomic.Int64
+
+	done chan struct{} // closed when Run returns
+	err  error         // returned by Run
 }
 
 func (pc protocolClient) Connect(version int, pos wire.Position, filter wire.Filter, compact bool) Connection {
+	return pc.ConnectWhere(version, pos, filter, nil, compact)
+}
+
+// ConnectWhere implements interface PredicateClient: the predicates are
+// applied by the server.
+//
+// An older server that does not support predicates doesn't acknowledge them.
+// In that case the connection falls back to applying the predicates locally,
+// as ConnectWhere does: it reconnects from the beginning and skips the
+// transactions up to pos. The local state is kept across reconnections, so
+// those resume from the last position.
+func (pc protocolClient) ConnectWhere(version int, pos wire.Position, filter wire.Filter, where wire.Where, compact bool) Connection {
 	return &protocolConnection{
 		client:  pc,
 		version: version,
 		pos:     pos,
 		filter:  filter,
+		where:   where,
 		compact: compact,
 		ready:   make(chan struct{}),
+		submits: make(chan *submission),
+		done:    make(chan struct{}),
 	}
 }
 
-func (pc *protocolConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) error {
+func (pc *protocolConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) (err error) {
 	logger := tlog.Get(ctx)
 
-	pc.httpClient = thttp.WithRequestsLogging(&http.Client{})
+	defer func() {
+		pc.err = err
+		close(pc.done)
+	}()
 	pc.sink = sink
+	pc.http = pc.client.newHTTPClient()
 	close(pc.ready)
-	url := fmt.Sprintf("ws://%s/pull", pc.client.server)
+	config := tws.StreamerConfig
+	config.TLSClientConfig = pc.client.options.TLS
+	backoff := retry.NewExpBackoff(pc.client.options.Retry)
 	for {
-		logger.Debug("Trying to connect to Limestone server", zap.String("url", url))
-		err := tws.Dial(ctx, url, nil, tws.StreamerConfig, pc.session)
+		server, err := pc.client.endpoints.pick(ctx)
+		if err == nil {
+			url := pc.client.url("ws", server, "/pull")
+			logger.Debug("Trying to connect to Limestone server", zap.String("url", url))
+			var headers http.Header
+			headers, err = pc.client.dialHeaders()
+			if err == nil {
+				pc.server = server
+				pc.connected = false
+				err = tws.Dial(ctx, url, headers, config, pc.session)
+			}
+			if errors.Is(err, errNoPredicates) {
+				logger.Warn("Limestone server does not support predicates, applying them locally", zap.String("url", url))
+				pc.filterLocally()
+				continue
+			}
+			if pc.connected {
+				// The server has been working: reconnect quickly, to another
+				// server if this one keeps failing
+				pc.client.endpoints.succeeded(server)
+				backoff.Reset()
+			}
+			if err != nil && ctx.Err() == nil {
+				pc.client.endpoints.failed(server)
+			}
+		}
 		if err != nil && !errors.Is(err, ctx.Err()) {
-			logger.Debug("Connection to Limestone server failed", zap.String("url", url), zap.Error(err))
+			logger.Debug("Connection to Limestone server failed", zap.Error(err))
 		}
 		var mismatch wire.ErrMismatch
 		if errors.As(err, &mismatch) {
@@ -85,7 +233,7 @@ func (pc *protocolConnection) Run(ctx context.Context, sink chan<- *wire.Incomin
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case <-time.After(pc.client.retryInterval):
+		case <-time.After(backoff.Backoff()):
 		}
 	}
 }
@@ -93,7 +241,10 @@ func (pc *protocolConnection) Run(ctx context.Context, sink chan<- *wire.Incomin
 func (pc *protocolConnection) session(ctx context.Context, incoming <-chan tws.Message, outgoing chan<- tws.Message) (err error) {
 	logger := tlog.Get(ctx)
 
-	req := wire.Request{Version: pc.version, Last: pc.pos, Filter: pc.filter, Compact: pc.compact}
+	req := wire.Request{Version: pc.version, Last: pc.pos, Filter: pc.filter, Compact: pc.compact, Where: pc.where, Resume: pc.resume, Secrets: meta.Secrets()}
+	if pc.local != nil {
+		req.Where = nil
+	}
 	// FIXME (alexey): request field temporarily renamed to limestoneRequest to
 	// work around Elasticsearch restriction that the same field name cannot be
 	// used for a string value in one message and for an object in any other
@@ -104,15 +255,17 @@ func (pc *protocolConnection) session(ctx context.Context, incoming <-chan tws.M
 		return ctx.Err()
 	case outgoing <- tws.Message{Data: must.OK1(json.Marshal(req))}:
 	}
+	pc.connected = true
 
-	// The hot start sequence is non-interruptible: hot start messages don't
-	// have a position which is used as a restart token. Restarting without a
-	// restart token can lead to local data corruption.
+	// Hot start messages don't have a position which is used as a restart
+	// token. Instead, they carry a hot start chunk which allows the server (or
+	// another one) to continue the hot start. Restarting without a restart
+	// token can lead to local data corruption, so a hot start message without
+	// a chunk (sent by an older server) makes the hot start non-interruptible.
 	//
-	// An interruption during hot start causes a soft restart: the service exits
-	// and restarts without logging a panic. This should be very unlikely
-	// because in the normal order in which services are restarted, the
-	// limestone server restarts first.
+	// An interruption of a non-interruptible hot start, or a server that
+	// cannot resume the hot start, causes a soft restart: the service exits and
+	// restarts without logging a panic.
 	restartable := true
 	defer func() {
 		var mismatch wire.ErrMismatch
@@ -125,87 +278,298 @@ func (pc *protocolConnection) session(ctx context.Context, incoming <-chan tws.M
 		}
 	}()
 
-	for {
-		var notification wire.Notification
+	// The acks are handled as soon as they are received, even if the sink is
+	// not being read: the reader of the sink may be waiting for an ack itself.
+	// The notifications are queued in the meantime. Otherwise the queue is
+	// limited, to keep the flow control of the connection.
+	var mu sync.Mutex
+	var queue []wire.Notification
+	queued := make(chan struct{}, 1)
+	wake := make(chan struct{}, 1) // the queue has been drained or an ack is awaited
+	pending := map[int64]*submission{}
+	// The first notification tells what the server supports. Older servers
+	// don't accept submits over WS, and don't support predicates.
+	hello := make(chan struct{}) // closed after the first notification
+	var wsSubmit bool
+	signal := func(ch chan struct{}) {
 		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case msg, ok := <-incoming:
-			if !ok {
-				return nil
-			}
-			if err := json.Unmarshal(msg.Data, &notification); err != nil {
-				return fmt.Errorf("failed to parse incoming WS message: %w", err)
-			}
+		case ch <- struct{}{}:
+		default:
 		}
-
-		if notification.Err != "" {
-			return notification.Err
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range pending {
+			close(s.res) // to be retried over the next connection
 		}
+	}()
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("read", parallel.Exit, func(ctx context.Context) error {
+			for {
+				mu.Lock()
+				full := len(queue) >= maxQueuedNotifications && len(pending) == 0
+				mu.Unlock()
+				if full {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case <-wake:
+					}
+					continue
+				}
+
+				var notification wire.Notification
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg, ok := <-incoming:
+					if !ok {
+						return nil
+					}
+					if err := json.Unmarshal(msg.Data, &notification); err != nil {
+						return fmt.Errorf("failed to parse incoming WS message: %w", err)
+					}
+				}
+
+				if notification.Err != "" {
+					return notification.Err
+				}
+
+				select {
+				case <-hello:
+				default:
+					if req.Where != nil && !notification.Where {
+						return errNoPredicates
+					}
+					wsSubmit = notification.Submit
+					close(hello)
+				}
+
+				if ack := notification.Ack; ack != nil {
+					mu.Lock()
+					s := pending[ack.ID]
+					delete(pending, ack.ID)
+					mu.Unlock()
+					if s != nil {
+						res := submitResult{pos: ack.Position}
+						if ack.Err != "" {
+							res.err = retry.Retriable(errors.New(ack.Err))
+						}
+						s.res <- res
+					}
+				}
+
+				if notification.Txn != nil || notification.Hot {
+					mu.Lock()
+					queue = append(queue, notification)
+					mu.Unlock()
+					signal(queued)
+				}
+			}
+		})
 
-		if notification.Txn != nil {
-			pc.pos = notification.Txn.Position
-			restartable = pc.pos != "" // cannot restart without a nonempty position
+		spawn("submit", parallel.Fail, func(ctx context.Context) error {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case pc.sink <- notification.Txn:
+			case <-hello:
+			}
+			if !wsSubmit {
+				logger.Info("Limestone server does not accept transactions over WebSocket, pushing over HTTP")
+			}
+			for {
+				var s *submission
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case s = <-pc.submits:
+				}
+				if !wsSubmit {
+					pos, err := pc.push(ctx, s.txn)
+					s.res <- submitResult{pos: pos, err: err}
+					continue
+				}
+				mu.Lock()
+				pending[s.id] = s
+				mu.Unlock()
+				signal(wake)
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Request{Submit: &wire.Submit{ID: s.id, Txn: s.txn}}))}:
+				}
+			}
+		})
+
+		spawn("deliver", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-queued:
+				}
+				mu.Lock()
+				notifications := queue
+				queue = nil
+				mu.Unlock()
+				signal(wake)
+
+				for _, notification := range notifications {
+					if notification.Txn != nil {
+						pc.pos = notification.Txn.Position
+						pc.resume = notification.HotStart
+						restartable = pc.pos != "" || pc.resume != nil // cannot restart without a restart token
+						if txn := pc.applyLocal(notification.Txn); txn != nil {
+							select {
+							case <-ctx.Done():
+								return ctx.Err()
+							case pc.sink <- txn:
+							}
+						}
+					}
+
+					if notification.Hot {
+						if pc.skipTo != wire.Beginning {
+							return wire.ErrContinuityBroken
+						}
+						restartable = true
+						select {
+						case <-ctx.Done():
+							return ctx.Err()
+						case pc.sink <- nil:
+						}
+					}
+				}
 			}
+		})
+
+		return nil
+	})
+}
+
+// errNoPredicates is returned by the session if the server has not
+// acknowledged the predicates
+var errNoPredicates = errors.New("predicates not supported by the server")
+
+// filterLocally switches the connection to applying the predicates locally.
+// The transactions up to the current position have been delivered already, so
+// they are replayed silently.
+func (pc *protocolConnection) filterLocally() {
+	pc.local = wire.NewRowFilter(pc.where)
+	pc.filter = wherePropFilter(pc.filter, pc.where)
+	pc.compact = pc.compact && pc.pos == wire.Beginning
+	pc.skipTo = pc.pos
+	pc.pos = wire.Beginning
+	pc.resume = nil
+}
+
+// applyLocal applies the local predicates, if any, to the incoming
+// transaction. Returns nil if there is nothing to deliver, not even the
+// position.
+func (pc *protocolConnection) applyLocal(txn *wire.IncomingTransaction) *wire.IncomingTransaction {
+	if pc.local == nil {
+		return txn
+	}
+	changes := pc.local.Apply(txn.Changes)
+	if pc.skipTo != wire.Beginning {
+		if txn.Position == pc.skipTo {
+			pc.skipTo = wire.Beginning
 		}
+		return nil
+	}
+	if changes == nil {
+		return wire.PositionOnly(txn.Position)
+	}
+	filtered := *txn
+	filtered.Changes = changes
+	return &filtered
+}
 
-		if notification.Hot {
-			restartable = true
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case pc.sink <- nil:
+// maxQueuedNotifications is the number of received notifications after which
+// the reading stops until they are delivered, unless an ack is awaited
+const maxQueuedNotifications = 100
+
+// submission is a transaction submitted over the WS connection, waiting for
+// the ack
+type submission struct {
+	id  int64
+	txn wire.Transaction
+	res chan submitResult // closed if the connection is lost before the ack
+}
+
+type submitResult struct {
+	pos wire.Position
+	err error
+}
+
+// push submits a transaction over HTTP to the server of the current session,
+// for older servers not accepting submits over WS
+func (pc *protocolConnection) push(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
+	url := pc.client.url("http", pc.server, fmt.Sprintf("/push?version=%d", pc.version))
+	ctx = tlog.With(ctx, zap.String("url", url))
+	req := must.OK1(http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(must.OK1(json.Marshal(txn)))))
+	res, err := pc.http.Do(req)
+	if err != nil {
+		return wire.Beginning, retry.Retriable(err)
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		// wire.Beginning if the server is too old to report the position
+		return wire.Position(res.Header.Get(wire.PositionHeader)), nil
+	case http.StatusConflict, http.StatusServiceUnavailable:
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return wire.Beginning, retry.Retriable(fmt.Errorf("failed to read error response: %w", err))
+		}
+		errText := strings.TrimSpace(string(b))
+		if errText != "" {
+			err := wire.ErrMismatch(errText)
+			if res.StatusCode == http.StatusServiceUnavailable {
+				// When the server's version is behind ours, the server
+				// reports it as a retriable 5xx error. This can happen
+				// during an upgrade, so we should retry and expect the new
+				// Limestone server to respond.
+				return wire.Beginning, retry.Retriable(err)
 			}
+			return wire.Beginning, err
 		}
+		fallthrough
+	default:
+		return wire.Beginning, retry.Retriable(fmt.Errorf("%s returned status code %d", url, res.StatusCode))
 	}
 }
 
-func (pc *protocolConnection) Submit(ctx context.Context, txn wire.Transaction) error {
+func (pc *protocolConnection) Submit(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return wire.Beginning, ctx.Err()
 	case <-pc.ready:
 	}
 
-	url := fmt.Sprintf("http://%s/push?version=%d", pc.client.server, pc.version)
-	body := must.OK1(json.Marshal(txn))
-	ctx = tlog.With(ctx, zap.String("url", url))
-
-	return retry.Do(ctx, retry.FixedConfig{RetryAfter: pc.client.retryInterval}, func() error {
-		req := must.OK1(http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body)))
-		res, err := pc.httpClient.Do(req)
-		if err != nil {
-			return retry.Retriable(err)
+	// A transaction not acknowledged before the connection is lost is
+	// submitted again over the next one. This is safe: duplicates are dropped
+	// by the servers and readers (see wire.Dedup).
+	return retry.Do1(ctx, pc.client.options.Retry, func() (wire.Position, error) {
+		s := &submission{id: pc.submitID.Add(1), txn: txn, res: make(chan submitResult, 1)}
+		select {
+		case <-ctx.Done():
+			return wire.Beginning, ctx.Err()
+		case <-pc.done:
+			return wire.Beginning, pc.err
+		case pc.submits <- s:
 		}
-		defer res.Body.Close()
-
-		switch res.StatusCode {
-		case http.StatusNoContent:
-			return nil
-		case http.StatusConflict, http.StatusServiceUnavailable:
-			b, err := io.ReadAll(res.Body)
-			if err != nil {
-				return retry.Retriable(fmt.Errorf("failed to read error response: %w", err))
-			}
-			errText := strings.TrimSpace(string(b))
-			if errText != "" {
-				err := wire.ErrMismatch(errText)
-				if res.StatusCode == http.StatusServiceUnavailable {
-					// When the server's version is behind ours, the server
-					// reports it as a retriable 5xx error. This can happen
-					// during an upgrade, so we should retry and expect the new
-					// Limestone server to respond.
-					return retry.Retriable(err)
-				}
-				return err
+
+		select {
+		case <-ctx.Done():
+			return wire.Beginning, ctx.Err()
+		case res, ok := <-s.res:
+			if !ok {
+				return wire.Beginning, retry.Retriable(errors.New("connection to Limestone server lost"))
 			}
-			fallthrough
-		default:
-			return retry.Retriable(fmt.Errorf("%s returned status code %d", url, res.StatusCode))
+			return res.pos, res.err
 		}
 	})
 }
@@ -4,12 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
-	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/ridge/limestone/retry"
 	"github.com/ridge/limestone/test"
 	"github.com/ridge/limestone/thttp"
 	"github.com/ridge/limestone/tnet"
@@ -18,22 +18,35 @@ import (
 	"github.com/ridge/must/v2"
 	"github.com/ridge/parallel"
 	"github.com/stretchr/testify/require"
-	"time"
 )
 
+var testRetry = retry.ExpConfig{Min: time.Millisecond, Max: 10 * time.Millisecond, Scale: 2}
+
 type protocolTestEnv struct {
 	group *parallel.Group
 
 	client Client
+	addr   string
 	conns  int
 
-	conn <-chan wire.Request
-	up   <-chan wire.Transaction
-	down chan<- *wire.IncomingTransaction
-	drop chan<- struct{}
+	conn   <-chan wire.Request
+	up     <-chan wire.Transaction
+	down   chan<- *wire.IncomingTransaction
+	notify chan<- wire.Notification
+	drop   chan<- struct{}
 }
 
 func protocolTestSetup(t *testing.T) *protocolTestEnv {
+	return newProtocolTestEnv(t, false)
+}
+
+// legacyProtocolTestSetup sets up a server that neither acknowledges
+// predicates nor accepts submits over WS, only over HTTP
+func legacyProtocolTestSetup(t *testing.T) *protocolTestEnv {
+	return newProtocolTestEnv(t, true)
+}
+
+func newProtocolTestEnv(t *testing.T, legacy bool) *protocolTestEnv {
 	var env protocolTestEnv
 
 	env.group = test.Group(t)
@@ -41,6 +54,7 @@ func protocolTestSetup(t *testing.T) *protocolTestEnv {
 	conn := make(chan wire.Request, 1)
 	up := make(chan wire.Transaction, 1)
 	down := make(chan *wire.IncomingTransaction, 1)
+	notify := make(chan wire.Notification, 1)
 	drop := make(chan struct{}, 1)
 
 	router := mux.NewRouter()
@@ -61,6 +75,13 @@ func protocolTestSetup(t *testing.T) *protocolTestEnv {
 						return nil
 					}
 				}
+				if !legacy {
+					select {
+					case <-ctx.Done():
+						return ctx.Err()
+					case outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Notification{Submit: true}))}:
+					}
+				}
 			}
 			for {
 				var notification wire.Notification
@@ -71,6 +92,15 @@ func protocolTestSetup(t *testing.T) *protocolTestEnv {
 					if notification.Txn == nil {
 						notification.Hot = true
 					}
+				case notification = <-notify:
+				case msg, ok := <-incoming:
+					if !ok {
+						return nil
+					}
+					var req wire.Request
+					must.OK(json.Unmarshal(msg.Data, &req))
+					up <- req.Submit.Txn
+					notification.Ack = &wire.Ack{ID: req.Submit.ID, Position: "0000000000000000-0000000000000009"}
 				case <-drop:
 					return nil
 				}
@@ -82,25 +112,32 @@ func protocolTestSetup(t *testing.T) *protocolTestEnv {
 			}
 		})
 	})
-	router.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
-		expected, _ := strconv.Atoi(r.URL.Query().Get("version"))
-		if expected != 1 {
-			http.Error(w, string(wire.ErrVersionMismatch(expected, 1)), http.StatusConflict)
-			return
-		}
-		var txn wire.Transaction
-		must.OK(json.Unmarshal(must.OK1(io.ReadAll(r.Body)), &txn))
-		up <- txn
-		w.WriteHeader(http.StatusNoContent)
-	})
-
+	if legacy {
+		router.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("version") != "1" {
+				w.WriteHeader(http.StatusConflict)
+				fmt.Fprintln(w, "version mismatch")
+				return
+			}
+			var txn wire.Transaction
+			must.OK(json.NewDecoder(r.Body).Decode(&txn))
+			up <- txn
+			if txn.Seq != 0 {
+				// a server that reports the position of pushed transactions
+				w.Header().Set(wire.PositionHeader, "0000000000000000-0000000000000002")
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}).Methods(http.MethodPost)
+	}
 	server := thttp.NewServer(tnet.ListenOnRandomPort(), thttp.StandardMiddleware(router))
-	env.client = newProtocolClient(server.ListenAddr().String(), time.Millisecond)
+	env.addr = server.ListenAddr().String()
+	env.client = newProtocolClient(staticEndpoints([]string{env.addr}), Options{Retry: testRetry})
 	env.group.Spawn("http", parallel.Fail, server.Run)
 
 	env.conn = conn
 	env.up = up
 	env.down = down
+	env.notify = notify
 	env.drop = drop
 
 	return &env
@@ -146,7 +183,61 @@ func TestProtocolPush(t *testing.T) {
 	conn, _ := env.spawnConnection(1, wire.Beginning, nil)
 	require.Equal(t, wire.Request{Version: 1}, <-env.conn)
 
-	require.NoError(t, conn.Submit(env.group.Context(), testTxn1))
+	pos, err := conn.Submit(env.group.Context(), testTxn1)
+	require.NoError(t, err)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000009"), pos)
+	require.Equal(t, testTxn1, <-env.up)
+}
+
+func TestProtocolPushLegacy(t *testing.T) {
+	env := legacyProtocolTestSetup(t)
+
+	conn, incoming := env.spawnConnection(1, wire.Beginning, nil)
+	require.Equal(t, wire.Request{Version: 1}, <-env.conn)
+
+	// The server tells nothing about submits until the first notification
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn1, Position: wire.Position("0000000000000000-0000000000000001")}
+	require.Equal(t, wire.Position("0000000000000000-0000000000000001"), (<-incoming).Position)
+
+	pos, err := conn.Submit(env.group.Context(), testTxn2)
+	require.NoError(t, err)
+	require.Equal(t, wire.Beginning, pos) // an older server
+	require.Equal(t, testTxn2, <-env.up)
+
+	txn := testTxn2
+	txn.Seq = 1
+	pos, err = conn.Submit(env.group.Context(), txn)
+	require.NoError(t, err)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000002"), pos)
+	require.Equal(t, txn, <-env.up)
+}
+
+func TestProtocolPushWhileNotReading(t *testing.T) {
+	env := protocolTestSetup(t)
+
+	conn, incoming := env.spawnConnection(1, wire.Beginning, nil)
+	require.Equal(t, wire.Request{Version: 1}, <-env.conn)
+
+	// The sink is not read while submitting, as in the DB processing loop
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn1, Position: wire.Position("0000000000000000-0000000000000001")}
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn1, Position: wire.Position("0000000000000000-0000000000000002")}
+	_, err := conn.Submit(env.group.Context(), testTxn2)
+	require.NoError(t, err)
+	require.Equal(t, testTxn2, <-env.up)
+
+	require.Equal(t, wire.Position("0000000000000000-0000000000000001"), (<-incoming).Position)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000002"), (<-incoming).Position)
+}
+
+func TestProtocolPushRetry(t *testing.T) {
+	env := protocolTestSetup(t)
+
+	conn, _ := env.spawnConnection(1, wire.Beginning, nil)
+	require.Equal(t, wire.Request{Version: 1}, <-env.conn)
+
+	env.drop <- struct{}{}
+	_, err := conn.Submit(env.group.Context(), testTxn1)
+	require.NoError(t, err)
 	require.Equal(t, testTxn1, <-env.up)
 }
 
@@ -157,7 +248,8 @@ func TestProtocolPushMismatch(t *testing.T) {
 	require.Equal(t, wire.Request{Version: 2}, <-env.conn)
 
 	require.Error(t, <-res, wire.ErrVersionMismatch(2, 1).Error())
-	require.EqualError(t, conn.Submit(env.group.Context(), testTxn1), wire.ErrVersionMismatch(2, 1).Error())
+	_, err := conn.Submit(env.group.Context(), testTxn1)
+	require.EqualError(t, err, wire.ErrVersionMismatch(2, 1).Error())
 }
 
 func TestProtocolRetry(t *testing.T) {
@@ -179,3 +271,139 @@ func TestProtocolRetry(t *testing.T) {
 	env.down <- nil
 	require.Nil(t, <-incoming)
 }
+
+func TestProtocolResumeHotStart(t *testing.T) {
+	env := protocolTestSetup(t)
+
+	incoming := make(chan *wire.IncomingTransaction)
+	conn := env.client.Connect(1, wire.Beginning, nil, true)
+	env.group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+		return conn.Run(ctx, incoming)
+	})
+	require.Equal(t, wire.Request{Version: 1, Compact: true}, <-env.conn)
+
+	chunk := wire.HotStartChunk{Position: "0000000000000000-0000000000000005", Seq: 0}
+	hotStartTxn := &wire.IncomingTransaction{Transaction: wire.Transaction{Changes: testTxn1.Changes}}
+	env.notify <- wire.Notification{Txn: hotStartTxn, HotStart: &chunk}
+	require.Equal(t, hotStartTxn, <-incoming)
+
+	env.drop <- struct{}{}
+	require.Equal(t, wire.Request{Version: 1, Compact: true, Resume: &chunk}, <-env.conn)
+
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn2, Position: wire.Position("0000000000000000-0000000000000006")}
+	require.Equal(t, &wire.IncomingTransaction{Transaction: testTxn2, Position: wire.Position("0000000000000000-0000000000000006")}, <-incoming)
+
+	env.drop <- struct{}{}
+	require.Equal(t, wire.Request{Version: 1, Last: wire.Position("0000000000000000-0000000000000006"), Compact: true}, <-env.conn)
+}
+
+func TestProtocolFailover(t *testing.T) {
+	env := protocolTestSetup(t)
+
+	dead := tnet.ListenOnRandomPort()
+	require.NoError(t, dead.Close())
+	env.client = newProtocolClient(staticEndpoints([]string{dead.Addr().String(), env.addr}), Options{Retry: testRetry})
+
+	conn, incoming := env.spawnConnection(1, wire.Beginning, nil)
+	require.Equal(t, wire.Request{Version: 1}, <-env.conn)
+
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn1, Position: wire.Position("0000000000000000-0000000000000000-0000000000000000")}
+	require.Equal(t, &wire.IncomingTransaction{Transaction: testTxn1, Position: wire.Position("0000000000000000-0000000000000000-0000000000000000")}, <-incoming)
+
+	env.drop <- struct{}{}
+	require.Equal(t, wire.Request{Version: 1, Last: wire.Position("0000000000000000-0000000000000000-0000000000000000")}, <-env.conn)
+
+	for i := 0; i < 3; i++ {
+		_, err := conn.Submit(env.group.Context(), testTxn2)
+		require.NoError(t, err)
+		require.Equal(t, testTxn2, <-env.up)
+	}
+}
+
+func TestProtocolWhereFallback(t *testing.T) {
+	env := legacyProtocolTestSetup(t)
+
+	where := wire.Where{"apple": {{Prop: "Color", In: []json.RawMessage{json.RawMessage(`"red"`)}}}}
+	incoming := make(chan *wire.IncomingTransaction)
+	conn := env.client.(PredicateClient).ConnectWhere(1, wire.Position("0000000000000000-0000000000000002"), nil, where, false)
+	env.group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+		return conn.Run(ctx, incoming)
+	})
+	require.Equal(t, wire.Request{Version: 1, Last: wire.Position("0000000000000000-0000000000000002"), Where: where}, <-env.conn)
+
+	// The test server does not acknowledge the predicates
+	green := wire.Transaction{Changes: wire.Changes{"apple": wire.KindChanges{"b": wire.Diff{"Color": json.RawMessage(`"green"`), "Size": json.RawMessage(`1`)}}}}
+	red := wire.Transaction{Changes: wire.Changes{"apple": wire.KindChanges{"b": wire.Diff{"Color": json.RawMessage(`"red"`)}}}}
+	env.down <- &wire.IncomingTransaction{Transaction: red, Position: wire.Position("0000000000000000-0000000000000003")}
+	require.Equal(t, wire.Request{Version: 1}, <-env.conn)
+
+	// The transactions up to the requested position are skipped
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn1, Position: wire.Position("0000000000000000-0000000000000001")}
+	env.down <- &wire.IncomingTransaction{Transaction: green, Position: wire.Position("0000000000000000-0000000000000002")}
+	env.down <- &wire.IncomingTransaction{Transaction: red, Position: wire.Position("0000000000000000-0000000000000003")}
+	require.Equal(t, &wire.IncomingTransaction{
+		Transaction: wire.Transaction{Changes: wire.Changes{"apple": wire.KindChanges{"b": wire.Diff{"Color": json.RawMessage(`"red"`), "Size": json.RawMessage(`1`)}}}},
+		Position:    wire.Position("0000000000000000-0000000000000003"),
+	}, <-incoming)
+	env.down <- &wire.IncomingTransaction{Transaction: testTxn2, Position: wire.Position("0000000000000000-0000000000000004")}
+	require.Equal(t, &wire.IncomingTransaction{Transaction: testTxn2, Position: wire.Position("0000000000000000-0000000000000004")}, <-incoming)
+	env.down <- nil
+	require.Nil(t, <-incoming)
+
+	// Reconnection resumes from the last position
+	env.drop <- struct{}{}
+	require.Equal(t, wire.Request{Version: 1, Last: wire.Position("0000000000000000-0000000000000004")}, <-env.conn)
+	env.down <- &wire.IncomingTransaction{Transaction: green, Position: wire.Position("0000000000000000-0000000000000005")}
+	require.Equal(t, &wire.IncomingTransaction{
+		Transaction: wire.Transaction{Changes: wire.Changes{"apple": wire.KindChanges{"b": wire.RemovedDiff()}}},
+		Position:    wire.Position("0000000000000000-0000000000000005"),
+	}, <-incoming)
+
+	// A transaction with nothing matching still advances the position
+	env.down <- &wire.IncomingTransaction{Transaction: green, Position: wire.Position("0000000000000000-0000000000000006")}
+	require.Equal(t, wire.PositionOnly("0000000000000000-0000000000000006"), <-incoming)
+}
+
+func TestEndpointsPick(t *testing.T) {
+	e := newEndpoints(staticEndpoints([]string{"a:1", "b:1", "c:1"}))
+	ctx := context.Background()
+
+	require.Equal(t, "a:1", must.OK1(e.pick(ctx)))
+	require.Equal(t, "b:1", must.OK1(e.pick(ctx)))
+	require.Equal(t, "c:1", must.OK1(e.pick(ctx)))
+
+	e.failed("a:1")
+	require.Equal(t, "b:1", must.OK1(e.pick(ctx)))
+	require.Equal(t, "b:1", must.OK1(e.pick(ctx)))
+	require.Equal(t, "c:1", must.OK1(e.pick(ctx)))
+
+	e.failed("b:1")
+	e.failed("c:1")
+	require.Equal(t, "a:1", must.OK1(e.pick(ctx))) // failed first
+
+	e.succeeded("c:1")
+	require.Equal(t, "c:1", must.OK1(e.pick(ctx)))
+}
+
+func TestProtocolToken(t *testing.T) {
+	group := test.Group(t)
+
+	auth := make(chan string, 1)
+	router := mux.NewRouter()
+	router.HandleFunc("/pull", func(w http.ResponseWriter, r *http.Request) {
+		auth <- r.Header.Get("Authorization")
+		tws.Serve(w, r, tws.StreamerConfig, func(ctx context.Context, incoming <-chan tws.Message, outgoing chan<- tws.Message) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	})
+	server := thttp.NewServer(tnet.ListenOnRandomPort(), thttp.StandardMiddleware(router))
+	group.Spawn("http", parallel.Fail, server.Run)
+
+	c := newProtocolClient(staticEndpoints([]string{server.ListenAddr().String()}), Options{TokenSource: StaticToken("secret"), Retry: testRetry})
+	conn := c.Connect(1, wire.Beginning, nil, false)
+	group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+		return conn.Run(ctx, make(chan *wire.IncomingTransaction))
+	})
+	require.Equal(t, "Bearer secret", <-auth)
+}
@@ -2,46 +2,100 @@ package client
 
 import (
 	"context"
+	"errors"
 	"sync"
 
 	"github.com/ridge/limestone/wire"
 	"github.com/ridge/parallel"
 )
 
+// DefaultSplitterBuffer is the number of recent transactions a Splitter keeps
+// in memory by default
+const DefaultSplitterBuffer = 10000
+
 // A Splitter is a Client that feeds several connections from a single upstream
 // connection. Its purpose is to optimize the case when several local Limestone
 // instances need to consume the same transaction log.
 //
 // The Splitter behaves like a normal Client from which several connections can
-// be created. However, Splitter requires the Run method to be called. New
-// connections cannot be created after Run has started.
+// be created. However, Splitter requires the Run method to be called.
+//
+// The upstream connection is established when Run is called (or upon the first
+// Connect if none were made before Run). It starts at the position of the
+// first connection and uses the union of the filters of the connections
+// created before Run. The recent upstream transactions are kept in a buffer.
+//
+// Each connection gets only the changes matching its own filter. A connection
+// whose position is found in the buffer is fed from the buffer. Otherwise, and
+// also if its filter is not covered by the upstream filter, it is fed from a
+// separate upstream connection, switching to the buffer as soon as the
+// positions meet. A connection that falls out of the buffer because it
+// doesn't keep up also switches to a separate upstream connection.
+//
+// Connections may be created at any time, but all of them must have the same
+// database version.
 //
-// Currently it's illegal to try to create several connections at different
-// starting positions. There will be only one upstream reading position from
-// which all connections of the splitter will be fed.
+// If the upstream connection fails with wire.ErrMismatch, so do all the
+// connections fed from the buffer.
+//
+// Retried transactions (see wire.Dedup) are dropped from the buffer: the
+// connections fed from it only see their positions.
 type Splitter struct {
-	client Client
+	client     Client
+	bufferSize int
+
+	mu        sync.Mutex
+	connected chan struct{} // closed upon the first Connect
+	ready     chan struct{} // closed once upstream is created
+	upstream  Connection
+	first     bool // true before the first Connect
+	version   int
+	startPos  wire.Position
+	filter    wire.Filter
+	compact   bool
 
-	mu         sync.Mutex
-	ready      chan struct{}
-	upstream   Connection
-	downstream []*splitterConnection
-	version    int
-	startPos   wire.Position
-	filter     wire.Filter
-	compact    bool
+	// buffer[i] has sequence number base+i; nil is the hot end marker
+	buffer  []*wire.IncomingTransaction
+	base    int
+	index   map[wire.Position]int // position -> sequence number
+	updated chan struct{}         // closed and replaced upon every append
+	err     error                 // upstream mismatch, returned to every connection
+	dedup   *wire.Dedup
 }
 
 type splitterConnection struct {
 	splitter *Splitter
-	ch       chan *wire.IncomingTransaction
+	pos      wire.Position
+	filter   wire.Filter
+	compact  bool
+	apply    func(wire.Changes) wire.Changes
+	hot      bool // the last message delivered was the hot end marker
+	detached bool // transactions without position delivered since pos
 }
 
-// NewSplitter creates a new Splitter
+// errFellBehind is returned when a connection has fallen out of the buffer
+var errFellBehind = errors.New("fell behind")
+
+// NewSplitter creates a new Splitter with the default buffer size
 func NewSplitter(upstream Client) *Splitter {
+	return NewSplitterWithBuffer(upstream, DefaultSplitterBuffer)
+}
+
+// NewSplitterWithBuffer creates a new Splitter that keeps the given number of
+// recent transactions in memory
+func NewSplitterWithBuffer(upstream Client, size int) *Splitter {
+	if size <= 0 {
+		panic("client.Splitter buffer size must be positive")
+	}
 	return &Splitter{
-		client: upstream,
-		ready:  make(chan struct{}),
+		client:     upstream,
+		bufferSize: size,
+		connected:  make(chan struct{}),
+		ready:      make(chan struct{}),
+		first:      true,
+		index:      map[wire.Position]int{},
+		updated:    make(chan struct{}),
+		dedup:      wire.NewDedup(wire.DedupWindow),
 	}
 }
 
@@ -50,56 +104,59 @@ func (s *Splitter) Connect(version int, pos wire.Position, filter wire.Filter, c
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.upstream != nil {
-		panic("cannot connect to client.Splitter once it's running")
-	}
-
-	if len(s.downstream) == 0 {
+	switch {
+	case s.first:
+		s.first = false
 		s.version = version
 		s.startPos = pos
-		s.filter = filter
+		s.filter = filterCopy(filter)
 		s.compact = compact
-	} else {
-		if s.version != version {
-			panic("all database versions for a client.Splitter must be the same")
-		}
-		if s.startPos != pos {
-			panic("all starting positions for a client.Splitter must be the same")
-		}
-		if s.compact != compact {
-			panic("all compact settings for a client.Splitter must be the same")
-		}
+		close(s.connected)
+	case s.version != version:
+		panic("all database versions for a client.Splitter must be the same")
+	case s.upstream == nil:
 		filterUnion(&s.filter, filter)
+		s.compact = s.compact && compact
 	}
 
-	conn := &splitterConnection{splitter: s, ch: make(chan *wire.IncomingTransaction)}
-	s.downstream = append(s.downstream, conn)
-	return conn
+	return &splitterConnection{
+		splitter: s,
+		pos:      pos,
+		filter:   filter,
+		compact:  compact,
+		apply:    wire.CompileFilter(filter),
+	}
 }
 
 // Run runs the splitter
 func (s *Splitter) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.connected:
+	}
 	s.connect()
 
 	incoming := make(chan *wire.IncomingTransaction)
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		spawn("upstream", parallel.Fail, func(ctx context.Context) error {
-			return s.upstream.Run(ctx, incoming)
+			err := s.upstream.Run(ctx, incoming)
+			var mismatch wire.ErrMismatch
+			if errors.As(err, &mismatch) {
+				s.fail(mismatch)
+			}
+			return err
 		})
 		spawn("split", parallel.Fail, func(ctx context.Context) error {
-			var txn *wire.IncomingTransaction
-			var ok bool
 			for {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				case txn, ok = <-incoming:
+				case txn, ok := <-incoming:
 					if !ok {
 						return ctx.Err()
 					}
-					if err := s.deliver(ctx, txn); err != nil {
-						return err
-					}
+					s.append(txn)
 				}
 			}
 		})
@@ -118,40 +175,263 @@ func (s *Splitter) connect() {
 	close(s.ready)
 }
 
-func (s *Splitter) deliver(ctx context.Context, txn *wire.IncomingTransaction) error {
-	for _, conn := range s.downstream {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case conn.ch <- txn:
+func (s *Splitter) append(txn *wire.IncomingTransaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if txn != nil && s.dedup.CheckTxn(txn.Transaction) {
+		txn = wire.PositionOnly(txn.Position)
+	}
+	s.buffer = append(s.buffer, txn)
+	if txn != nil && txn.Position != "" {
+		s.index[txn.Position] = s.base + len(s.buffer) - 1
+	}
+	if len(s.buffer) > s.bufferSize {
+		if evicted := s.buffer[0]; evicted != nil {
+			delete(s.index, evicted.Position)
 		}
+		s.buffer[0] = nil
+		s.buffer = s.buffer[1:]
+		s.base++
 	}
-	return nil
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *Splitter) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// Err returns the wire.ErrMismatch error the upstream connection has failed
+// with, or nil
+func (s *Splitter) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// locate returns the sequence number of the next buffered transaction for the
+// connection, if the connection can be fed from the buffer
+func (s *Splitter) locate(sc *splitterConnection) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !filterCovers(s.filter, sc.filter) {
+		return 0, false
+	}
+	if sc.pos == s.startPos && s.base == 0 && (sc.compact || !s.compact) {
+		return 0, true
+	}
+	if sc.pos == wire.Beginning {
+		return 0, false
+	}
+	seq, ok := s.index[sc.pos]
+	return seq + 1, ok
 }
 
-func (sc *splitterConnection) Submit(ctx context.Context, txn wire.Transaction) error {
+func (sc *splitterConnection) Submit(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return wire.Beginning, ctx.Err()
 	case <-sc.splitter.ready:
 		return sc.splitter.upstream.Submit(ctx, txn)
 	}
 }
 
 func (sc *splitterConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sc.splitter.ready:
+	}
+
 	for {
-		var txn *wire.IncomingTransaction
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case txn = <-sc.ch:
+		seq, ok := sc.splitter.locate(sc)
+		if !ok {
+			var err error
+			seq, err = sc.catchUp(ctx, sink)
+			if err != nil {
+				return err
+			}
+		}
+		err := sc.follow(ctx, sink, seq)
+		if !errors.Is(err, errFellBehind) {
+			return err
 		}
+		if sc.detached {
+			// Compacted transactions have no positions to restart from
+			return wire.ErrMismatch("client.Splitter connection fell behind during hot start")
+		}
+	}
+}
+
+// catchUp feeds the connection from a separate upstream connection until its
+// position is found in the buffer, and returns the sequence number of the next
+// buffered transaction
+func (sc *splitterConnection) catchUp(ctx context.Context, sink chan<- *wire.IncomingTransaction) (int, error) {
+	s := sc.splitter
+	var seq int
+	err := parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		incoming := make(chan *wire.IncomingTransaction)
+		conn := s.client.Connect(s.version, sc.pos, sc.filter, sc.compact)
+		spawn("upstream", parallel.Fail, func(ctx context.Context) error {
+			return conn.Run(ctx, incoming)
+		})
+		spawn("catch-up", parallel.Exit, func(ctx context.Context) error {
+			for {
+				s.mu.Lock()
+				updated := s.updated
+				s.mu.Unlock()
+
+				var ok bool
+				if seq, ok = s.locate(sc); ok {
+					return nil
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-updated:
+				case txn := <-incoming:
+					if err := sc.deliver(ctx, sink, txn); err != nil {
+						return err
+					}
+				}
+			}
+		})
+		return nil
+	})
+	return seq, err
+}
+
+// follow feeds the connection from the buffer starting from the given sequence
+// number
+func (sc *splitterConnection) follow(ctx context.Context, sink chan<- *wire.IncomingTransaction, seq int) error {
+	s := sc.splitter
+	for {
+		s.mu.Lock()
+		if s.err != nil {
+			s.mu.Unlock()
+			return s.err
+		}
+		if seq < s.base {
+			s.mu.Unlock()
+			return errFellBehind
+		}
+		if seq < s.base+len(s.buffer) {
+			txn := s.buffer[seq-s.base]
+			s.mu.Unlock()
+			seq++
+			if err := sc.deliver(ctx, sink, txn); err != nil {
+				return err
+			}
+			continue
+		}
+		// The connection may have switched from a separate upstream
+		// connection before it reached the hot end, while the main upstream
+		// connection is already there.
+		hot := len(s.buffer) != 0 && s.buffer[len(s.buffer)-1] == nil
+		updated := s.updated
+		s.mu.Unlock()
+
+		if hot && !sc.hot {
+			if err := sc.deliver(ctx, sink, nil); err != nil {
+				return err
+			}
+			continue
+		}
+
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case sink <- txn:
+		case <-updated:
+		}
+	}
+}
+
+func (sc *splitterConnection) deliver(ctx context.Context, sink chan<- *wire.IncomingTransaction, txn *wire.IncomingTransaction) error {
+	if txn == nil {
+		if sc.hot {
+			return nil
+		}
+	} else {
+		if txn.Position != "" {
+			sc.pos = txn.Position
+			sc.detached = false
+		} else {
+			sc.detached = true
+		}
+		changes := sc.apply(txn.Changes)
+		switch {
+		case changes != nil:
+			filtered := *txn
+			filtered.Changes = changes
+			txn = &filtered
+		case txn.Position != "":
+			txn = wire.PositionOnly(txn.Position)
+		default:
+			return nil
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case sink <- txn:
+	}
+	sc.hot = txn == nil
+	return nil
+}
+
+func filterCopy(f wire.Filter) wire.Filter {
+	if f == nil {
+		return nil
+	}
+	res := make(wire.Filter, len(f))
+	for kind, props := range f {
+		res[kind] = props
+	}
+	return res
+}
+
+// filterCovers returns true if everything matching b also matches a
+func filterCovers(a, b wire.Filter) bool {
+	if a == nil {
+		return true
+	}
+	if b == nil {
+		return false
+	}
+	for kind, propsB := range b {
+		propsA, ok := a[kind]
+		switch {
+		case !ok:
+			return false
+		case propsA == nil:
+			continue
+		case propsB == nil:
+			return false
+		}
+		for _, pb := range propsB {
+			found := false
+			for _, pa := range propsA {
+				if pa == pb {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
 		}
 	}
+	return true
 }
 
 // modifies first argument
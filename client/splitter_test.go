@@ -2,6 +2,7 @@ package client
 
 import (
 	"context"
+	"sync/atomic"
 	"testing"
 
 	"github.com/ridge/limestone/wire"
@@ -28,7 +29,8 @@ func TestSplitter(t *testing.T) {
 	require.Nil(t, <-incoming1)
 	require.Nil(t, <-incoming2)
 
-	require.NoError(t, conn1.Submit(env.group.Context(), testTxn1))
+	_, err := conn1.Submit(env.group.Context(), testTxn1)
+	require.NoError(t, err)
 	in1 := <-incoming1
 	require.Equal(t, wire.Position("0000000000000000-0000000000000000"), in1.Position)
 	require.NotZero(t, in1.TS)
@@ -45,7 +47,8 @@ func TestSplitter(t *testing.T) {
 	require.Nil(t, <-incoming1)
 	require.Nil(t, <-incoming2)
 
-	require.NoError(t, conn2.Submit(env.group.Context(), testTxn2))
+	_, err = conn2.Submit(env.group.Context(), testTxn2)
+	require.NoError(t, err)
 	in1 = <-incoming1
 	require.Equal(t, wire.Position("0000000000000000-0000000000000001"), in1.Position)
 	require.NotZero(t, in1.TS)
@@ -63,6 +66,165 @@ func TestSplitter(t *testing.T) {
 	require.Nil(t, <-incoming2)
 }
 
+func TestSplitterPositionsAndFilters(t *testing.T) {
+	env := kafkaTestSetup(t)
+	ctx := env.group.Context()
+	require.NoError(t, PublishKafkaManifest(ctx, env.kafka, wire.Manifest{Topic: "txlog"}))
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", testTxn1))
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", testTxn2))
+
+	splitter := NewSplitterWithBuffer(env.client, 1)
+	run := func(conn Connection) chan *wire.IncomingTransaction {
+		incoming := make(chan *wire.IncomingTransaction)
+		env.group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+			return conn.Run(ctx, incoming)
+		})
+		return incoming
+	}
+
+	// Different filters
+	apples := run(splitter.Connect(0, wire.Beginning, wire.Filter{"apple": nil}, false))
+	all := run(splitter.Connect(0, wire.Beginning, nil, false))
+	env.group.Spawn("splitter", parallel.Fail, splitter.Run)
+
+	in := <-apples
+	require.Equal(t, testTxn1.Changes, in.Changes)
+	in = <-apples
+	require.Nil(t, in.Changes) // only oranges
+	require.Equal(t, KafkaPosition(0, 1), in.Position)
+	require.Nil(t, <-apples)
+	in = <-all
+	require.Equal(t, testTxn1.Changes, in.Changes)
+	pos1 := in.Position
+	in = <-all
+	require.Equal(t, testTxn2.Changes, in.Changes)
+	require.Nil(t, <-all)
+
+	// Late joiner at a different position, not in the buffer
+	late := run(splitter.Connect(0, pos1, nil, false))
+	in = <-late
+	require.Equal(t, testTxn2.Changes, in.Changes)
+	require.Nil(t, <-late)
+
+	// New transactions reach everyone
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", testTxn1))
+	for _, ch := range []chan *wire.IncomingTransaction{apples, all, late} {
+		in = <-ch
+		require.Equal(t, testTxn1.Changes, in.Changes)
+		require.Nil(t, <-ch)
+	}
+}
+
+// countingClient counts the upstream connections
+type countingClient struct {
+	Client
+	conns *atomic.Int32
+}
+
+func (cc countingClient) Connect(version int, pos wire.Position, filter wire.Filter, compact bool) Connection {
+	cc.conns.Add(1)
+	return cc.Client.Connect(version, pos, filter, compact)
+}
+
+func TestSplitterBuffer(t *testing.T) {
+	env := kafkaTestSetup(t)
+	ctx := env.group.Context()
+	require.NoError(t, PublishKafkaManifest(ctx, env.kafka, wire.Manifest{Topic: "txlog"}))
+	for _, txn := range []wire.Transaction{testTxn1, testTxn2, testTxn1} {
+		require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", txn))
+	}
+	pos := func(offset int64) wire.Position {
+		return KafkaPosition(0, offset)
+	}
+
+	var conns atomic.Int32
+	splitter := NewSplitterWithBuffer(countingClient{Client: env.client, conns: &conns}, 3)
+	run := func(conn Connection, size int) chan *wire.IncomingTransaction {
+		incoming := make(chan *wire.IncomingTransaction, size)
+		env.group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+			return conn.Run(ctx, incoming)
+		})
+		return incoming
+	}
+	expect := func(ch chan *wire.IncomingTransaction, offsets ...int64) {
+		for _, offset := range offsets {
+			require.Equal(t, pos(offset), (<-ch).Position)
+		}
+		require.Nil(t, <-ch)
+	}
+
+	// The buffer starts after the first transaction. The main connection
+	// never falls behind.
+	main := run(splitter.Connect(0, pos(0), nil, false), 100)
+	env.group.Spawn("splitter", parallel.Fail, splitter.Run)
+	expect(main, 1, 2)
+	require.EqualValues(t, 1, conns.Load())
+
+	// Hit: fed from the buffer
+	expect(run(splitter.Connect(0, pos(2), nil, false), 0))
+	require.EqualValues(t, 1, conns.Load())
+
+	// Miss: fed from a separate upstream connection
+	expect(run(splitter.Connect(0, wire.Beginning, nil, false), 0), 0, 1, 2)
+	require.EqualValues(t, 2, conns.Load())
+
+	// Eviction: the buffer only keeps the most recent transactions
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", testTxn2))
+	expect(main, 3)
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", testTxn1))
+	expect(main, 4)
+	expect(run(splitter.Connect(0, pos(2), nil, false), 0), 3, 4)
+	require.EqualValues(t, 3, conns.Load())
+}
+
+func TestSplitterDedup(t *testing.T) {
+	env := kafkaTestSetup(t)
+	ctx := env.group.Context()
+	require.NoError(t, PublishKafkaManifest(ctx, env.kafka, wire.Manifest{Topic: "txlog"}))
+	txn := testTxn1
+	txn.Seq = 1
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", txn))
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", txn)) // retried
+	txn.Seq = 2
+	require.NoError(t, PublishKafkaTransaction(ctx, env.kafka, "txlog", txn))
+
+	splitter := NewSplitter(env.client)
+	conn := splitter.Connect(0, wire.Beginning, nil, false)
+	incoming := make(chan *wire.IncomingTransaction)
+	env.group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+		return conn.Run(ctx, incoming)
+	})
+	env.group.Spawn("splitter", parallel.Fail, splitter.Run)
+
+	in := <-incoming
+	require.Equal(t, KafkaPosition(0, 0), in.Position)
+	require.Equal(t, int64(1), in.Seq)
+	require.Equal(t, wire.PositionOnly(KafkaPosition(0, 1)), <-incoming) // the retry
+	in = <-incoming
+	require.Equal(t, KafkaPosition(0, 2), in.Position)
+	require.Equal(t, int64(2), in.Seq)
+	require.Nil(t, <-incoming)
+
+	// The position of the retry is still known
+	late := splitter.Connect(0, KafkaPosition(0, 1), nil, false)
+	lateIncoming := make(chan *wire.IncomingTransaction)
+	env.group.Spawn("late", parallel.Fail, func(ctx context.Context) error {
+		return late.Run(ctx, lateIncoming)
+	})
+	require.Equal(t, KafkaPosition(0, 2), (<-lateIncoming).Position)
+	require.Nil(t, <-lateIncoming)
+}
+
+func TestFilterCovers(t *testing.T) {
+	require.True(t, filterCovers(nil, nil))
+	require.True(t, filterCovers(nil, wire.Filter{"foo": nil}))
+	require.False(t, filterCovers(wire.Filter{"foo": nil}, nil))
+	require.True(t, filterCovers(wire.Filter{"foo": nil, "bar": {"a", "b"}}, wire.Filter{"foo": {"x"}, "bar": {"b"}}))
+	require.False(t, filterCovers(wire.Filter{"bar": {"a"}}, wire.Filter{"bar": nil}))
+	require.False(t, filterCovers(wire.Filter{"bar": {"a"}}, wire.Filter{"bar": {"c"}}))
+	require.False(t, filterCovers(wire.Filter{"bar": {"a"}}, wire.Filter{"baz": nil}))
+}
+
 func TestFilterUnion(t *testing.T) {
 	f1 := wire.Filter{
 		"foo": nil,
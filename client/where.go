@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/parallel"
+)
+
+// PredicateClient is implemented by clients that can apply row-level
+// predicates at the source
+type PredicateClient interface {
+	Client
+
+	// ConnectWhere is a version of Connect that only delivers the entities
+	// matching the predicates.
+	//
+	// An entity that starts matching is delivered with all its properties. An
+	// entity that stops matching is delivered with wire.RemovedDiff. The
+	// consumer is expected to forget such entities.
+	ConnectWhere(version int, pos wire.Position, filter wire.Filter, where wire.Where, compact bool) Connection
+}
+
+// WithWhere returns a client applying the given row-level predicates.
+//
+// If c implements PredicateClient, the predicates are applied at the source.
+// Otherwise they are applied locally, which means all the entities are still
+// transferred, and a resumed connection rereads the history from the
+// beginning.
+func WithWhere(c Client, where wire.Where) Client {
+	return whereClient{client: c, where: where}
+}
+
+type whereClient struct {
+	client Client
+	where  wire.Where
+}
+
+func (wc whereClient) Connect(version int, pos wire.Position, filter wire.Filter, compact bool) Connection {
+	if pc, ok := wc.client.(PredicateClient); ok {
+		return pc.ConnectWhere(version, pos, filter, wc.where, compact)
+	}
+	return ConnectWhere(wc.client, version, pos, filter, wc.where, compact)
+}
+
+// ConnectWhere connects to a client that does not support predicates and
+// applies the predicates locally.
+//
+// The upstream connection always starts from the beginning because the state
+// of each entity must be known to decide whether it matches. When resuming,
+// the transactions up to and including pos are consumed silently. If pos is
+// not seen before the hot end, Run returns wire.ErrContinuityBroken.
+//
+// Thus the cost of a resumed connection is proportional to the whole
+// transaction log rather than to the part after pos, and the connection keeps
+// the properties of all entities of the restricted kinds in memory, matching or
+// not (see wire.RowFilter).
+func ConnectWhere(c Client, version int, pos wire.Position, filter wire.Filter, where wire.Where, compact bool) Connection {
+	return &whereConnection{
+		Connection: c.Connect(version, wire.Beginning, wherePropFilter(filter, where), compact && pos == wire.Beginning),
+		pos:        pos,
+		where:      where,
+	}
+}
+
+// wherePropFilter extends the filter so that the properties used in
+// predicates are not filtered out
+func wherePropFilter(filter wire.Filter, where wire.Where) wire.Filter {
+	if filter == nil {
+		return nil
+	}
+	res := wire.Filter{}
+	for kind, props := range filter {
+		res[kind] = props
+		if props == nil {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, prop := range props {
+			seen[prop] = true
+		}
+		for _, p := range where[kind] {
+			if !seen[p.Prop] {
+				seen[p.Prop] = true
+				res[kind] = append(append([]string(nil), res[kind]...), p.Prop)
+			}
+		}
+	}
+	return res
+}
+
+type whereConnection struct {
+	Connection
+
+	pos   wire.Position
+	where wire.Where
+}
+
+func (wc *whereConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		incoming := make(chan *wire.IncomingTransaction)
+		spawn("upstream", parallel.Fail, func(ctx context.Context) error {
+			return wc.Connection.Run(ctx, incoming)
+		})
+		spawn("filter", parallel.Fail, func(ctx context.Context) error {
+			rows := wire.NewRowFilter(wc.where)
+			skipping := wc.pos != wire.Beginning
+			for {
+				var txn *wire.IncomingTransaction
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case txn = <-incoming:
+				}
+
+				if txn == nil {
+					if skipping {
+						return wire.ErrContinuityBroken
+					}
+				} else {
+					changes := rows.Apply(txn.Changes)
+					if skipping {
+						skipping = txn.Position != wc.pos
+						continue
+					}
+					if changes == nil {
+						txn = wire.PositionOnly(txn.Position)
+					} else {
+						filtered := *txn
+						filtered.Changes = changes
+						txn = &filtered
+					}
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case sink <- txn:
+				}
+			}
+		})
+		return nil
+	})
+}
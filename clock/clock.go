@@ -0,0 +1,41 @@
+// Package clock abstracts the passage of time so that time-dependent code can
+// be tested with a fake clock.
+package clock
+
+import (
+	"time"
+)
+
+// A Clock tells the current time and runs functions after a delay
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// AfterFunc waits for the duration to elapse and then calls f in its
+	// own goroutine (or, for a fake clock, in the goroutine advancing it)
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// A Timer is a pending call scheduled by Clock.AfterFunc
+type Timer interface {
+	// Stop prevents the call, returning false if it has already been made or
+	// the timer has been stopped
+	Stop() bool
+
+	// Reset reschedules the call to happen after the duration, returning
+	// true if the timer had been active
+	Reset(d time.Duration) bool
+}
+
+// Real is the clock backed by the time package
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
@@ -0,0 +1,108 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Fake is a clock that only moves when told to. Timers fire synchronously in
+// the goroutine calling Advance or Set.
+//
+// Safe for concurrent use.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool
+}
+
+// NewFake creates a fake clock showing the given time
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now, timers: map[*fakeTimer]bool{}}
+}
+
+// Now implements Clock
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// AfterFunc implements Clock
+func (f *Fake) AfterFunc(d time.Duration, fn func()) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{clock: f, when: f.now.Add(d), fn: fn}
+	f.timers[t] = true
+	return t
+}
+
+// Advance moves the clock forward by the duration, firing the timers that are
+// due in chronological order
+func (f *Fake) Advance(d time.Duration) {
+	f.Set(f.Now().Add(d))
+}
+
+// Set moves the clock to the given time, firing the timers that are due in
+// chronological order. Setting the time back fires no timers.
+func (f *Fake) Set(now time.Time) {
+	for {
+		f.mu.Lock()
+		var due *fakeTimer
+		for t := range f.timers {
+			if !t.when.After(now) && (due == nil || t.when.Before(due.when)) {
+				due = t
+			}
+		}
+		if due == nil {
+			f.now = now
+			f.mu.Unlock()
+			return
+		}
+		delete(f.timers, due)
+		if due.when.After(f.now) {
+			f.now = due.when
+		}
+		f.mu.Unlock()
+
+		due.fn()
+	}
+}
+
+// Pending returns the times when the active timers are due, in chronological
+// order
+func (f *Fake) Pending() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := make([]time.Time, 0, len(f.timers))
+	for t := range f.timers {
+		res = append(res, t.when)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Before(res[j])
+	})
+	return res
+}
+
+type fakeTimer struct {
+	clock *Fake
+	when  time.Time
+	fn    func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.timers[t]
+	delete(t.clock.timers, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.timers[t]
+	t.when = t.clock.now.Add(d)
+	t.clock.timers[t] = true
+	return active
+}
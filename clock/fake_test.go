@@ -0,0 +1,34 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFake(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFake(t0)
+	require.Equal(t, t0, c.Now())
+
+	var fired []time.Time
+	record := func() { fired = append(fired, c.Now()) }
+
+	c.AfterFunc(2*time.Second, record)
+	t1 := c.AfterFunc(time.Second, record)
+	t3 := c.AfterFunc(3*time.Second, record)
+	require.True(t, t3.Stop())
+	require.False(t, t3.Stop())
+	require.Equal(t, []time.Time{t0.Add(time.Second), t0.Add(2 * time.Second)}, c.Pending())
+
+	c.Advance(500 * time.Millisecond)
+	require.Empty(t, fired)
+	require.True(t, t1.Reset(time.Second)) // now due at t0+1.5s
+
+	c.Advance(5 * time.Second)
+	require.Equal(t, []time.Time{t0.Add(1500 * time.Millisecond), t0.Add(2 * time.Second)}, fired)
+	require.Equal(t, t0.Add(5500*time.Millisecond), c.Now())
+	require.Empty(t, c.Pending())
+	require.False(t, t1.Stop())
+}
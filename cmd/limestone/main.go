@@ -0,0 +1,12 @@
+// The limestone command inspects the transaction log, see package cli
+package main
+
+import (
+	"os"
+
+	"github.com/ridge/limestone/cli"
+)
+
+func main() {
+	cli.Main(os.Args)
+}
@@ -20,42 +20,6 @@ import (
 	"time"
 )
 
-type activeSet map[string]map[string]*wire.ActiveObject // kind -> ID -> object
-
-type surviveFn func(object wire.ActiveObject, now time.Time) bool
-
-func (as activeSet) applyTxn(txn wire.Transaction, now time.Time, survive surviveFn) {
-	for kind, kindChanges := range txn.Changes {
-		byID := as[kind]
-		if byID == nil {
-			byID = map[string]*wire.ActiveObject{}
-			as[kind] = byID
-		}
-		for id, diff := range kindChanges {
-			obj := byID[id]
-			if obj == nil {
-				if _, ok := diff["ID"]; !ok {
-					continue // update to a previously deleted object
-				}
-				obj = &wire.ActiveObject{
-					Kind:  kind,
-					TS:    *txn.TS,
-					Props: wire.Diff{},
-				}
-				byID[id] = obj
-			} else {
-				obj.TS = *txn.TS
-			}
-			for k, v := range diff {
-				obj.Props[k] = v
-			}
-			if !survive(*obj, now) {
-				delete(byID, id)
-			}
-		}
-	}
-}
-
 func parseGSURL(gsURL string) (bucket, object string, err error) {
 	u, err := url.Parse(gsURL)
 	if err != nil {
@@ -75,7 +39,7 @@ var gsRetryConfig = retry.ExpConfig{
 	Instant: true,
 }
 
-func uploadActiveSet(ctx context.Context, gsURL string, header wire.ActiveSetHeader, as activeSet) error {
+func uploadActiveSet(ctx context.Context, gsURL string, header wire.ActiveSetHeader, as wire.ActiveSet) error {
 	bucket, object, err := parseGSURL(gsURL)
 	if err != nil {
 		return fmt.Errorf("failed to upload active set: %w", err)
@@ -142,7 +106,7 @@ func uploadActiveSet(ctx context.Context, gsURL string, header wire.ActiveSetHea
 	return err
 }
 
-func downloadActiveSet(ctx context.Context, gsURL string, survive surviveFn) (header wire.ActiveSetHeader, as activeSet, err error) {
+func downloadActiveSet(ctx context.Context, gsURL string, survive wire.SurviveFn) (header wire.ActiveSetHeader, as wire.ActiveSet, err error) {
 	bucket, object, err := parseGSURL(gsURL)
 	if err != nil {
 		return header, nil, fmt.Errorf("failed to download active set: %w", err)
@@ -182,7 +146,7 @@ func downloadActiveSet(ctx context.Context, gsURL string, survive surviveFn) (he
 			return err
 		}
 
-		as = activeSet{}
+		as = wire.ActiveSet{}
 		now := time.Now()
 		for {
 			var ao wire.ActiveObject
@@ -25,7 +25,7 @@ type Config struct {
 	HotStartStorage  string
 	DBVersionHistory []string
 	UpgradeSteps     map[string]xform.Transformation
-	Survive          func(object wire.ActiveObject, now time.Time) bool
+	Survive          wire.SurviveFn
 }
 
 // DatabaseIsEmpty returns true if database is empty
@@ -40,9 +40,9 @@ func transform(ctx context.Context, config Config, lc client.KafkaClient, manife
 	}
 	tlog.Get(ctx).Info("Running upgrade steps", zap.Strings("steps", names), zap.String("newTopic", config.NewTopic))
 
-	var active activeSet
+	var active wire.ActiveSet
 	if config.HotStartStorage != "" {
-		active = activeSet{}
+		active = wire.ActiveSet{}
 	}
 
 	maintenance := false
@@ -141,6 +141,7 @@ func transform(ctx context.Context, config Config, lc client.KafkaClient, manife
 			}()
 
 			now := time.Now()
+			dedup := wire.NewDedup(wire.DedupWindow)
 			for {
 				select {
 				case <-ctx.Done():
@@ -149,8 +150,10 @@ func transform(ctx context.Context, config Config, lc client.KafkaClient, manife
 					if !ok {
 						return nil
 					}
-					if active != nil {
-						active.applyTxn(txn, now, config.Survive)
+					if active != nil && !dedup.CheckTxn(txn) {
+						if err := active.Apply(txn, now, config.Survive); err != nil {
+							tlog.Get(ctx).Warn("Skipped invalid changes in hot start data", zap.Error(err))
+						}
 					}
 					select {
 					case <-ctx.Done():
@@ -170,7 +173,7 @@ func transform(ctx context.Context, config Config, lc client.KafkaClient, manife
 				case msg, ok := <-output:
 					// batch size or end of stream reached
 					if !ok || len(batch) >= batchSize {
-						if err := config.DestKafka.Write(ctx, config.NewTopic, batch); err != nil {
+						if _, err := config.DestKafka.Write(ctx, config.NewTopic, batch); err != nil {
 							return err
 						}
 						batch = batch[:0] // truncate while keeping the underlying capacity
@@ -256,7 +259,7 @@ func refreshHotStart(ctx context.Context, config Config, lc client.KafkaClient,
 		}
 	}
 	if active == nil {
-		active = activeSet{}
+		active = wire.ActiveSet{}
 		header = wire.ActiveSetHeader{
 			Version:  manifest.Version,
 			Position: wire.Beginning,
@@ -269,6 +272,9 @@ func refreshHotStart(ctx context.Context, config Config, lc client.KafkaClient,
 			return lc.Connect(manifest.Version, header.Position, nil, false).Run(ctx, incoming)
 		})
 		spawn("consumer", parallel.Exit, func(ctx context.Context) error {
+			// Retries of the transactions preceding the hot start data are
+			// not recognized
+			dedup := wire.NewDedup(wire.DedupWindow)
 			for {
 				var txn *wire.IncomingTransaction
 				select {
@@ -280,7 +286,12 @@ func refreshHotStart(ctx context.Context, config Config, lc client.KafkaClient,
 					return nil
 				}
 				header.Position = txn.Position
-				active.applyTxn(txn.Transaction, now, config.Survive)
+				if dedup.CheckTxn(txn.Transaction) {
+					continue
+				}
+				if err := active.Apply(txn.Transaction, now, config.Survive); err != nil {
+					tlog.Get(ctx).Warn("Skipped invalid changes in hot start data", zap.String("position", string(txn.Position)), zap.Error(err))
+				}
 			}
 		})
 		return nil
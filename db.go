@@ -2,11 +2,16 @@ package limestone
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"time"
 
 	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/clock"
 	"github.com/ridge/limestone/indices"
 	"github.com/ridge/limestone/meta"
 	"github.com/ridge/limestone/scheduler"
@@ -39,6 +44,13 @@ func MustGet[T any](s Snapshot, id any, ptr *T) {
 	typeddb.MustGet(s, id, ptr)
 }
 
+// DiffEntry describes how an entity differs between two snapshots
+type DiffEntry = typeddb.DiffEntry
+
+// Diff compares two snapshots and returns the entities of the given kinds that
+// have been added, removed or changed. See typeddb.Diff.
+var Diff = typeddb.Diff
+
 // Producer is a generic service name
 type Producer = meta.Producer
 
@@ -86,6 +98,10 @@ type Config struct {
 	// Entities is a list of entities to be synchronized
 	Entities KindList
 
+	// Derived is a list of kinds of derived entities computed from other
+	// entities and never exported to Kafka. See Derivation.
+	Derived []Derivation
+
 	// WakeUp is a callback to be called when a batch of changes has been
 	// received, and business logic can continue. Can be nil.
 	//
@@ -93,6 +109,23 @@ type Config struct {
 	// after WakeUp returns.
 	WakeUp WakeUpFn
 
+	// Election enables leader election among the replicas of the service.
+	// Nil means every replica acts independently. See Election.
+	Election *Election
+
+	// Sharding enables sharded processing across the replicas of the
+	// service. Nil means every replica processes all entities. Cannot be
+	// combined with Election. See Sharding.
+	Sharding *Sharding
+
+	// Where restricts the synchronized entities to those matching row-level
+	// predicates, keyed by entity DBName. An entity that stops matching is
+	// removed from the local database. Nil means all entities.
+	//
+	// Entities created locally are kept until the next incoming change even if
+	// they don't match.
+	Where wire.Where
+
 	// Source is the info about the local service.
 	// Empty iff the service is read only.
 	Source
@@ -100,8 +133,9 @@ type Config struct {
 	// Logger is a logger to be used for logging in DB sync.
 	Logger *zap.Logger
 
-	// The following field is to be left empty except in tests
+	// The following fields are to be left empty except in tests
 	Session int64
+	Clock   clock.Clock // clock.Real if nil
 
 	// If DebugTap is non-nil, Limestone will send a snapshot into this channel
 	// every time a transaction is committed. This applies both to Do/DoE
@@ -109,7 +143,7 @@ type Config struct {
 	// makes changes, the snapshot includes them.
 	//
 	// For use in tests only. If writing to the channel blocks, this holds up
-	// the entire Limestone.
+	// the entire Limestone. Prefer DB.WaitFor, which never blocks Limestone.
 	DebugTap chan<- Snapshot
 }
 
@@ -118,7 +152,7 @@ type DBReadWrite interface {
 	WaitReady(ctx context.Context) error
 	Snapshot() typeddb.Snapshot
 	Do(fn func(txn Transaction))
-	DoE(func(txn Transaction) error) error
+	DoE(func(txn Transaction) error) (wire.Position, error)
 }
 
 // DBReadOnly is an abstraction for limestone DB for read-only DB operations
@@ -131,13 +165,22 @@ type DB struct {
 	tdb   *typeddb.TypedDB
 	kinds map[string]*typeddb.Kind
 
-	wakeUp    WakeUpFn
-	scheduler *scheduler.Scheduler
+	derivations  []Derivation
+	derivedKinds map[*typeddb.Kind]bool
+
+	wakeUp     WakeUpFn
+	election   *Election
+	sharding   *Sharding
+	leases     *leaseTable
+	assignment assignment // protected by leases.mu
+	clock      clock.Clock
+	scheduler  *scheduler.Scheduler
 
 	connection client.Connection
 
 	source  *Source
 	session int64
+	seq     atomic.Int64 // last sequence number of submitted transactions
 
 	// readyCtx is used as a "fence" synchronization primitive,
 	// not as a context, so it is stored in this struct
@@ -145,6 +188,14 @@ type DB struct {
 	readyCancel context.CancelFunc
 	ready       bool
 
+	// updated is closed and replaced every time a transaction is committed
+	// or the position advances
+	updatedMu sync.Mutex
+	updated   chan struct{}
+	position  wire.Position // of the last incoming transaction reflected in the snapshots
+
+	idleRequests chan chan struct{} // see WaitIdle
+
 	logger             *zap.Logger
 	monitoringInstance string
 	debugTap           chan<- Snapshot
@@ -152,15 +203,28 @@ type DB struct {
 
 // New creates a new Limestone instance
 func New(config Config) *DB {
+	allKinds := append(KindList{}, config.Entities...)
+	for _, d := range config.Derived {
+		allKinds = append(allKinds, d.Kind)
+	}
+
 	db := DB{
-		tdb:       typeddb.New(config.Entities),
-		kinds:     map[string]*typeddb.Kind{},
-		wakeUp:    config.WakeUp,
-		scheduler: scheduler.New(),
-		session:   config.Session,
-		logger:    config.Logger,
-		debugTap:  config.DebugTap,
+		tdb:          typeddb.New(allKinds),
+		kinds:        map[string]*typeddb.Kind{},
+		derivations:  config.Derived,
+		derivedKinds: map[*typeddb.Kind]bool{},
+		wakeUp:       config.WakeUp,
+		clock:        config.Clock,
+		session:      config.Session,
+		logger:       config.Logger,
+		debugTap:     config.DebugTap,
+		updated:      make(chan struct{}),
+		idleRequests: make(chan chan struct{}),
+	}
+	if db.clock == nil {
+		db.clock = clock.Real
 	}
+	db.scheduler = scheduler.NewWithClock(db.clock)
 
 	db.readyCtx, db.readyCancel = context.WithCancel(context.Background())
 
@@ -173,6 +237,44 @@ func New(config Config) *DB {
 		*db.source = config.Source
 	}
 
+	switch {
+	case config.Election != nil && config.Sharding != nil:
+		panic("leader election and sharding cannot be combined")
+	case config.Election != nil:
+		if db.source == nil {
+			panic("leader election requires a Source")
+		}
+		db.election = new(Election)
+		*db.election = *config.Election
+		if db.election.Name == "" {
+			db.election.Name = string(config.Producer)
+		}
+		name := db.election.Name
+		if db.election.ClockSkew == 0 {
+			db.election.ClockSkew = db.election.Duration / 10
+		}
+		if db.election.ClockSkew < 0 || db.election.ClockSkew >= db.election.Duration/2 {
+			panic("election clock skew must be non-negative and less than half of the lease duration")
+		}
+		db.leases = newLeaseTable(name, db.election.Duration, db.election.ClockSkew, func(id string) bool {
+			return id == name
+		})
+	case config.Sharding != nil:
+		if db.source == nil {
+			panic("sharding requires a Source")
+		}
+		db.sharding = new(Sharding)
+		*db.sharding = *config.Sharding
+		if db.sharding.Name == "" {
+			db.sharding.Name = string(config.Producer)
+		}
+		prefix := shardMemberID(db.sharding.Name, Source{})
+		db.leases = newLeaseTable(shardMemberID(db.sharding.Name, *db.source), db.sharding.Duration, db.sharding.Duration/10, func(id string) bool {
+			return strings.HasPrefix(id, prefix)
+		})
+		db.assignment = assignment{self: -1}
+	}
+
 	filter := wire.Filter{}
 	for _, kind := range config.Entities {
 		if db.kinds[kind.DBName] != nil {
@@ -186,7 +288,25 @@ func New(config Config) *DB {
 		}
 		filter[kind.DBName] = fields
 	}
-	db.connection = config.Client.Connect(len(config.DBHistory), wire.Beginning, filter, true)
+	if db.leases != nil {
+		filter[leaseKind] = []string{"Holder", "Session", "Expires"}
+	}
+	for _, d := range config.Derived {
+		if db.kinds[d.Kind.DBName] != nil || db.derivedKinds[d.Kind] {
+			panic(fmt.Sprintf("duplicate entity name: %s", d.Kind.DBName))
+		}
+		db.derivedKinds[d.Kind] = true
+	}
+	c := config.Client
+	if config.Where != nil {
+		for k := range config.Where {
+			if db.kinds[k] == nil {
+				panic(fmt.Sprintf("predicates for unknown entity: %s", k))
+			}
+		}
+		c = client.WithWhere(c, config.Where)
+	}
+	db.connection = c.Connect(len(config.DBHistory), wire.Beginning, filter, true)
 
 	if db.monitoringInstance == "" {
 		db.monitoringInstance = "main"
@@ -201,8 +321,16 @@ func New(config Config) *DB {
 // During startup, before Limestone has caught up with the hot end of the
 // transaction log, DoE panics.
 //
+// If leader election is enabled and this replica is not the leader, DoE
+// returns ErrNotLeader without calling fn.
+//
+// DoE returns the position of the written transaction in the transaction log,
+// or wire.Beginning if nothing has been written (or the client can't tell).
+// Pass it to WaitPosition of another DB, possibly in another service, to wait
+// until that DB has seen the transaction.
+//
 // Do not use the transaction from other goroutines or after fn returns.
-func (db *DB) DoE(fn func(txn Transaction) error) error {
+func (db *DB) DoE(fn func(txn Transaction) error) (wire.Position, error) {
 	if db.source == nil {
 		panic("The database is read-only")
 	}
@@ -211,18 +339,29 @@ func (db *DB) DoE(fn func(txn Transaction) error) error {
 		panic("Limestone is not ready")
 	}
 
-	txn, tc := db.tdb.Transaction()
+	if !db.IsLeader() {
+		return wire.Beginning, ErrNotLeader
+	}
+
+	txn, tc := db.tdb.TransactionBackdated(db.clock.Now())
 	defer tc.Cancel()
 
 	ctx := tlog.WithLogger(context.Background(), db.logger) // for logging only
 
 	if err := fn(txn); err != nil {
-		return err
+		return wire.Beginning, err
+	}
+
+	touched := map[typeddb.EID]bool{}
+	for eid := range tc.Changes() {
+		touched[eid] = true
 	}
+	db.derive(txn, tc, touched)
 
 	snapshot := txn.Snapshot()
 
-	if err := db.submit(ctx, tc); err != nil {
+	pos, err := db.submit(ctx, tc)
+	if err != nil {
 		// We cannot continue, as callers are not ready to handle this failure,
 		// they only expect errors to be returned from fn() above.
 		panic(fmt.Errorf("limestone cannot continue after a failure to submit transaction: %w", err))
@@ -233,25 +372,32 @@ func (db *DB) DoE(fn func(txn Transaction) error) error {
 	}
 
 	for eid, change := range tc.Changes() {
-		db.postProcess(tc, eid, change.After, time.Time{})
+		if !db.isDerived(eid.Kind) {
+			db.postProcess(tc, eid, change.After, time.Time{})
+		}
 	}
 
 	tc.Commit()
-	return nil
+	db.notifyUpdated()
+	return pos, nil
 }
 
 // Do calls fn with a new transcation. The transaction is committed if fn returns,
 // and is canceled if it panics.
 //
 // During startup, before the reader has caught up with the hot end of the
-// transaction log, Do panics.
+// transaction log, Do panics. If leader election is enabled and this replica
+// is not the leader, Do panics as well; use DoE to handle it.
 //
 // Do not use the transaction from other goroutines or after fn returns.
 func (db *DB) Do(fn func(txn Transaction)) {
-	_ = db.DoE(func(txn Transaction) error {
+	_, err := db.DoE(func(txn Transaction) error {
 		fn(txn)
 		return nil
 	})
+	if errors.Is(err, ErrNotLeader) {
+		panic("Limestone is not the leader")
+	}
 }
 
 func (db *DB) postProcess(tc typeddb.TransactionControl, eid typeddb.EID, obj any, now time.Time) {
@@ -261,6 +407,11 @@ func (db *DB) postProcess(tc typeddb.TransactionControl, eid typeddb.EID, obj an
 		return
 	}
 
+	if !db.owns(eid, obj) {
+		db.schedule(eid, time.Time{})
+		return
+	}
+
 	if d, ok := obj.(WithDeadline); ok {
 		deadline := d.Deadline()
 		if !deadline.IsZero() && now.After(deadline) {
@@ -284,7 +435,7 @@ func (db *DB) Snapshot() Snapshot {
 	if db.readyCtx.Err() == nil || !db.ready {
 		return nil
 	}
-	return db.tdb.Snapshot()
+	return db.tdb.SnapshotBackdated(db.clock.Now())
 }
 
 // WaitReady waits until Limestone has caught up. To be used in the start-up
@@ -307,10 +458,122 @@ func (db *DB) WaitReady(ctx context.Context) error {
 	}
 }
 
+// WaitFor waits until Limestone is ready and cond returns true for the current
+// snapshot, and returns that snapshot. cond is called once initially and then
+// after every committed transaction, possibly skipping some snapshots if
+// transactions are committed faster than cond is evaluated.
+//
+// If the context is canceled, WaitFor returns the context error along with the
+// last snapshot passed to cond (nil if Limestone has never been ready). If
+// Limestone is shut down before catch-up is complete, WaitFor returns an error
+// as WaitReady does.
+//
+// Unlike reading DebugTap, waiting never holds up Limestone, so any number of
+// goroutines may wait concurrently. Do not call WaitFor from WakeUp or from
+// within Do/DoE: the awaited transactions could never be committed.
+func (db *DB) WaitFor(ctx context.Context, cond func(Snapshot) bool) (Snapshot, error) {
+	if err := db.WaitReady(ctx); err != nil {
+		return nil, err
+	}
+
+	var last Snapshot
+	for {
+		// Take the channel before the snapshot so that no update is missed
+		updated := db.updatedCh()
+		last = db.tdb.SnapshotBackdated(db.clock.Now())
+		if cond(last) {
+			return last, nil
+		}
+		select {
+		case <-ctx.Done():
+			return last, ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// WaitIdle waits until Limestone has handled all the incoming transactions
+// received so far, has reached the hot end of the transaction log, and has no
+// pending WakeUp calls, including those for fired alarms.
+//
+// For use in tests only. WaitIdle knows nothing of the transactions that have
+// not reached Limestone yet. If Limestone is not running, WaitIdle blocks
+// until the context is canceled.
+func (db *DB) WaitIdle(ctx context.Context) error {
+	reply := make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case db.idleRequests <- reply:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-reply:
+		return nil
+	}
+}
+
+// WaitPosition waits until Limestone is ready and has handled the incoming
+// transactions up to the given position, as returned by DoE of this or another
+// DB using the same transaction log, so that the changes made by that
+// transaction are visible in Snapshot.
+//
+// The transactions filtered out by this DB still count: the connection
+// delivers their positions (see wire.PositionOnly). If Limestone is shut
+// down before catch-up is complete, WaitPosition returns an error as WaitReady
+// does. Do not call WaitPosition from WakeUp or from within Do/DoE.
+func (db *DB) WaitPosition(ctx context.Context, pos wire.Position) error {
+	if err := db.WaitReady(ctx); err != nil {
+		return err
+	}
+	for {
+		db.updatedMu.Lock()
+		updated, current := db.updated, db.position
+		db.updatedMu.Unlock()
+
+		if wire.ComparePositions(current, pos) >= 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-updated:
+		}
+	}
+}
+
+// setPosition records the position of the last incoming transaction reflected
+// in the snapshots and wakes up all WaitPosition callers
+func (db *DB) setPosition(pos wire.Position) {
+	db.updatedMu.Lock()
+	defer db.updatedMu.Unlock()
+	if db.position == pos {
+		return
+	}
+	db.position = pos
+	close(db.updated)
+	db.updated = make(chan struct{})
+}
+
+func (db *DB) updatedCh() <-chan struct{} {
+	db.updatedMu.Lock()
+	defer db.updatedMu.Unlock()
+	return db.updated
+}
+
+// notifyUpdated wakes up all WaitFor callers
+func (db *DB) notifyUpdated() {
+	db.updatedMu.Lock()
+	defer db.updatedMu.Unlock()
+	close(db.updated)
+	db.updated = make(chan struct{})
+}
+
 func (db *DB) schedule(eid typeddb.EID, when time.Time) {
 	if !when.IsZero() {
 		db.logger.Debug("Scheduling alarm", zap.Stringer("eid", eid), zap.Time("when", when),
-			zap.Duration("left", time.Until(when)))
+			zap.Duration("left", when.Sub(db.clock.Now())))
 	}
 	db.scheduler.Schedule(eid, when)
 }
@@ -318,6 +581,7 @@ func (db *DB) schedule(eid typeddb.EID, when time.Time) {
 // SnapshotAfterTransaction returns a snapshot, except that it waits for the current transaction (if any) to finish.
 // The need for this function is rare; only use it if you have a good reason.
 func SnapshotAfterTransaction(db DBReadWrite) Snapshot {
-	db.Do(func(Transaction) {})
+	// A replica that is not the leader runs no transactions to wait for
+	_, _ = db.DoE(func(Transaction) error { return nil })
 	return db.Snapshot()
 }
@@ -15,6 +15,7 @@ import (
 	"github.com/ridge/limestone/test"
 	"github.com/ridge/limestone/tlog"
 	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
 	"github.com/ridge/parallel"
 	"github.com/stretchr/testify/require"
 )
@@ -85,6 +86,18 @@ func (o optWakeUp) apply(c *Config) {
 	c.WakeUp = WakeUpFn(o)
 }
 
+type optClient struct{ client.Client }
+
+func (o optClient) apply(c *Config) {
+	c.Client = o.Client
+}
+
+type optEntities KindList
+
+func (o optEntities) apply(c *Config) {
+	c.Entities = KindList(o)
+}
+
 func testEnv(t *testing.T) (kafka.Client, *parallel.Group) {
 	k := mock.New()
 	group := test.GroupWithTimeout(t, testTimeout)
@@ -273,6 +286,33 @@ func TestResponse(t *testing.T) {
 	require.NoError(t, group.Context().Err()) // not timed out
 }
 
+func TestWakeUpFirstTime(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog",
+		foo{fooA: fooA{ID: fooID("f1"), A: 3}},
+	))
+
+	tap := make(chan Snapshot, 1)
+	createDB(k, group, Source{Producer: "b"}, optTap(tap), optWakeUp(func(ctx context.Context, txn Transaction, entities []any) {
+		for _, e := range entities {
+			f := e.(foo)
+			f.B = f.A
+			txn.Set(f)
+		}
+	}))
+
+	for snapshot := range tap {
+		var f1 foo
+		MustGet(snapshot, fooID("f1"), &f1)
+		if f1.B == 0 {
+			continue
+		}
+		require.Equal(t, 3, f1.B)
+		break
+	}
+	require.NoError(t, group.Context().Err()) // not timed out
+}
+
 func TestResponseLinked(t *testing.T) {
 	k, group := testEnv(t)
 
@@ -390,3 +430,132 @@ func TestResponseLinked(t *testing.T) {
 	}
 	require.NoError(t, group.Context().Err()) // not timed out
 }
+
+func TestWaitFor(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog",
+		foo{fooA: fooA{ID: "f1", A: 1}},
+	))
+
+	a := createDB(k, group, Source{Producer: "a"})
+	b := createDB(k, group, Source{Producer: "b"})
+
+	snapshot, err := b.WaitFor(group.Context(), func(snapshot Snapshot) bool {
+		return snapshot.Get(fooID("f1"), new(foo))
+	})
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+
+	// Any number of waiters, none of them holding up Limestone
+	waiters := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			_, err := b.WaitFor(group.Context(), func(snapshot Snapshot) bool {
+				var f foo
+				return snapshot.Get(fooID("f2"), &f) && f.A == 2
+			})
+			waiters <- err
+		}()
+	}
+
+	require.NoError(t, a.WaitReady(group.Context()))
+	a.Do(func(txn Transaction) {
+		txn.Set(foo{fooA: fooA{ID: "f2", A: 2}})
+	})
+	for i := 0; i < 3; i++ {
+		require.NoError(t, <-waiters)
+	}
+
+	var f foo
+	test.AssertEventuallyField(t, b, testTimeout, fooID("f2"), &f, "A", 2)
+	require.Equal(t, fooID("f2"), f.ID)
+
+	ctx, cancel := context.WithTimeout(group.Context(), 10*time.Millisecond)
+	defer cancel()
+	snapshot, err = b.WaitFor(ctx, func(Snapshot) bool { return false })
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotNil(t, snapshot)
+}
+
+func TestDuplicateTransactions(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog"))
+
+	set := func(seq int64, a int) wire.Transaction {
+		return wire.Transaction{
+			Source:  wire.Source{Producer: "a"},
+			Session: 7,
+			Seq:     seq,
+			Changes: wire.Changes{"foo": wire.KindChanges{"f1": wire.Diff{
+				"ID": json.RawMessage(`"f1"`),
+				"A":  must.OK1(json.Marshal(a)),
+			}}},
+		}
+	}
+	ctx := group.Context()
+	require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", set(1, 1)))
+	require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", set(2, 2)))
+	require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", set(1, 1))) // retried submit
+
+	db := createDB(k, group, Source{Producer: "b"})
+	require.NoError(t, db.WaitReady(ctx))
+	var f foo
+	require.True(t, db.Snapshot().Get(fooID("f1"), &f))
+	require.Equal(t, 2, f.A)
+
+	// Transactions without keys are never dropped
+	require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", set(0, 1)))
+	require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", set(0, 3)))
+	require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", set(0, 1)))
+	test.AssertEventuallyField(t, db, testTimeout, fooID("f1"), &f, "A", 1)
+}
+
+func TestWaitPosition(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog"))
+	ctx := group.Context()
+
+	a := createDB(k, group, Source{Producer: "a"})
+	b := createDB(k, group, Source{Producer: "b"})
+	require.NoError(t, a.WaitReady(ctx))
+	require.NoError(t, b.WaitReady(ctx))
+
+	pos, err := a.DoE(func(txn Transaction) error {
+		txn.Set(foo{fooA: fooA{ID: "f1", A: 1}})
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotEqual(t, wire.Beginning, pos)
+
+	require.NoError(t, b.WaitPosition(ctx, pos))
+	var f foo
+	require.True(t, b.Snapshot().Get(fooID("f1"), &f))
+	require.Equal(t, 1, f.A)
+
+	require.NoError(t, a.WaitPosition(ctx, pos)) // the own echo counts
+
+	pos, err = a.DoE(func(txn Transaction) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, wire.Beginning, pos)
+}
+
+func TestWaitPositionFilteredOut(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog"))
+	ctx := group.Context()
+
+	a := createDB(k, group, Source{Producer: "a"})
+	// The splitter filters out the changes to the kinds b doesn't know
+	splitter := client.NewSplitter(client.NewKafkaClient(k))
+	group.Spawn("splitter", parallel.Fail, splitter.Run)
+	b := createDB(k, group, Source{Producer: "b"}, optClient{splitter}, optEntities{kindFoo})
+	require.NoError(t, a.WaitReady(ctx))
+	require.NoError(t, b.WaitReady(ctx))
+
+	pos, err := a.DoE(func(txn Transaction) error {
+		txn.Set(bar{barA: barA{ID: "b1", A: "x"}})
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, b.WaitPosition(ctx, pos))
+}
@@ -0,0 +1,112 @@
+package limestone
+
+import (
+	"reflect"
+
+	"github.com/ridge/limestone/typeddb"
+)
+
+// Change is a change to an entity. Before is nil if the entity has been
+// created, After is nil if it has been forgotten.
+type Change = typeddb.Change
+
+// DeriveFn is a callback type for recalculating derived entities. It receives
+// the changes to the source entities made in the transaction, and updates
+// the derived entities in the transaction accordingly.
+type DeriveFn func(txn Transaction, changes []Change)
+
+// A Derivation describes a kind of derived entities. Derived entities are
+// computed from source entities by the service itself: they are kept in memory
+// with their own indices like any other entities, but they are never written
+// to or read from Kafka.
+//
+// Limestone calls Derive at the end of every transaction that changes entities
+// of the source kinds, whether the transaction is local (Do/DoE) or incoming.
+// For incoming transactions, Derive is called before WakeUp, so WakeUp sees the
+// derived entities up to date, and then once more for the changes made by
+// WakeUp. The derived entities are updated atomically with the source
+// entities, so snapshots never see them out of sync.
+//
+// To delete a derived entity, define a Survive method for the derived kind and
+// make it return false. Deadline is not supported for derived kinds.
+type Derivation struct {
+	// Kind is the kind of derived entities. Its DB name must not coincide
+	// with the name of any other kind.
+	Kind *Kind
+
+	// Sources is the list of kinds whose changes trigger recalculation.
+	// It may include derived kinds of preceding derivations in the
+	// Config.Derived list.
+	Sources KindList
+
+	// Derive recalculates derived entities. It should only modify entities
+	// of Kind.
+	//
+	// The Derive function must depend on nothing but the contents of
+	// the transaction.
+	Derive DeriveFn
+}
+
+func (db *DB) isDerived(kind *typeddb.Kind) bool {
+	return db.derivedKinds[kind]
+}
+
+// derive runs the derivations for the entities touched in the transaction
+// and prunes derived entities that should not survive.
+//
+// The state of a touched entity before the change is taken from tc.Changes()
+// if it's there, so after tc.Reset the derivations only see the changes made
+// since then.
+func (db *DB) derive(txn Transaction, tc typeddb.TransactionControl, touched map[typeddb.EID]bool) {
+	if len(db.derivations) == 0 {
+		return
+	}
+
+	touched = cloneTouched(touched)
+	for _, d := range db.derivations {
+		sources := map[*typeddb.Kind]bool{}
+		for _, kind := range d.Sources {
+			sources[kind] = true
+		}
+		var changes []Change
+		for eid := range touched {
+			if !sources[eid.Kind] {
+				continue
+			}
+			change, ok := tc.Changes()[eid]
+			if !ok {
+				change.Before = tc.GetBeforeByEID(eid) // pruned
+			}
+			change.After = tc.GetByEID(eid)
+			if !reflect.DeepEqual(change.Before, change.After) {
+				changes = append(changes, change)
+			}
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		d.Derive(txn, changes)
+		for eid := range tc.Changes() {
+			if eid.Kind == d.Kind {
+				touched[eid] = true
+			}
+		}
+	}
+
+	for eid, change := range tc.Changes() {
+		if !db.isDerived(eid.Kind) {
+			continue
+		}
+		if s, ok := change.After.(withSurvive); ok && !s.Survive() {
+			tc.Prune(eid)
+		}
+	}
+}
+
+func cloneTouched(touched map[typeddb.EID]bool) map[typeddb.EID]bool {
+	res := make(map[typeddb.EID]bool, len(touched))
+	for eid := range touched {
+		res[eid] = true
+	}
+	return res
+}
@@ -0,0 +1,148 @@
+package limestone
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/require"
+)
+
+type totalID string
+type total struct {
+	Meta `limestone:"name=total"`
+	ID   totalID `limestone:"identity"`
+	Sum  int
+	N    int
+}
+
+func (t total) Survive() bool {
+	return t.N > 0
+}
+
+var kindTotal = KindOf(total{})
+
+type optDerived Derivation
+
+func (o optDerived) apply(c *Config) {
+	c.Derived = append(c.Derived, Derivation(o))
+}
+
+var derivationTotal = optDerived{
+	Kind:    kindTotal,
+	Sources: KindList{kindFoo},
+	Derive: func(txn Transaction, changes []Change) {
+		var t total
+		if !txn.Get(totalID("all"), &t) {
+			t.ID = "all"
+		}
+		for _, c := range changes {
+			if c.Before != nil {
+				t.Sum -= c.Before.(foo).A
+				t.N--
+			}
+			if c.After != nil {
+				t.Sum += c.After.(foo).A
+				t.N++
+			}
+		}
+		txn.Set(t)
+	},
+}
+
+func TestDerived(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog",
+		foo{fooA: fooA{ID: "f1", A: 1}},
+	))
+
+	messages := make(chan *kafka.IncomingMessage, 10)
+	group.Spawn("reader", parallel.Fail, func(ctx context.Context) error {
+		return k.Read(ctx, "txlog", 1, messages)
+	})
+
+	tapA := make(chan Snapshot, 1)
+	a := createDB(k, group, Source{Producer: "a"}, optTap(tapA), derivationTotal)
+	tapB := make(chan Snapshot)
+	createDB(k, group, Source{Producer: "b"}, optTap(tapB), derivationTotal)
+
+	require.NoError(t, a.WaitReady(group.Context()))
+	var tot total
+	MustGet(a.Snapshot(), totalID("all"), &tot)
+	require.Equal(t, total{ID: "all", Sum: 1, N: 1}, tot)
+	<-tapA
+
+	a.Do(func(txn Transaction) {
+		txn.Set(foo{fooA: fooA{ID: "f2", A: 2}})
+		var f1 foo
+		MustGet(txn, fooID("f1"), &f1)
+		f1.A = 10
+		txn.Set(f1)
+	})
+	MustGet(<-tapA, totalID("all"), &tot)
+	require.Equal(t, total{ID: "all", Sum: 12, N: 2}, tot)
+
+	msg := <-messages
+	if msg == nil { // hot end
+		msg = <-messages
+	}
+	var wtxn wire.Transaction
+	require.NoError(t, json.Unmarshal(msg.Value, &wtxn))
+	require.NotContains(t, wtxn.Changes, "total")
+
+	for snapshot := range tapB {
+		if snapshot.Get(totalID("all"), &tot) && tot.N == 2 {
+			break
+		}
+	}
+	require.NoError(t, group.Context().Err()) // not timed out
+	require.Equal(t, total{ID: "all", Sum: 12, N: 2}, tot)
+}
+
+func TestDerivedWakeUp(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog",
+		foo{fooA: fooA{ID: "f1", A: 1}},
+	))
+
+	a := createDB(k, group, Source{Producer: "a"})
+	tapB := make(chan Snapshot, 1)
+	createDB(k, group, Source{Producer: "b"}, optTap(tapB), derivationTotal, optWakeUp(func(ctx context.Context, txn Transaction, entities []any) {
+		var tot total
+		MustGet(txn, totalID("all"), &tot)
+		for _, e := range entities {
+			if f := e.(foo); f.B != tot.Sum {
+				f.B = tot.Sum
+				txn.Set(f)
+			}
+		}
+	}))
+
+	require.NoError(t, a.WaitReady(group.Context()))
+	a.Do(func(txn Transaction) {
+		txn.Set(foo{fooA: fooA{ID: "f2", A: 2}})
+	})
+
+	for snapshot := range tapB {
+		var f2 foo
+		if !snapshot.Get(fooID("f2"), &f2) || f2.B == 0 {
+			continue
+		}
+		require.Equal(t, 3, f2.B) // WakeUp has seen the derived entity updated with f2
+		var tot total
+		MustGet(snapshot, totalID("all"), &tot)
+		require.Equal(t, total{ID: "all", Sum: 3, N: 2}, tot) // changes by WakeUp are derived once
+		break
+	}
+	require.NoError(t, group.Context().Err()) // not timed out
+}
+
+func TestDerivedDuplicateName(t *testing.T) {
+	k, group := testEnv(t)
+	require.PanicsWithValue(t, "duplicate entity name: foo", func() {
+		createDB(k, group, Source{Producer: "a"}, optDerived{Kind: KindOf(fooA{}), Sources: KindList{kindFoo}})
+	})
+}
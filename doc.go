@@ -93,6 +93,36 @@
 // name is the same as the Go field name. This option should be used to avoid
 // conflicts when two fields in different sections have the same Go name.
 //
+// * default=VALUE: sets the value that the field takes when an entity is
+// created by an update that does not mention the field. For string-based
+// fields, VALUE is taken literally; for other fields, it is the JSON
+// representation of the value. Commas cannot be used in VALUE. This makes it
+// possible to add a field whose zero value is not a sensible default without
+// converting the history. See also the Defaults method below.
+//
+// * patch: applies to map and slice fields. When such a field of an existing
+// entity is modified, only the difference is sent: a shallow JSON merge patch
+// for a map, or a list of removed and appended elements for a slice. This
+// keeps updates to large collections small, and allows several producers to
+// update disjoint keys of the same map. The entire value is still sent when it
+// is more compact than the patch. Patches are marked with the "$patch" key, so
+// all consumers of the entity kind must run a Limestone version that
+// understands them.
+//
+// * secret: the value of the field is replaced with a placeholder when
+// transactions are logged. Clients tell the Limestone server which fields of
+// which kinds are secret when they connect, so the server redacts the field
+// once any client that has the entity structure declared has connected to it.
+// Identity fields cannot be secret.
+//
+// * encrypted: implies secret. The value of the field is encrypted before it is
+// written to Kafka and decrypted when it is read, so that it never appears in
+// the transaction log in plaintext. The keys are supplied by the process-wide
+// key provider set using wire.SetKeyProvider; every producer and consumer of
+// the field needs it. Encrypted values are redacted in logs everywhere,
+// including the Limestone server. Plain values written before the field was
+// declared encrypted are still accepted. Cannot be combined with patch.
+//
 // * - (hyphen): declares the field as hidden. Such a field is not exported to
 // Kafka and not updated from incoming Kafka messages. It is used to store
 // non-persistent data local to the service. Such fields still can only be
@@ -218,6 +248,31 @@
 //
 // The typical use case for Survive is to discard entities with Deleted flag.
 //
+// # Defaults
+//
+// The entity structure can define an optional Defaults method:
+//
+//	func (Foo) Defaults() Foo
+//
+// If this method exists, Limestone calls it when an incoming update creates an
+// entity. Fields not mentioned in the update take their values from the
+// returned structure instead of the zero values. Options default=VALUE on
+// individual fields take precedence over the result of Defaults.
+//
+// When a new entity is submitted, fields with default values are written
+// explicitly, so changing the defaults later does not affect existing
+// entities.
+//
+// The Defaults method must be a pure function.
+//
+// # Derived entities
+//
+// Services often need state derived from the entities, such as per-fleet totals
+// or denormalized names. Instead of maintaining it by hand in WakeUp, declare
+// a derived kind in Config.Derived (see Derivation). Limestone recalculates
+// derived entities in every transaction that changes their sources, stores them
+// in memory with their own indices, and never exports them to Kafka.
+//
 // # Initial catch-up
 //
 // When the service starts, Limestone begins to catch up with Kafka history.
@@ -232,6 +287,44 @@
 // Deadline handlers will be called as usual after the initial transaction is
 // complete.
 //
+// # Leader election
+//
+// When several replicas of a service run concurrently, each of them would call
+// WakeUp and submit the same changes. Set Config.Election to let the replicas
+// elect a leader through a lease kept in the transaction log: only the leader
+// calls WakeUp and accepts transactions (on followers, DoE returns ErrNotLeader
+// and Do panics), while the followers keep up-to-date snapshots. If the leader dies, another replica takes over once the lease
+// expires. The replicas must differ in Source.Instance. See Election.
+//
+// If one process cannot cope with all the WakeUp work, set Config.Sharding
+// instead. Every replica keeps the entire state, but calls WakeUp and schedules
+// deadlines only for the entities whose IDs (or custom shard keys) fall into
+// its hash range. The ranges are rebalanced when replicas join or leave. See
+// Sharding.
+//
+// # Row-level predicates
+//
+// A service that only needs a subset of the entities of a kind can set
+// Config.Where, for example to the records of one data center. Entities that
+// don't match the predicates are never stored locally, and an entity that stops
+// matching is removed as if it were pruned. The Limestone server applies the
+// predicates at the source; other clients, and older servers, apply them
+// locally. See wire.Where.
+//
+// Predicates save network traffic and local memory, not work at the source:
+// whoever applies them reads the transaction log from the beginning for every
+// new connection, even one resuming from a position, and keeps the properties of all entities of the restricted
+// kinds, matching or not.
+//
+// # Read-your-writes
+//
+// DoE returns the position of the written transaction in the transaction log.
+// Another DB reading the same log, possibly in another service, can wait for
+// it with WaitPosition, after which its snapshots include the changes. The
+// other DB does not need to have the changed kinds declared. For example, a
+// service that writes and then asks a read-only replica to act on the write
+// passes the position along with the request.
+//
 // # Command line
 //
 // Importing the limestone package adds the following option to global set
@@ -271,13 +364,11 @@
 //
 // 4. Initialize a test agent imitating the DCM connected to mock Kafka.
 //
-//	tapDCM := make(chan Snapshot)
 //	mockDCM := limestone.New(limestone.Config{
 //	    Kafka:    k,
 //	    Entities: limestone.KindList{kindInstance},
 //	    Source:   limestone.Source{Producer: "example-service"},
 //	    Logger:   tlog.Get(ctx),
-//	    DebugTap: tapDCM,
 //	})
 //	go mockDCM.Run(ctx)
 //
@@ -290,15 +381,26 @@
 //
 // 6. As mock DCM, wait for the expected number of instances to be created by the allocator.
 //
-//	for snapshot := range tapDCM {
+//	_, err := mockDCM.WaitFor(ctx, func(snapshot limestone.Snapshot) bool {
 //	    iter := snapshot.Search(kindInstance, indexFleetID, fleetID)
 //	    n := 0
 //	    var inst Instance
 //	    for iter(&inst) {
 //	        n++
 //	    }
-//	    if n == expectedNumber {
-//	        break
-//	    }
-//	}
+//	    return n == expectedNumber
+//	})
+//	require.NoError(t, err)
+//
+// WaitFor never holds up Limestone, unlike reading snapshots from
+// Config.DebugTap. The test package provides assertion helpers built on it,
+// such as test.AssertEventuallyField:
+//
+//	var inst Instance
+//	test.AssertEventuallyField(t, mockDCM, time.Second, instanceID, &inst, "State", StateRunning)
+//
+// To test a single service in isolation, use the harness package. It runs the
+// service's Limestone instance over mock Kafka with a fake clock, injects
+// transactions of other producers, advances time to trigger deadlines, and
+// records the transactions the service submits.
 package limestone
@@ -0,0 +1,171 @@
+// Package fixture records ranges of a production Limestone transaction log
+// into compact fixture files and replays them in tests.
+//
+// A typical use is reproducing a failing WakeUp: record the range of the
+// transaction log around the failure, then replay it into a DB under test
+// (via Client) or into mock Kafka (via Replay), stopping just before or just
+// after the offending transaction.
+package fixture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+)
+
+// NoStop is the stopAt value that means to replay all recorded transactions
+const NoStop int64 = -1
+
+// Fixture is a recorded range of a transaction log
+type Fixture struct {
+	// Manifest is the manifest current at the time of recording
+	Manifest wire.Manifest
+
+	// State is the compacted state of the database before the first
+	// recorded transaction, nil if the range starts at the beginning of the
+	// transaction log. Each entity's diff is the merge of all its diffs, so
+	// entities deleted before the range are included with their last values.
+	State wire.Changes `json:",omitempty"`
+
+	// StateTime is the timestamp of the last transaction merged into State
+	StateTime time.Time
+
+	Transactions []Transaction `json:"-"` // stored one per line
+}
+
+// Transaction is a recorded transaction
+type Transaction struct {
+	Offset int64     // offset in the original topic
+	Time   time.Time // original Kafka message timestamp
+	wire.Transaction
+}
+
+// Save writes the fixture in its file format: gzip-compressed JSON lines, the
+// first one describing the manifest and the state, followed by one line per
+// transaction
+func (f Fixture) Save(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(f); err != nil {
+		return err
+	}
+	for _, txn := range f.Transactions {
+		if err := enc.Encode(txn); err != nil {
+			return err
+		}
+	}
+	return gz.Close()
+}
+
+// SaveFile writes the fixture into a file
+func (f Fixture) SaveFile(path string) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return f.Save(file)
+}
+
+// Load reads a fixture written by Save
+func Load(r io.Reader) (Fixture, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return Fixture{}, fmt.Errorf("failed to read fixture: %w", err)
+	}
+	dec := json.NewDecoder(bufio.NewReader(gz))
+
+	var f Fixture
+	if err := dec.Decode(&f); err != nil {
+		return Fixture{}, fmt.Errorf("failed to read fixture header: %w", err)
+	}
+	for {
+		var txn Transaction
+		err := dec.Decode(&txn)
+		if err == io.EOF {
+			return f, nil
+		}
+		if err != nil {
+			return Fixture{}, fmt.Errorf("failed to read fixture transaction %d: %w", len(f.Transactions), err)
+		}
+		f.Transactions = append(f.Transactions, txn)
+	}
+}
+
+// LoadFile reads a fixture from a file
+func LoadFile(path string) (Fixture, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Fixture{}, err
+	}
+	defer file.Close()
+	return Load(file)
+}
+
+// MustLoadFile reads a fixture from a file, panicking on error. Handy in tests.
+func MustLoadFile(path string) Fixture {
+	return must.OK1(LoadFile(path))
+}
+
+// until returns the transactions before the stopAt offset
+func (f Fixture) until(stopAt int64) []Transaction {
+	if stopAt == NoStop {
+		return f.Transactions
+	}
+	for i, txn := range f.Transactions {
+		if txn.Offset >= stopAt {
+			return f.Transactions[:i]
+		}
+	}
+	return f.Transactions
+}
+
+// stateTransaction returns the administrative transaction recreating State
+func (f Fixture) stateTransaction() wire.Transaction {
+	ts := f.StateTime
+	return wire.Transaction{TS: &ts, Changes: f.State}
+}
+
+// mergeChanges merges the changes into the compacted state. Changes containing
+// invalid patches are skipped and reported in the returned error.
+func mergeChanges(state, changes wire.Changes) error {
+	var errs []error
+	for kind, kc := range changes {
+		byID := state[kind]
+		if byID == nil {
+			byID = wire.KindChanges{}
+			state[kind] = byID
+		}
+		for id, diff := range kc {
+			merged := byID[id]
+			if merged == nil {
+				merged = wire.Diff{}
+				byID[id] = merged
+			}
+			for k, v := range diff {
+				if wire.IsPatch(v) {
+					patched, err := wire.ApplyDiffPatch(merged[k], v)
+					if err != nil {
+						errs = append(errs, fmt.Errorf("%s %s field %s: %w", kind, id, k, err))
+						continue
+					}
+					v = patched
+				}
+				merged[k] = v
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
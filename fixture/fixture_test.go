@@ -0,0 +1,105 @@
+package fixture
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone"
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/clock"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/require"
+)
+
+type thingID string
+
+type thing struct {
+	limestone.Meta `limestone:"name=thing,producer=p"`
+	ID             thingID `limestone:"identity"`
+	N              int
+}
+
+var kindThing = limestone.KindOf(thing{})
+
+var t0 = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func recorded(t *testing.T) Fixture {
+	ctx := test.Context(t)
+	k := mock.NewWithClock(clock.NewFake(t0))
+	require.NoError(t, limestone.Bootstrap(ctx, k, 1, "txlog", thing{ID: "t1", N: 1}))
+	for _, changes := range []wire.Changes{
+		{"thing": {"t1": {"N": []byte("2")}}},
+		{"thing": {"t2": {"ID": []byte(`"t2"`), "N": []byte("5")}}},
+	} {
+		require.NoError(t, client.PublishKafkaTransaction(ctx, k, "txlog", wire.Transaction{
+			Source:  wire.Source{Producer: "p"},
+			Changes: changes,
+		}))
+	}
+
+	f, err := Record(ctx, k, Range{From: 1})
+	require.NoError(t, err)
+	return f
+}
+
+func snapshotOf(t *testing.T, c limestone.Client) limestone.Snapshot {
+	group := test.GroupWithTimeout(t, 10*time.Second)
+	db := limestone.New(limestone.Config{
+		DBHistory: []string{"initial"},
+		Client:    c,
+		Entities:  limestone.KindList{kindThing},
+		Logger:    tlog.Get(group.Context()),
+	})
+	group.Spawn("limestone", parallel.Fail, db.Run)
+	require.NoError(t, db.WaitReady(group.Context()))
+	return db.Snapshot()
+}
+
+func TestRecord(t *testing.T) {
+	f := recorded(t)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog"}, f.Manifest)
+	require.Equal(t, wire.Changes{"thing": {"t1": {"ID": []byte(`"t1"`), "N": []byte("1")}}}, f.State)
+	require.Len(t, f.Transactions, 2)
+	require.Equal(t, int64(1), f.Transactions[0].Offset)
+	require.Equal(t, int64(2), f.Transactions[1].Offset)
+	require.Equal(t, t0, f.Transactions[1].Time)
+
+	var buf bytes.Buffer
+	require.NoError(t, f.Save(&buf))
+	loaded, err := Load(&buf)
+	require.NoError(t, err)
+	require.Equal(t, f, loaded)
+}
+
+func TestClient(t *testing.T) {
+	f := recorded(t)
+
+	snapshot := snapshotOf(t, f.Client(2))
+	var th thing
+	limestone.MustGet(snapshot, thingID("t1"), &th)
+	require.Equal(t, 2, th.N)
+	require.False(t, snapshot.Get(thingID("t2"), &th))
+
+	snapshot = snapshotOf(t, f.Client(NoStop))
+	limestone.MustGet(snapshot, thingID("t2"), &th)
+	require.Equal(t, 5, th.N)
+}
+
+func TestReplay(t *testing.T) {
+	f := recorded(t)
+
+	k := mock.New()
+	require.NoError(t, f.Replay(context.Background(), k, 2))
+
+	snapshot := snapshotOf(t, client.NewKafkaClient(k))
+	var th thing
+	limestone.MustGet(snapshot, thingID("t1"), &th)
+	require.Equal(t, 2, th.N)
+	require.False(t, snapshot.Get(thingID("t2"), &th))
+}
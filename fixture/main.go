@@ -0,0 +1,68 @@
+package fixture
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/run"
+	"github.com/ridge/limestone/tlog"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+// Main handles the command line and runs the recorder
+func Main(args []string) {
+	var kafkaURI, output, since, until string
+	var r Range
+	pflag.StringVar(&kafkaURI, "kafka", "", "Kafka URI")
+	pflag.StringVar(&output, "output", "", "Fixture file to write")
+	pflag.Int64Var(&r.From, "from", 0, "First offset to record")
+	pflag.Int64Var(&r.To, "to", 0, "Offset to stop recording at (exclusive). Default: record up to the hot end")
+	pflag.StringVar(&since, "since", "", "First timestamp to record (RFC 3339)")
+	pflag.StringVar(&until, "until", "", "Timestamp to stop recording at (RFC 3339, exclusive)")
+	_ = pflag.CommandLine.Parse(args[1:])
+
+	run.Tool(func(ctx context.Context) error {
+		if kafkaURI == "" {
+			return errors.New("--kafka is required")
+		}
+		if output == "" {
+			return errors.New("--output is required")
+		}
+		var err error
+		if r.Since, err = parseTime("since", since); err != nil {
+			return err
+		}
+		if r.Until, err = parseTime("until", until); err != nil {
+			return err
+		}
+		k, err := kafka.FromURI(kafkaURI)
+		if err != nil {
+			return err
+		}
+
+		f, err := Record(ctx, k, r)
+		if err != nil {
+			return err
+		}
+		if err := f.SaveFile(output); err != nil {
+			return fmt.Errorf("failed to save fixture: %w", err)
+		}
+		tlog.Get(ctx).Info("Fixture saved", zap.String("file", output))
+		return nil
+	})
+}
+
+func parseTime(label, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --%s: %w", label, err)
+	}
+	return t, nil
+}
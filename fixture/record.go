@@ -0,0 +1,89 @@
+package fixture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/parallel"
+	"go.uber.org/zap"
+)
+
+// Range selects the transactions to record. Zero values mean no limit.
+type Range struct {
+	From, To     int64     // offsets: From inclusive, To exclusive
+	Since, Until time.Time // message timestamps: Since inclusive, Until exclusive
+}
+
+func (r Range) before(msg *kafka.IncomingMessage) bool {
+	return msg.Offset < r.From || msg.Time.Before(r.Since)
+}
+
+func (r Range) after(msg *kafka.IncomingMessage) bool {
+	return r.To != 0 && msg.Offset >= r.To || !r.Until.IsZero() && !msg.Time.Before(r.Until)
+}
+
+// Record reads the current manifest and the given range of the transaction
+// log, up to the hot end, into a fixture. The transactions before the range
+// are compacted into Fixture.State.
+func Record(ctx context.Context, k kafka.Client, r Range) (Fixture, error) {
+	logger := tlog.Get(ctx)
+
+	manifest, err := client.NewKafkaClient(k).RetrieveManifest(ctx, false)
+	if err != nil {
+		return Fixture{}, fmt.Errorf("failed to record fixture: %w", err)
+	}
+	f := Fixture{Manifest: manifest}
+	logger.Info("Recording transaction log", zap.Object("manifest", manifest))
+
+	err = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		messages := make(chan *kafka.IncomingMessage)
+		spawn("reader", parallel.Fail, func(ctx context.Context) error {
+			return k.Read(ctx, manifest.Topic, 0, messages)
+		})
+		spawn("recorder", parallel.Exit, func(ctx context.Context) error {
+			for {
+				var msg *kafka.IncomingMessage
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg = <-messages:
+				}
+				if msg == nil || r.after(msg) {
+					return nil
+				}
+				if len(msg.Value) == 0 {
+					continue // padding
+				}
+
+				txn := Transaction{Offset: msg.Offset, Time: msg.Time}
+				if err := json.Unmarshal(msg.Value, &txn.Transaction); err != nil {
+					return fmt.Errorf("failed to parse transaction at offset %d: %w", msg.Offset, err)
+				}
+				if r.before(msg) {
+					if f.State == nil {
+						f.State = wire.Changes{}
+					}
+					if err := mergeChanges(f.State, txn.Changes); err != nil {
+						logger.Warn("Skipped invalid changes", zap.Int64("offset", msg.Offset), zap.Error(err))
+					}
+					f.StateTime = msg.Time
+					continue
+				}
+				f.Transactions = append(f.Transactions, txn)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return Fixture{}, fmt.Errorf("failed to record fixture: %w", err)
+	}
+	logger.Info("Recorded transaction log", zap.Int("transactions", len(f.Transactions)),
+		zap.Int("stateKinds", len(f.State)))
+	return f, nil
+}
@@ -0,0 +1,128 @@
+package fixture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+)
+
+// Replay writes the fixture into Kafka (normally, kafka/mock): the state and
+// the recorded transactions before the stopAt offset (or all of them if stopAt
+// is NoStop) into the topic named in the manifest, with original timestamps,
+// followed by the manifest. The topic must be empty.
+//
+// The offsets of the replayed transactions differ from the original ones.
+func (f Fixture) Replay(ctx context.Context, k kafka.ClientBackdate, stopAt int64) error {
+	topic := f.Manifest.Topic
+	var messages []kafka.IncomingMessage
+	if f.State != nil {
+		messages = append(messages, kafka.IncomingMessage{
+			Message: kafka.Message{Topic: topic, Value: must.OK1(json.Marshal(f.stateTransaction()))},
+			Time:    f.StateTime,
+		})
+	}
+	for _, txn := range f.until(stopAt) {
+		messages = append(messages, kafka.IncomingMessage{
+			Message: kafka.Message{Topic: topic, Value: must.OK1(json.Marshal(txn.Transaction))},
+			Time:    txn.Time,
+		})
+	}
+	if err := k.WriteBackdated(ctx, topic, messages); err != nil {
+		return fmt.Errorf("failed to replay fixture: %w", err)
+	}
+	if err := client.PublishKafkaManifest(ctx, k, f.Manifest); err != nil {
+		return fmt.Errorf("failed to replay fixture: %w", err)
+	}
+	return nil
+}
+
+// Client returns a Limestone client that feeds the fixture directly into a DB
+// under test: the state followed by the recorded transactions before the
+// stopAt offset (or all of them if stopAt is NoStop), then the hot end marker.
+//
+// Positions of the replayed transactions are their original offsets in
+// decimal. Submitted transactions are accepted and discarded: the replayed
+// log never changes.
+func (f Fixture) Client(stopAt int64) client.Client {
+	return fixtureClient{fixture: f, stopAt: stopAt}
+}
+
+type fixtureClient struct {
+	fixture Fixture
+	stopAt  int64
+}
+
+func (fc fixtureClient) Connect(version int, pos wire.Position, filter wire.Filter, compact bool) client.Connection {
+	return &fixtureConnection{fixtureClient: fc, version: version, pos: pos}
+}
+
+type fixtureConnection struct {
+	fixtureClient
+	version int
+	pos     wire.Position
+}
+
+func (fc *fixtureConnection) Submit(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
+	return wire.Beginning, nil
+}
+
+func (fc *fixtureConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) error {
+	f := fc.fixture
+	if fc.version != f.Manifest.Version {
+		return wire.ErrVersionMismatch(fc.version, f.Manifest.Version)
+	}
+
+	send := func(txn *wire.IncomingTransaction) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case sink <- txn:
+			return nil
+		}
+	}
+
+	after := int64(-1)
+	if fc.pos == wire.Beginning {
+		if f.State != nil {
+			if err := send(&wire.IncomingTransaction{
+				Transaction: f.stateTransaction(),
+				Position:    "state",
+			}); err != nil {
+				return err
+			}
+		}
+	} else if fc.pos != "state" {
+		var err error
+		if after, err = strconv.ParseInt(string(fc.pos), 10, 64); err != nil {
+			return wire.ErrContinuityBroken
+		}
+	}
+
+	for _, txn := range f.until(fc.stopAt) {
+		if txn.Offset <= after {
+			continue
+		}
+		incoming := &wire.IncomingTransaction{
+			Transaction: txn.Transaction,
+			Position:    wire.Position(strconv.FormatInt(txn.Offset, 10)),
+		}
+		if incoming.TS == nil {
+			ts := txn.Time
+			incoming.TS = &ts
+		}
+		if err := send(incoming); err != nil {
+			return err
+		}
+	}
+	if err := send(nil); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
@@ -0,0 +1,274 @@
+// Package harness runs a real Limestone instance in memory for component
+// tests of services built on Limestone.
+//
+// Unlike mock.DBReadWrite, the harness runs the complete Limestone machinery:
+// WakeUp, Deadline, Survive and derived entities. It uses the in-memory Kafka
+// simulator and a fake clock, and lets the test:
+//
+//   - inject transactions from other producers (Inject),
+//   - advance time to trigger deadlines (Advance),
+//   - wait until the service has handled everything (Settle),
+//   - inspect the exact transactions the service has submitted (TakeSubmitted).
+//
+// Not for use outside tests.
+package harness
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone"
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/clock"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/require"
+)
+
+// Epoch is the initial time of the fake clock
+var Epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Timeout limits the time the harness waits for Limestone to become ready or
+// to settle
+var Timeout = 10 * time.Second
+
+const topic = "txlog"
+
+// Harness is a Limestone instance running over in-memory Kafka with a fake
+// clock
+type Harness struct {
+	t     *testing.T
+	group *parallel.Group
+	kafka kafka.ClientBackdate
+	clock *clock.Fake
+	db    *limestone.DB
+
+	mu        sync.Mutex
+	delivered int           // number of transactions delivered to the DB
+	atHotEnd  bool          // the hot end marker has been delivered after them
+	progress  chan struct{} // closed and replaced on every delivery
+	submitted []wire.Transaction
+}
+
+// New bootstraps the in-memory Kafka with the given initial entities, starts
+// Limestone with the given configuration and waits until it has settled.
+//
+// Client and Clock in the configuration are replaced by the harness. If Logger
+// is nil, the test logger is used. The DB version is the length of DBHistory.
+func New(t *testing.T, config limestone.Config, initial ...any) *Harness {
+	h := &Harness{
+		t:        t,
+		group:    test.Group(t),
+		clock:    clock.NewFake(Epoch),
+		progress: make(chan struct{}),
+	}
+	h.kafka = mock.NewWithClock(h.clock)
+
+	ctx := h.group.Context()
+	require.NoError(t, limestone.Bootstrap(ctx, h.kafka, len(config.DBHistory), topic, initial...))
+
+	config.Client = recordingClient{Client: client.NewKafkaClient(h.kafka), h: h}
+	config.Clock = h.clock
+	if config.Logger == nil {
+		config.Logger = tlog.Get(ctx)
+	}
+	h.db = limestone.New(config)
+	h.group.Spawn("limestone", parallel.Fail, h.db.Run)
+
+	ctx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+	require.NoError(t, h.db.WaitReady(ctx))
+	h.Settle()
+	return h
+}
+
+// DB returns the Limestone instance under test
+func (h *Harness) DB() *limestone.DB {
+	return h.db
+}
+
+// Clock returns the fake clock used by Limestone and the in-memory Kafka
+func (h *Harness) Clock() *clock.Fake {
+	return h.clock
+}
+
+// Kafka returns the in-memory Kafka
+func (h *Harness) Kafka() kafka.ClientBackdate {
+	return h.kafka
+}
+
+// Inject submits a transaction setting the given entities on behalf of the
+// given source, as if it came from another service, and waits until
+// Limestone has settled. Only the fields that differ from the current state of
+// the entities are included. The empty source means an administrative
+// transaction that may write any field.
+func (h *Harness) Inject(source limestone.Source, entities ...any) {
+	h.t.Helper()
+
+	snapshot := h.db.Snapshot()
+	changes := wire.Changes{}
+	for _, e := range entities {
+		v := reflect.ValueOf(e)
+		s := meta.Survey(v.Type())
+		id := v.FieldByIndex(s.Identity().Index)
+
+		var before any
+		if ptr := reflect.New(v.Type()); snapshot.Get(id.Interface(), ptr.Interface()) {
+			before = ptr.Elem().Interface()
+		}
+		diff := must.OK1(wire.Encode(s, before, e, nil))
+		if diff == nil {
+			continue
+		}
+		if changes[s.DBName] == nil {
+			changes[s.DBName] = wire.KindChanges{}
+		}
+		changes[s.DBName][id.String()] = diff
+	}
+	if len(changes) == 0 {
+		return
+	}
+
+	require.NoError(h.t, client.PublishKafkaTransaction(h.group.Context(), h.kafka, topic, wire.Transaction{
+		Source:  source,
+		Changes: changes,
+	}))
+	h.Settle()
+}
+
+// Advance moves the fake clock forward, firing the deadlines that are due, and
+// waits until Limestone has settled
+func (h *Harness) Advance(d time.Duration) {
+	h.t.Helper()
+
+	h.clock.Advance(d)
+	h.Settle()
+}
+
+// Settle waits until Limestone has handled all the transactions in the
+// transaction log, including those submitted by WakeUp, and has no pending
+// WakeUp calls. Fails the test on timeout.
+func (h *Harness) Settle() {
+	h.t.Helper()
+
+	ctx, cancel := context.WithTimeout(h.group.Context(), Timeout)
+	defer cancel()
+
+	n, err := h.kafka.LastOffset(ctx, topic)
+	require.NoError(h.t, err)
+	for {
+		for {
+			delivered, atHotEnd, progress := h.state()
+			if int64(delivered) >= n && atHotEnd {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				require.FailNow(h.t, "timed out waiting for Limestone to read the transaction log",
+					"%d of %d transactions delivered", delivered, n)
+			case <-progress:
+			}
+		}
+		require.NoError(h.t, h.db.WaitIdle(ctx), "timed out waiting for Limestone to settle")
+
+		last, err := h.kafka.LastOffset(ctx, topic)
+		require.NoError(h.t, err)
+		if last == n {
+			return
+		}
+		n = last // WakeUp has submitted more
+	}
+}
+
+// TakeSubmitted returns the transactions submitted by the Limestone instance
+// under test since the previous call, in order of submission
+func (h *Harness) TakeSubmitted() []wire.Transaction {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := h.submitted
+	h.submitted = nil
+	return res
+}
+
+func (h *Harness) state() (int, bool, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.delivered, h.atHotEnd, h.progress
+}
+
+func (h *Harness) deliver(txn *wire.IncomingTransaction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if txn != nil {
+		h.delivered++
+	}
+	h.atHotEnd = txn == nil
+	close(h.progress)
+	h.progress = make(chan struct{})
+}
+
+func (h *Harness) submit(txn wire.Transaction) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.submitted = append(h.submitted, txn)
+}
+
+// recordingClient keeps track of the transactions delivered to the DB and
+// submitted by it
+type recordingClient struct {
+	client.Client
+	h *Harness
+}
+
+func (rc recordingClient) Connect(version int, pos wire.Position, filter wire.Filter, compact bool) client.Connection {
+	return recordingConnection{Connection: rc.Client.Connect(version, pos, filter, compact), h: rc.h}
+}
+
+type recordingConnection struct {
+	client.Connection
+	h *Harness
+}
+
+func (rc recordingConnection) Submit(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
+	pos, err := rc.Connection.Submit(ctx, txn)
+	if err != nil {
+		return wire.Beginning, err
+	}
+	rc.h.submit(txn)
+	return pos, nil
+}
+
+func (rc recordingConnection) Run(ctx context.Context, sink chan<- *wire.IncomingTransaction) error {
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		ch := make(chan *wire.IncomingTransaction)
+		spawn("connection", parallel.Fail, func(ctx context.Context) error {
+			return rc.Connection.Run(ctx, ch)
+		})
+		spawn("recorder", parallel.Fail, func(ctx context.Context) error {
+			for {
+				var txn *wire.IncomingTransaction
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case txn = <-ch:
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case sink <- txn:
+				}
+				rc.h.deliver(txn)
+			}
+		})
+		return nil
+	})
+}
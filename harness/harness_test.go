@@ -0,0 +1,84 @@
+package harness
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone"
+	"github.com/ridge/limestone/wire"
+	"github.com/stretchr/testify/require"
+)
+
+type jobID string
+
+type jobUI struct {
+	limestone.Meta `limestone:"name=job,producer=ui"`
+	ID             jobID `limestone:"identity"`
+	Name           string
+}
+
+type jobService struct {
+	limestone.Meta `limestone:"name=job,producer=service"`
+	State          string
+	Expires        time.Time
+}
+
+type job struct {
+	jobUI
+	jobService
+}
+
+func (j job) Deadline() time.Time {
+	if j.State != "running" {
+		return limestone.NoDeadline
+	}
+	return j.Expires
+}
+
+var kindJob = limestone.KindOf(job{})
+
+func wakeUp(ctx context.Context, txn limestone.Transaction, entities []any) {
+	for _, e := range entities {
+		j := e.(job)
+		switch {
+		case j.State == "":
+			j.State = "running"
+			j.Expires = txn.Time().Add(time.Minute)
+		case j.State == "running" && !txn.Time().Before(j.Expires):
+			j.State = "expired"
+		default:
+			continue
+		}
+		txn.Set(j)
+	}
+}
+
+func TestHarness(t *testing.T) {
+	h := New(t, limestone.Config{
+		Entities: limestone.KindList{kindJob},
+		Source:   limestone.Source{Producer: "service"},
+		WakeUp:   wakeUp,
+	})
+	require.Empty(t, h.TakeSubmitted())
+
+	h.Inject(limestone.Source{Producer: "ui"}, job{jobUI: jobUI{ID: "j1", Name: "first"}})
+
+	submitted := h.TakeSubmitted()
+	require.Len(t, submitted, 1)
+	require.Equal(t, limestone.Source{Producer: "service"}, submitted[0].Source)
+	require.Equal(t, wire.Diff{
+		"State":   []byte(`"running"`),
+		"Expires": []byte(`"2020-01-01T00:01:00Z"`),
+	}, submitted[0].Changes["job"]["j1"])
+
+	h.Advance(30 * time.Second)
+	require.Empty(t, h.TakeSubmitted())
+
+	h.Advance(30 * time.Second)
+	require.Len(t, h.TakeSubmitted(), 1)
+	var j job
+	limestone.MustGet(h.DB().Snapshot(), jobID("j1"), &j)
+	require.Equal(t, "expired", j.State)
+	require.Equal(t, Epoch.Add(time.Minute), h.Clock().Now())
+}
@@ -43,6 +43,14 @@ func (ii identityIndexer) FromArgs(args ...any) ([]byte, error) {
 	return []byte(v.String() + "\x00"), nil
 }
 
+func (ii identityIndexer) PrefixFromArgs(args ...any) ([]byte, error) {
+	v := reflect.ValueOf(args[0])
+	if v.Kind() != reflect.String {
+		return nil, errors.New("primary key index expects a string")
+	}
+	return []byte(v.String()), nil
+}
+
 func (ii identityIndexer) FromObject(obj any) (bool, []byte, error) {
 	v := reflect.ValueOf(obj).FieldByIndex(ii.index)
 	return true, []byte(v.String() + "\x00"), nil
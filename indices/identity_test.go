@@ -32,6 +32,10 @@ func TestIdentityIndex(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte{0x21, 0x00}, b)
 
+	b, err = schema.Indexer.(memdb.PrefixIndexer).PrefixFromArgs(FooID("!"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x21}, b)
+
 	single := schema.Indexer.(memdb.SingleIndexer)
 	testSingleFromObjectValuesFound(t, single, Foo{ID: "!"}, []byte{0x21, 0x00})
 }
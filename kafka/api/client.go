@@ -29,11 +29,12 @@ type Client interface {
 	Read(ctx context.Context, topic string, offset int64, dest chan<- *IncomingMessage) error
 
 	// Write writes a batch of messages to a Kafka topic. All messages must be
-	// destined for the specified topic.
+	// destined for the specified topic. Returns the offset of the first
+	// message, the rest follow it in order (0 if there are no messages).
 	//
 	// Either all messages are posted or none. Keeps retrying on temporary
 	// errors, returns permanent ones.
-	Write(ctx context.Context, topic string, messages []Message) error
+	Write(ctx context.Context, topic string, messages []Message) (int64, error)
 }
 
 // ClientBackdate is an extended interface implemented by some Kafka clients
@@ -18,10 +18,11 @@ func TestTopicIsEmpty(t *testing.T) {
 	require.NoError(t, err)
 	require.True(t, empty)
 
-	require.NoError(t, k.Write(ctx, "foo", []api.Message{{
+	_, err = k.Write(ctx, "foo", []api.Message{{
 		Topic: "foo",
 		Value: []byte("FOO"),
-	}}))
+	}})
+	require.NoError(t, err)
 
 	empty, err = TopicIsEmpty(ctx, k, "foo")
 	require.NoError(t, err)
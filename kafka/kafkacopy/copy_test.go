@@ -2,6 +2,8 @@ package kafkacopy
 
 import (
 	"context"
+	"fmt"
+	"regexp"
 	"testing"
 
 	"github.com/ridge/limestone/kafka/api"
@@ -121,3 +123,167 @@ func testReadTopic(ctx context.Context, client api.Client, topic string) ([]api.
 	})
 	return res, err
 }
+
+func TestCopyFilters(t *testing.T) {
+	ctx := test.Context(t)
+
+	source := mock.New()
+	dest := mock.New()
+
+	require.NoError(t, source.WriteBackdated(ctx, "foo", []api.IncomingMessage{
+		{Message: api.Message{Topic: "foo", Value: []byte("FOO-0")}, Time: testTime},
+		{Message: api.Message{Topic: "foo", Value: []byte("FOO-1")}, Time: testTime.Add(time.Hour)},
+		{Message: api.Message{Topic: "foo", Value: []byte("FOO-2")}, Time: testTime.Add(2 * time.Hour)},
+	}))
+	require.NoError(t, source.WriteBackdated(ctx, "bar", []api.IncomingMessage{
+		{Message: api.Message{Topic: "bar", Value: []byte("BAR")}, Time: testTime},
+	}))
+
+	require.NoError(t, Run(ctx, Config{
+		From:       source,
+		To:         dest,
+		Rename:     "%s",
+		TopicRegex: regexp.MustCompile(`^f`),
+		Since:      testTime.Add(30 * time.Minute),
+		Until:      testTime.Add(90 * time.Minute),
+	}))
+
+	topics, err := dest.Topics(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo"}, topics)
+
+	messages, err := testReadTopic(ctx, dest, "foo")
+	require.NoError(t, err)
+	require.Equal(t, []api.IncomingMessage{
+		{Message: api.Message{Topic: "foo"}, Time: testTime.Add(time.Hour), Offset: 0},
+		{Message: api.Message{Topic: "foo", Value: []byte("FOO-1")}, Time: testTime.Add(time.Hour), Offset: 1},
+	}, messages)
+}
+
+func TestFollow(t *testing.T) {
+	ctx := test.Context(t)
+
+	source := mock.New()
+	dest := mock.New()
+	config := Config{
+		From:               source,
+		To:                 dest,
+		Rename:             "%s",
+		Follow:             true,
+		CheckpointInterval: 10 * time.Millisecond,
+		ScanInterval:       10 * time.Millisecond,
+	}
+	write := func(topic string, offset int) {
+		require.NoError(t, source.WriteBackdated(ctx, topic, []api.IncomingMessage{{
+			Message: api.Message{Topic: topic, Value: []byte(fmt.Sprintf("%s-%d", topic, offset))},
+			Time:    testTime.Add(time.Duration(offset) * time.Second),
+		}}))
+	}
+	start := func() *parallel.Group {
+		group := parallel.NewGroup(ctx)
+		group.Spawn("copy", parallel.Fail, func(ctx context.Context) error {
+			return Run(ctx, config)
+		})
+		return group
+	}
+	stop := func(group *parallel.Group) {
+		group.Exit(nil)
+		require.NoError(t, group.Wait())
+	}
+
+	write("foo", 0)
+	write("foo", 1)
+	group := start()
+	testWaitTopic(ctx, t, dest, "foo", 2)
+	write("foo", 2)
+	testWaitTopic(ctx, t, dest, "foo", 3)
+	write("bar", 0)
+	testWaitTopic(ctx, t, dest, "bar", 1)
+	stop(group)
+
+	// Resume after restart
+	write("foo", 3)
+	group = start()
+	testWaitTopic(ctx, t, dest, "foo", 4)
+	require.Eventually(t, func() bool {
+		checkpoints, err := readCheckpoints(ctx, dest, DefaultCheckpointTopic)
+		require.NoError(t, err)
+		return checkpoints["foo"] == 4
+	}, time.Second, 10*time.Millisecond)
+	stop(group)
+
+	for _, topic := range []string{"foo", "bar"} {
+		expected, err := testReadTopic(ctx, source, topic)
+		require.NoError(t, err)
+		actual, err := testReadTopic(ctx, dest, topic)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+
+	checkpoints, err := readCheckpoints(ctx, dest, DefaultCheckpointTopic)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int64{"foo": 4, "bar": 1}, checkpoints)
+}
+
+func TestFollowCheckpoints(t *testing.T) {
+	ctx := test.Context(t)
+
+	source := mock.New()
+	dest := mock.New()
+	config := Config{
+		From:               source,
+		To:                 dest,
+		Rename:             "%s",
+		Since:              testTime.Add(2 * time.Second),
+		Follow:             true,
+		CheckpointInterval: 10 * time.Millisecond,
+		ScanInterval:       10 * time.Millisecond,
+	}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, source.WriteBackdated(ctx, "foo", []api.IncomingMessage{{
+			Message: api.Message{Topic: "foo", Value: []byte(fmt.Sprintf("foo-%d", i))},
+			Time:    testTime.Add(time.Duration(i) * time.Second),
+		}}))
+	}
+
+	group := parallel.NewGroup(ctx)
+	group.Spawn("copy", parallel.Fail, func(ctx context.Context) error {
+		return Run(ctx, config)
+	})
+	// The messages are skipped, so only the checkpoint tells the progress
+	require.Eventually(t, func() bool {
+		checkpoints, err := readCheckpoints(ctx, dest, DefaultCheckpointTopic)
+		require.NoError(t, err)
+		return checkpoints["foo"] == 2
+	}, time.Second, 10*time.Millisecond)
+	group.Exit(nil)
+	require.NoError(t, group.Wait())
+
+	// Nothing has changed since, so no more checkpoints are written
+	last, err := dest.LastOffset(ctx, DefaultCheckpointTopic)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), last)
+}
+
+// testWaitTopic waits until the topic contains n messages
+func testWaitTopic(ctx context.Context, t *testing.T, client api.Client, topic string, n int64) {
+	require.NoError(t, parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		messages := make(chan *api.IncomingMessage)
+		spawn("reader", parallel.Fail, func(ctx context.Context) error {
+			return client.Read(ctx, topic, n-1, messages)
+		})
+		spawn("consumer", parallel.Exit, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg := <-messages:
+					if msg != nil {
+						return nil
+					}
+				}
+			}
+		})
+		return nil
+	}))
+}
@@ -4,7 +4,11 @@ package kafkacopy
 // being added
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/ridge/limestone/kafka"
 	"github.com/ridge/limestone/kafka/api"
@@ -20,25 +24,73 @@ import (
 
 const batchSize = 1000
 
+// DefaultCheckpointTopic is the default name of the topic in the destination
+// where the source offsets are saved in the follow mode
+const DefaultCheckpointTopic = "kafkacopy-checkpoints"
+
+const defaultScanInterval = 30 * time.Second
+
+const defaultCheckpointInterval = 10 * time.Second
+
+// checkpointKey is the key of the messages in the checkpoint topic, so that
+// compaction keeps the last one
+const checkpointKey = "checkpoint"
+
 // Config describes the copy tool configuration
 type Config struct {
 	From, To api.Client
 	Topics   []string
 	Rename   string
+
+	// TopicRegex, if not nil, restricts the topics to copy to the matching
+	// ones
+	TopicRegex *regexp.Regexp
+
+	// Since and Until, if not zero, restrict the messages to copy to the given
+	// time range. The messages before Since are replaced with blank ones to
+	// maintain offset parity. Copying a topic stops at the first message after
+	// Until.
+	Since, Until time.Time
+
+	// Follow enables the follow mode: after reaching the end of the source
+	// topics keep copying the new messages, and copy the new topics as they
+	// appear. The destination topics may be non-empty in the follow mode.
+	//
+	// The source offsets of all the topics are saved to CheckpointTopic in the
+	// destination every CheckpointInterval, and copying resumes from them
+	// after a restart, or from the ends of the destination topics if they are
+	// further. Only the last message of CheckpointTopic is read, so the topic
+	// should be compacted (all the messages have the same key) or at least
+	// keep the last message. Run one copy per checkpoint topic.
+	Follow             bool
+	CheckpointTopic    string        // DefaultCheckpointTopic if empty
+	CheckpointInterval time.Duration // defaultCheckpointInterval if zero
+	ScanInterval       time.Duration // for new topics, defaultScanInterval if zero
 }
 
 // Main handles the command line and runs the copy tool
 func Main(args []string) {
-	var from, to string
+	var from, to, topicRegex, since, until string
 	var cfg Config
 	pflag.StringVar(&from, "from", "", "Source Kafka URI")
 	pflag.StringVar(&to, "to", "", "Destination Kafka URI")
 	pflag.StringArrayVar(&cfg.Topics, "topic", nil, "Topic to copy (can be repeated). Default: copy all topics")
+	pflag.StringVar(&topicRegex, "topic-regex", "", "Copy only the topics matching the regular expression")
 	pflag.StringVar(&cfg.Rename, "rename", "%s", "The format string to transform the topic names")
+	pflag.StringVar(&since, "since", "", "Copy only the messages since the given time (RFC 3339)")
+	pflag.StringVar(&until, "until", "", "Copy only the messages until the given time (RFC 3339)")
+	pflag.BoolVar(&cfg.Follow, "follow", false, "Keep copying new messages and topics, resume from the checkpoints after restart")
+	pflag.StringVar(&cfg.CheckpointTopic, "checkpoint-topic", DefaultCheckpointTopic, "The topic in the destination to save the source offsets to in the follow mode (should be compacted)")
+	pflag.DurationVar(&cfg.CheckpointInterval, "checkpoint-interval", defaultCheckpointInterval, "How often to save the source offsets in the follow mode")
 	_ = pflag.CommandLine.Parse(args[1:])
 
 	cfg.From = kafkaClientFromURI("from", from)
 	cfg.To = kafkaClientFromURI("to", to)
+	if topicRegex != "" {
+		cfg.TopicRegex = regexp.MustCompile(topicRegex)
+	}
+	cfg.Since = parseTime("since", since)
+	cfg.Until = parseTime("until", until)
 
 	run.Tool(func(ctx context.Context) error {
 		return Run(ctx, cfg)
@@ -52,16 +104,36 @@ func kafkaClientFromURI(label string, kafkaURI string) api.Client {
 	return must.OK1(kafka.FromURI(kafkaURI))
 }
 
+func parseTime(label string, s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		panic(fmt.Errorf("invalid --%s: %w", label, err))
+	}
+	return t
+}
+
 // Run copies data from one Kafka instance to another
 func Run(ctx context.Context, config Config) error {
+	if config.CheckpointTopic == "" {
+		config.CheckpointTopic = DefaultCheckpointTopic
+	}
+	if config.ScanInterval == 0 {
+		config.ScanInterval = defaultScanInterval
+	}
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = defaultCheckpointInterval
+	}
+	if config.Follow {
+		return follow(ctx, config)
+	}
+
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
-		topics := config.Topics
-		if len(topics) == 0 {
-			var err error
-			topics, err = config.From.Topics(ctx)
-			if err != nil {
-				return err
-			}
+		topics, err := selectTopics(ctx, config)
+		if err != nil {
+			return err
 		}
 		tlog.Get(ctx).Info("Preparing to copy topics", zap.Strings("topics", topics))
 		for _, topic := range topics {
@@ -80,20 +152,195 @@ func Run(ctx context.Context, config Config) error {
 		for _, topic := range topics {
 			topic := topic
 			spawn(topic, parallel.Continue, func(ctx context.Context) error {
-				return copyTopic(ctx, config.From, topic, config.To, fmt.Sprintf(config.Rename, topic))
+				return copyTopic(ctx, config, topic, fmt.Sprintf(config.Rename, topic), 0, 0, nil)
 			})
 		}
 		return nil
 	})
 }
 
-func copyTopic(ctx context.Context, client1 api.Client, topic1 string, client2 api.Client, topic2 string) error {
+// selectTopics returns the source topics to copy
+func selectTopics(ctx context.Context, config Config) ([]string, error) {
+	topics := config.Topics
+	if len(topics) == 0 {
+		var err error
+		topics, err = config.From.Topics(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.TopicRegex == nil {
+		return topics, nil
+	}
+	var res []string
+	for _, topic := range topics {
+		if config.TopicRegex.MatchString(topic) {
+			res = append(res, topic)
+		}
+	}
+	return res, nil
+}
+
+// checkpoint is a message in the checkpoint topic
+type checkpoint struct {
+	Offsets map[string]int64 // next offset to copy by source topic
+}
+
+// follow copies the topics continuously, see Config.Follow
+func follow(ctx context.Context, config Config) error {
+	if err := names.ValidateTopicName(config.CheckpointTopic); err != nil {
+		return err
+	}
+	checkpoints, err := readCheckpoints(ctx, config.To, config.CheckpointTopic)
+	if err != nil {
+		return err
+	}
+	var mu sync.Mutex // protects checkpoints and dirty
+	dirty := false    // checkpoints have changed since saved
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("checkpointer", parallel.Fail, func(ctx context.Context) error {
+			ticker := time.NewTicker(config.CheckpointInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-ticker.C:
+				}
+				var value []byte
+				mu.Lock()
+				if dirty {
+					value = must.OK1(json.Marshal(checkpoint{Offsets: checkpoints}))
+					dirty = false
+				}
+				mu.Unlock()
+				if value == nil {
+					continue
+				}
+				if _, err := config.To.Write(ctx, config.CheckpointTopic, []api.Message{{
+					Topic: config.CheckpointTopic,
+					Key:   checkpointKey,
+					Value: value,
+				}}); err != nil {
+					return fmt.Errorf("failed to save checkpoint: %w", err)
+				}
+			}
+		})
+		spawn("scanner", parallel.Fail, func(ctx context.Context) error {
+			logger := tlog.Get(ctx)
+			copying := map[string]bool{}
+			for {
+				topics, err := selectTopics(ctx, config)
+				if err != nil {
+					return err
+				}
+				for _, topic := range topics {
+					name := fmt.Sprintf(config.Rename, topic)
+					if copying[topic] || name == config.CheckpointTopic {
+						continue
+					}
+					copying[topic] = true
+
+					if err := names.ValidateTopicName(name); err != nil {
+						return err
+					}
+					// Offset parity is maintained, so the destination topic
+					// can't be behind the data copied. The checkpoint can be
+					// ahead of it if the messages at the end were skipped.
+					dest, err := config.To.LastOffset(ctx, name)
+					if err != nil {
+						return err
+					}
+					offset := dest
+					mu.Lock()
+					switch {
+					case checkpoints[topic] > offset:
+						offset = checkpoints[topic]
+					case checkpoints[topic] < offset:
+						checkpoints[topic] = offset
+						dirty = true
+					}
+					mu.Unlock()
+					logger.Info("Following topic", zap.String("topic", topic), zap.Int64("offset", offset))
+
+					topic := topic
+					spawn(topic, parallel.Continue, func(ctx context.Context) error {
+						return copyTopic(ctx, config, topic, name, dest, offset, func(next int64) {
+							mu.Lock()
+							defer mu.Unlock()
+							checkpoints[topic] = next
+							dirty = true
+						})
+					})
+				}
+
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(config.ScanInterval):
+				}
+			}
+		})
+		return nil
+	})
+}
+
+// readCheckpoints returns the checkpoints for the source topics from the last
+// message of the checkpoint topic
+func readCheckpoints(ctx context.Context, client api.Client, topic string) (map[string]int64, error) {
+	res := map[string]int64{}
+	last, err := client.LastOffset(ctx, topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoints from %s: %w", topic, err)
+	}
+	if last == 0 {
+		return res, nil
+	}
+	err = parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		messages := make(chan *api.IncomingMessage)
+		spawn("reader", parallel.Fail, func(ctx context.Context) error {
+			return client.Read(ctx, topic, last-1, messages)
+		})
+		spawn("consumer", parallel.Exit, func(ctx context.Context) error {
+			var msg *api.IncomingMessage
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case msg = <-messages:
+			}
+			if msg == nil { // deleted by retention
+				return nil
+			}
+			var cp checkpoint
+			if err := json.Unmarshal(msg.Value, &cp); err != nil {
+				return fmt.Errorf("failed to parse checkpoint %q: %w", msg.Value, err)
+			}
+			if cp.Offsets != nil {
+				res = cp.Offsets
+			}
+			return nil
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoints from %s: %w", topic, err)
+	}
+	return res, nil
+}
+
+// copyTopic copies topic1 starting from the given offset to topic2 containing
+// dest messages. In the follow mode, reports the next source offset to
+// checkpoint after writing each batch and at the end of the source topic if
+// anything has been read.
+func copyTopic(ctx context.Context, config Config, topic1, topic2 string, dest, offset int64, checkpoint func(next int64)) error {
+	client1, client2 := config.From, config.To
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		logger := tlog.Get(ctx).With(zap.String("fromTopic", topic1), zap.String("toTopic", topic2))
 		logger.Info("Started copying")
 		messages := make(chan *api.IncomingMessage, batchSize)
 		spawn("reader", parallel.Fail, func(ctx context.Context) error {
-			return client1.Read(ctx, topic1, 0, messages)
+			return client1.Read(ctx, topic1, offset, messages)
 		})
 		spawn("writer", parallel.Exit, func(ctx context.Context) error {
 			write := func(ctx context.Context, topic string, messages []api.IncomingMessage) error {
@@ -101,31 +348,61 @@ func copyTopic(ctx context.Context, client1 api.Client, topic1 string, client2 a
 				for _, m := range messages {
 					batch = append(batch, m.Message)
 				}
-				return client2.Write(ctx, topic, batch)
+				_, err := client2.Write(ctx, topic, batch)
+				return err
 			}
 			if client2backdated, ok := client2.(api.ClientBackdate); ok {
 				write = client2backdated.WriteBackdated
 			}
-			var n int64
+			n := dest      // next offset in the destination topic
+			next := offset // next offset in the source topic
+			checkpointed := offset
 			batch := make([]api.IncomingMessage, 0, batchSize)
+			flush := func(ctx context.Context) error {
+				if len(batch) != 0 {
+					if err := write(ctx, topic2, batch); err != nil {
+						return fmt.Errorf("failed to copy topic %s to %s: %w", topic1, topic2, err)
+					}
+					batch = batch[:0] // truncate while keeping the underlying capacity
+				}
+				if checkpoint != nil && next != checkpointed {
+					checkpoint(next)
+					checkpointed = next
+				}
+				return nil
+			}
 			for {
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
 				case msg := <-messages:
 					// batch size reached or hot end encountered
-					if len(batch) >= batchSize || msg == nil && len(batch) != 0 {
-						if err := write(ctx, topic2, batch); err != nil {
-							return fmt.Errorf("failed to copy topic %s to %s: %w", topic1, topic2, err)
+					if len(batch) >= batchSize || msg == nil {
+						if err := flush(ctx); err != nil {
+							return err
 						}
-						batch = batch[:0] // truncate while keeping the underlying capacity
 					}
 
 					if msg == nil {
-						logger.Info("Finished copying", zap.Int64("messagesCopied", n))
+						if checkpoint != nil {
+							continue // follow mode
+						}
+						logger.Info("Finished copying", zap.Int64("messagesCopied", n-dest))
 						return nil
 					}
 
+					if !config.Until.IsZero() && msg.Time.After(config.Until) {
+						if err := flush(ctx); err != nil {
+							return err
+						}
+						logger.Info("Finished copying: reached the end of the time range", zap.Int64("messagesCopied", n-dest))
+						return nil
+					}
+					next = msg.Offset + 1
+					if !config.Since.IsZero() && msg.Time.Before(config.Since) {
+						continue // replaced with padding
+					}
+
 					// pad with blank messages to maintain offset parity
 					for n < msg.Offset {
 						batch = append(batch, api.IncomingMessage{
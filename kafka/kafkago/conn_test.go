@@ -20,9 +20,9 @@ func (m *mockConn) SetDeadline(deadline time.Time) error {
 	return args.Error(0)
 }
 
-func (m *mockConn) WriteMessages(batch ...kafka.Message) (int, error) {
+func (m *mockConn) WriteCompressedMessagesAt(codec kafka.CompressionCodec, batch ...kafka.Message) (int, int32, int64, time.Time, error) {
 	args := m.Called(batch)
-	return args.Int(0), args.Error(1)
+	return 0, 0, args.Get(0).(int64), time.Time{}, args.Error(1)
 }
 
 func (m *mockConn) ReadPartitions(topics ...string) ([]kafka.Partition, error) {
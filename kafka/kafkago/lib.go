@@ -27,7 +27,7 @@ type kafkaReader interface {
 type kafkaConn interface {
 	Close() error
 	SetDeadline(t time.Time) error
-	WriteMessages(batch ...kafka.Message) (int, error)
+	WriteCompressedMessagesAt(codec kafka.CompressionCodec, batch ...kafka.Message) (nbytes int, partition int32, offset int64, appendTime time.Time, err error)
 	ReadPartitions(topics ...string) ([]kafka.Partition, error)
 	ReadLastOffset() (int64, error)
 }
@@ -3,6 +3,7 @@ package kafkago
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/ridge/limestone/kafka/api"
 	"github.com/ridge/limestone/retry"
@@ -10,16 +11,15 @@ import (
 	"github.com/ridge/must/v2"
 	"github.com/segmentio/kafka-go"
 	"go.uber.org/zap"
-	"time"
 )
 
 const writerTimeout = time.Minute
 
 var writerRetry = retry.FixedConfig{RetryAfter: time.Second}
 
-func (c *client) Write(ctx context.Context, topic string, messages []api.Message) error {
+func (c *client) Write(ctx context.Context, topic string, messages []api.Message) (int64, error) {
 	if len(messages) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	ctx = tlog.With(ctx, zap.String("topic", topic))
@@ -39,18 +39,20 @@ func (c *client) Write(ctx context.Context, topic string, messages []api.Message
 		})
 	}
 
-	return retry.Do(ctx, writerRetry, func() error {
-		if _, err := c.writeBatch(ctx, topic, batch); err != nil {
+	return retry.Do1(ctx, writerRetry, func() (int64, error) {
+		offset, err := c.writeBatch(ctx, topic, batch)
+		if err != nil {
 			if shouldRetry(err) {
-				return retry.Retriable(fmt.Errorf("failed to write Kafka messages: %w", err))
+				return 0, retry.Retriable(fmt.Errorf("failed to write Kafka messages: %w", err))
 			}
-			return err
+			return 0, err
 		}
-		return nil
+		return offset, nil
 	})
 }
 
-func (c *client) writeBatch(ctx context.Context, topic string, batch []kafka.Message) (int, error) {
+// writeBatch returns the offset of the first message
+func (c *client) writeBatch(ctx context.Context, topic string, batch []kafka.Message) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, writerTimeout)
 	defer cancel()
 
@@ -62,10 +64,10 @@ func (c *client) writeBatch(ctx context.Context, topic string, batch []kafka.Mes
 	deadline, _ := ctx.Deadline()       // ok is definitely true because of context.WithTimeout
 	must.OK(conn.SetDeadline(deadline)) // kafka-go always returns nil from conn.SetDeadline
 
-	nbytes, err := conn.WriteMessages(batch...)
+	_, _, offset, _, err := conn.WriteCompressedMessagesAt(nil, batch...)
 	if err != nil {
 		c.invalidateKafkaConn(topic, conn)
 		_ = conn.Close()
 	}
-	return nbytes, err
+	return offset, err
 }
@@ -37,7 +37,8 @@ func TestFatalError(t *testing.T) {
 		Value: []byte("test-message-value"),
 	}
 
-	require.Error(t, c.Write(ctx, "test-topic-nonexistent", []api.Message{msg}))
+	_, err := c.Write(ctx, "test-topic-nonexistent", []api.Message{msg})
+	require.Error(t, err)
 
 	mockAPI.conn.AssertExpectations(t)
 }
@@ -60,8 +61,10 @@ func TestWriteSingleMessage(t *testing.T) {
 	}
 
 	mockAPI.conn.On("SetDeadline", matchAny()).Return(nil).Once()
-	mockAPI.conn.On("WriteMessages", []kafka.Message{kafkaMsg}).Return(42, nil).Once()
-	require.NoError(t, c.Write(ctx, "test-topic", []api.Message{msg}))
+	mockAPI.conn.On("WriteCompressedMessagesAt", []kafka.Message{kafkaMsg}).Return(int64(42), nil).Once()
+	offset, err := c.Write(ctx, "test-topic", []api.Message{msg})
+	require.NoError(t, err)
+	require.Equal(t, int64(42), offset)
 
 	mockAPI.conn.AssertExpectations(t)
 }
@@ -86,8 +89,10 @@ func TestWriteMultipleMessages(t *testing.T) {
 		}
 
 		mockAPI.conn.On("SetDeadline", matchAny()).Return(nil).Once()
-		mockAPI.conn.On("WriteMessages", []kafka.Message{kafkaMsg}).Return(42, nil).Once()
-		require.NoError(t, c.Write(ctx, "test-topic", []api.Message{msg}))
+		mockAPI.conn.On("WriteCompressedMessagesAt", []kafka.Message{kafkaMsg}).Return(int64(42), nil).Once()
+		offset, err := c.Write(ctx, "test-topic", []api.Message{msg})
+		require.NoError(t, err)
+		require.Equal(t, int64(42), offset)
 	}
 
 	mockAPI.conn.AssertExpectations(t)
@@ -119,8 +124,10 @@ func TestWriteMultipleMessagesInCall(t *testing.T) {
 	}
 
 	mockAPI.conn.On("SetDeadline", matchAny()).Return(nil).Once()
-	mockAPI.conn.On("WriteMessages", kafkaMsgs).Return(42, nil).Once()
-	require.NoError(t, c.Write(ctx, "test-topic", msgs))
+	mockAPI.conn.On("WriteCompressedMessagesAt", kafkaMsgs).Return(int64(42), nil).Once()
+	offset, err := c.Write(ctx, "test-topic", msgs)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), offset)
 
 	mockAPI.conn.AssertExpectations(t)
 }
@@ -153,8 +160,10 @@ func TestMessageWithHeaders(t *testing.T) {
 	}
 
 	mockAPI.conn.On("SetDeadline", matchAny()).Return(nil).Once()
-	mockAPI.conn.On("WriteMessages", []kafka.Message{kafkaMsg}).Return(42, nil).Once()
-	require.NoError(t, c.Write(ctx, "test-topic", []api.Message{msg}))
+	mockAPI.conn.On("WriteCompressedMessagesAt", []kafka.Message{kafkaMsg}).Return(int64(42), nil).Once()
+	offset, err := c.Write(ctx, "test-topic", []api.Message{msg})
+	require.NoError(t, err)
+	require.Equal(t, int64(42), offset)
 
 	mockAPI.conn.AssertExpectations(t)
 }
@@ -181,9 +190,10 @@ func TestMessageSendNotOK(t *testing.T) {
 	defer cancel()
 
 	mockAPI.conn.On("SetDeadline", matchAny()).Return(nil).Once()
-	mockAPI.conn.On("WriteMessages", []kafka.Message{kafkaMsg}).Return(0, errors.New("failed to send kafka message")).Once()
+	mockAPI.conn.On("WriteCompressedMessagesAt", []kafka.Message{kafkaMsg}).Return(int64(0), errors.New("failed to send kafka message")).Once()
 	mockAPI.conn.On("Close").Return(nil).Run(func(args mock.Arguments) { cancel() }).Once()
-	require.Error(t, c.Write(ctx, "test-topic", []api.Message{msg}))
+	_, err := c.Write(ctx, "test-topic", []api.Message{msg})
+	require.Error(t, err)
 
 	mockAPI.conn.AssertExpectations(t)
 }
@@ -21,7 +21,7 @@ func TestChat(t *testing.T) {
 
 	require.Nil(t, <-messagesBar)
 
-	require.NoError(t, env.client.Write(env.group.Context(), "foo", []api.Message{
+	_, err := env.client.Write(env.group.Context(), "foo", []api.Message{
 		{
 			Topic: "foo",
 			Key:   "666",
@@ -32,14 +32,16 @@ func TestChat(t *testing.T) {
 			Key:   "777",
 			Value: []byte("FOO-777"),
 		},
-	}))
-	require.NoError(t, env.client.Write(env.group.Context(), "bar", []api.Message{
+	})
+	require.NoError(t, err)
+	_, err = env.client.Write(env.group.Context(), "bar", []api.Message{
 		{
 			Topic:   "bar",
 			Headers: map[string]string{"a": "b", "c": "d"},
 			Value:   []byte("BAR"),
 		},
-	}))
+	})
+	require.NoError(t, err)
 
 	require.Equal(t, &api.IncomingMessage{
 		Message: api.Message{
@@ -76,12 +78,13 @@ func TestChat(t *testing.T) {
 	}, <-messagesFoo)
 	require.Nil(t, <-messagesFoo)
 
-	require.NoError(t, env.client.Write(env.group.Context(), "bar", []api.Message{
+	_, err = env.client.Write(env.group.Context(), "bar", []api.Message{
 		{
 			Topic: "bar",
 			Value: []byte{},
 		},
-	}))
+	})
+	require.NoError(t, err)
 
 	require.Equal(t, &api.IncomingMessage{
 		Message: api.Message{
@@ -20,7 +20,8 @@ import (
 )
 
 type client struct {
-	dir string
+	dir  string
+	ends *topicEnds
 }
 
 // New creates a new Kafka instance based on the given directory name. The
@@ -30,7 +31,7 @@ func New(dir string) (api.ClientBackdate, error) {
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return nil, fmt.Errorf("failed to create local Kafka: %w", err)
 	}
-	return client{dir: dir}, nil
+	return client{dir: dir, ends: &topicEnds{byTopic: map[string]topicEnd{}}}, nil
 }
 
 func (c client) Topics(ctx context.Context) ([]string, error) {
@@ -1,22 +1,26 @@
 package local
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/ridge/limestone/kafka/api"
 	"github.com/ridge/limestone/kafka/names"
 	"github.com/ridge/limestone/kafka/wire"
 	"github.com/ridge/must/v2"
-	"time"
 )
 
-func (c client) Write(ctx context.Context, topic string, messages []api.Message) error {
+func (c client) Write(ctx context.Context, topic string, messages []api.Message) (int64, error) {
 	ts := time.Now()
 	batch := make([]api.IncomingMessage, 0, len(messages))
 	for _, m := range messages {
@@ -25,27 +29,43 @@ func (c client) Write(ctx context.Context, topic string, messages []api.Message)
 			Time:    ts,
 		})
 	}
-	return c.WriteBackdated(ctx, topic, batch)
+	return c.write(topic, batch)
 }
 
 func (c client) WriteBackdated(ctx context.Context, topic string, messages []api.IncomingMessage) error {
+	_, err := c.write(topic, messages)
+	return err
+}
+
+// write returns the offset of the first message
+func (c client) write(topic string, messages []api.IncomingMessage) (int64, error) {
 	must.OK(names.ValidateTopicName(topic))
 	if len(messages) == 0 {
-		return nil
+		return 0, nil
 	}
 
-	f, err := os.OpenFile(filepath.Join(c.dir, topic), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	path := filepath.Join(c.dir, topic)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
-		return fmt.Errorf("failed to append topic %s: %w", topic, err)
+		return 0, fmt.Errorf("failed to append topic %s: %w", topic, err)
 	}
 	defer must.Do(f.Close)
 	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
-		return fmt.Errorf("failed to append topic %s: %w", topic, err)
+		return 0, fmt.Errorf("failed to append topic %s: %w", topic, err)
 	}
 	defer must.Do(func() error {
 		return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
 	})
 
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("failed to append topic %s: %w", topic, err)
+	}
+	offset, err := c.ends.next(topic, path, fi)
+	if err != nil {
+		return 0, fmt.Errorf("failed to append topic %s: %w", topic, err)
+	}
+
 	// prepare a single write to minimize the likelihood of leaving the file corrupted
 	var buf bytes.Buffer
 
@@ -65,11 +85,68 @@ func (c client) WriteBackdated(ctx context.Context, topic string, messages []api
 	}
 
 	if _, err := f.Write(buf.Bytes()); err != nil {
-		return fmt.Errorf("failed to append topic %s: %w", topic, err)
+		return 0, fmt.Errorf("failed to append topic %s: %w", topic, err)
 	}
 	if err := f.Sync(); err != nil {
-		return fmt.Errorf("failed to append topic %s: %w", topic, err)
+		return 0, fmt.Errorf("failed to append topic %s: %w", topic, err)
+	}
+	c.ends.set(topic, topicEnd{file: fi, size: fi.Size() + int64(buf.Len()), next: offset + int64(len(messages))})
+
+	return offset, nil
+}
+
+// topicEnds remembers where each topic file written by this client ended, so
+// that only the messages appended since by others have to be read to find the
+// next offset
+type topicEnds struct {
+	mu      sync.Mutex
+	byTopic map[string]topicEnd
+}
+
+type topicEnd struct {
+	file os.FileInfo
+	size int64
+	next int64 // offset of the message at size
+}
+
+func (te *topicEnds) set(topic string, end topicEnd) {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	te.byTopic[topic] = end
+}
+
+// next returns the offset of the message to be appended to the topic file. To
+// be called with the file locked.
+func (te *topicEnds) next(topic, path string, fi os.FileInfo) (int64, error) {
+	te.mu.Lock()
+	end, ok := te.byTopic[topic]
+	te.mu.Unlock()
+	if !ok || !os.SameFile(end.file, fi) || end.size > fi.Size() {
+		end = topicEnd{} // unknown or replaced file: read it from the start
+	}
+	if end.size == fi.Size() {
+		return end.next, nil
 	}
 
-	return nil
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(end.size, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(f)
+	next := end.next
+	for {
+		msg, _, err := readMessage(topic, r, next)
+		switch {
+		case errors.Is(err, io.EOF):
+			return next, nil
+		case err != nil:
+			return 0, err
+		}
+		next = msg.Offset + 1
+	}
 }
@@ -12,7 +12,7 @@ import (
 func TestWrite(t *testing.T) {
 	env := setupTest(t)
 
-	require.NoError(t, env.client.Write(env.group.Context(), "foo", []api.Message{
+	offset, err := env.client.Write(env.group.Context(), "foo", []api.Message{
 		{
 			Topic: "foo",
 			Key:   "666",
@@ -23,14 +23,17 @@ func TestWrite(t *testing.T) {
 			Key:   "777",
 			Value: []byte("FOO-777"),
 		},
-	}))
-	require.NoError(t, env.client.Write(env.group.Context(), "bar", []api.Message{
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(0), offset)
+	_, err = env.client.Write(env.group.Context(), "bar", []api.Message{
 		{
 			Topic:   "bar",
 			Headers: map[string]string{"a": "b", "c": "d"},
 			Value:   []byte("BAR"),
 		},
-	}))
+	})
+	require.NoError(t, err)
 
 	require.Equal(t, lines(
 		`{"TS":"2020-01-01T12:00:00Z","Key":"666","Len":7}`,
@@ -43,12 +46,14 @@ func TestWrite(t *testing.T) {
 		`BAR`,
 	), string(must.OK1(os.ReadFile(env.dir+"/bar"))))
 
-	require.NoError(t, env.client.Write(env.group.Context(), "bar", []api.Message{
+	offset, err = env.client.Write(env.group.Context(), "bar", []api.Message{
 		{
 			Topic: "bar",
 			Value: []byte{},
 		},
-	}))
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), offset)
 	require.Equal(t, lines(
 		`{"TS":"2020-01-01T12:00:00Z","Headers":{"a":"b","c":"d"},"Len":3}`,
 		`BAR`,
@@ -56,3 +61,25 @@ func TestWrite(t *testing.T) {
 		``,
 	), string(must.OK1(os.ReadFile(env.dir+"/bar"))))
 }
+
+func TestWriteOffsetsShared(t *testing.T) {
+	env := setupTest(t)
+	other := must.OK1(New(env.dir))
+
+	write := func(c api.Client, n int) int64 {
+		messages := make([]api.Message, n)
+		for i := range messages {
+			messages[i] = api.Message{Topic: "foo", Value: []byte("FOO")}
+		}
+		return must.OK1(c.Write(env.group.Context(), "foo", messages))
+	}
+
+	require.Equal(t, int64(0), write(env.client, 2))
+	require.Equal(t, int64(2), write(env.client, 1))
+	require.Equal(t, int64(3), write(other, 3))      // reads the whole file
+	require.Equal(t, int64(6), write(env.client, 1)) // reads what the other one appended
+	require.Equal(t, int64(7), write(other, 1))
+
+	require.NoError(t, os.Remove(env.dir+"/foo"))
+	require.Equal(t, int64(0), write(env.client, 1))
+}
@@ -2,9 +2,10 @@ package mock
 
 import (
 	"sync"
+	"time"
 
+	"github.com/ridge/limestone/clock"
 	"github.com/ridge/limestone/kafka/api"
-	"time"
 )
 
 type message struct {
@@ -20,6 +21,7 @@ type topic struct {
 }
 
 type kafka struct {
+	clock  clock.Clock
 	mu     sync.RWMutex
 	topics map[string]*topic
 	more   chan struct{}
@@ -27,7 +29,14 @@ type kafka struct {
 
 // New creates a new in-memory Kafka simulator
 func New() api.ClientBackdate {
+	return NewWithClock(clock.Real)
+}
+
+// NewWithClock creates a new in-memory Kafka simulator timestamping written
+// messages with the given clock
+func NewWithClock(c clock.Clock) api.ClientBackdate {
 	return &kafka{
+		clock:  c,
 		topics: map[string]*topic{},
 		more:   make(chan struct{}),
 	}
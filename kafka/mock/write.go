@@ -3,24 +3,24 @@ package mock
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/ridge/limestone/kafka/api"
 	"github.com/ridge/limestone/kafka/names"
 	"github.com/ridge/must/v2"
-	"time"
 )
 
 // Write implements the Write method of the kafka.Client interface (see
 // documentation) by writing to the simulated database.
-func (k *kafka) Write(ctx context.Context, topicName string, messages []api.Message) error {
+func (k *kafka) Write(ctx context.Context, topicName string, messages []api.Message) (int64, error) {
 	if len(messages) == 0 {
-		return nil
+		return 0, nil
 	}
 
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	ts := time.Now()
+	ts := k.clock.Now()
 	batch := make([]api.IncomingMessage, 0, len(messages))
 	for _, m := range messages {
 		batch = append(batch, api.IncomingMessage{
@@ -28,7 +28,7 @@ func (k *kafka) Write(ctx context.Context, topicName string, messages []api.Mess
 			Time:    ts,
 		})
 	}
-	return k.writeImpl(topicName, batch)
+	return k.writeImpl(topicName, batch), nil
 }
 
 // WriteBackdated implements the WriteBackdated method of the
@@ -42,10 +42,12 @@ func (k *kafka) WriteBackdated(ctx context.Context, topicName string, messages [
 	k.mu.Lock()
 	defer k.mu.Unlock()
 
-	return k.writeImpl(topicName, messages)
+	k.writeImpl(topicName, messages)
+	return nil
 }
 
-func (k *kafka) writeImpl(topicName string, messages []api.IncomingMessage) error {
+// writeImpl returns the offset of the first message
+func (k *kafka) writeImpl(topicName string, messages []api.IncomingMessage) int64 {
 	must.OK(names.ValidateTopicName(topicName))
 
 	t := k.topics[topicName]
@@ -60,6 +62,7 @@ func (k *kafka) writeImpl(topicName string, messages []api.IncomingMessage) erro
 	if len(t.data) > 0 {
 		last = t.data[len(t.data)-1].ts
 	}
+	offset := int64(len(t.data))
 
 	for _, m := range messages {
 		if m.Topic != topicName {
@@ -80,5 +83,5 @@ func (k *kafka) writeImpl(topicName string, messages []api.IncomingMessage) erro
 	close(t.more)
 	t.more = make(chan struct{})
 
-	return nil
+	return offset
 }
@@ -28,6 +28,6 @@ func New(httpClient *http.Client, origin string) api.Client {
 	return client{httpClient: httpClient, origin: origin}
 }
 
-func (c client) Write(ctx context.Context, topic string, messages []api.Message) error {
+func (c client) Write(ctx context.Context, topic string, messages []api.Message) (int64, error) {
 	panic("Remote Kafka client does not support writing")
 }
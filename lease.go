@@ -0,0 +1,268 @@
+package limestone
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/typeddb"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"go.uber.org/zap"
+)
+
+// ErrNotLeader is returned by DoE when leader election is enabled and this
+// replica is not the leader
+var ErrNotLeader = errors.New("not the leader")
+
+// Election configures leader election among the replicas of a service.
+//
+// The replicas share a lease stored in the transaction log itself. Each
+// replica identifies itself by its Source (replicas must differ in
+// Source.Instance) and session. A replica may take the lease over once it has
+// expired; the holder renews it every third of Duration. Every replica decides
+// who holds the lease by reading the transaction log: a lease write is only
+// accepted if it is made by the new holder itself (fencing by Source and
+// Session) and the previous lease has expired by the Kafka timestamp of the
+// write, or has been held by the same writer. Therefore all replicas agree on
+// the leader.
+//
+// A replica considers itself the leader only until ClockSkew before its lease
+// expires, so that it stops writing before the other replicas may consider the
+// lease free. Transactions written by a replica of the same producer that did
+// not hold the lease at the time of the write (per its Kafka timestamp) are
+// ignored by all replicas, so a deposed leader that keeps writing cannot
+// corrupt the state. Therefore all replicas writing as the producer must take
+// part in the same election.
+//
+// Only the leader calls WakeUp and accepts Do/DoE; followers keep their
+// snapshots up to date and schedule deadlines, but do not act on them. When a
+// replica becomes the leader, WakeUp is called for all entities, as on
+// startup.
+type Election struct {
+	// Name identifies the lease. Replicas using the same name elect one
+	// leader. Defaults to the producer name.
+	Name string
+
+	// Duration is the time the lease is valid for after it has been
+	// acquired or renewed. If the leader dies, failover happens within
+	// Duration.
+	Duration time.Duration
+
+	// ClockSkew is the maximum expected difference between the clocks of the
+	// replicas and Kafka. Defaults to a tenth of Duration; must be less than
+	// half of it.
+	ClockSkew time.Duration
+}
+
+// leaseKind is the DB name of lease entities. Leases are processed by
+// Limestone itself and never appear in snapshots.
+const leaseKind = "limestone_lease"
+
+type lease struct {
+	Holder  Source
+	Session int64
+	Expires time.Time
+}
+
+func (l lease) heldBy(source Source, session int64) bool {
+	return l.Holder == source && l.Session == session
+}
+
+// leaseTable keeps track of the leases relevant to this replica: the election
+// lease or the membership leases of the shard group
+type leaseTable struct {
+	own      string               // ID of the lease this replica renews
+	duration time.Duration        // of the own lease
+	margin   time.Duration        // before expiration when a lease is no longer considered held
+	relevant func(id string) bool // whether the lease with the given ID is tracked
+	tick     chan struct{}        // signaled after every renewal attempt
+	mu       sync.Mutex
+	byID     map[string]*lease
+}
+
+func newLeaseTable(own string, duration, margin time.Duration, relevant func(id string) bool) *leaseTable {
+	if duration <= 0 {
+		panic("lease duration must be positive")
+	}
+	return &leaseTable{
+		own:      own,
+		duration: duration,
+		margin:   margin,
+		relevant: relevant,
+		tick:     make(chan struct{}, 1),
+		byID:     map[string]*lease{},
+	}
+}
+
+// IsLeader returns true if leader election is disabled, or if this replica
+// currently holds the lease
+func (db *DB) IsLeader() bool {
+	if db.election == nil {
+		return true
+	}
+	db.leases.mu.Lock()
+	defer db.leases.mu.Unlock()
+	return db.holdsLease(db.leases.byID[db.leases.own])
+}
+
+func (db *DB) holdsLease(l *lease) bool {
+	return l != nil && l.heldBy(*db.source, db.session) && db.clock.Now().Before(l.Expires.Add(-db.leases.margin))
+}
+
+// fenced returns true if the incoming transaction has been written by a
+// replica of this service that did not hold the election lease at the time of
+// the write. Such transactions must be ignored.
+//
+// Transactions written before any lease has been acquired are accepted, as well
+// as lease renewals, which are checked by applyLease.
+func (db *DB) fenced(incoming *wire.IncomingTransaction) bool {
+	if db.election == nil || incoming.Source.Producer != db.source.Producer {
+		return false
+	}
+	if _, ok := incoming.Changes[leaseKind]; ok && len(incoming.Changes) == 1 {
+		return false
+	}
+
+	db.leases.mu.Lock()
+	defer db.leases.mu.Unlock()
+
+	cur := db.leases.byID[db.leases.own]
+	if cur == nil {
+		return false
+	}
+	return !cur.heldBy(incoming.Source, incoming.Session) || incoming.TS != nil && !incoming.TS.Before(cur.Expires)
+}
+
+// applyLeases updates the leases from an incoming transaction (including an
+// echo of our own one)
+func (db *DB) applyLeases(ctx context.Context, incoming *wire.IncomingTransaction) {
+	if db.leases == nil {
+		return
+	}
+	for id, raw := range incoming.Changes[leaseKind] {
+		if db.leases.relevant(id) {
+			db.applyLease(ctx, id, raw, incoming)
+		}
+	}
+}
+
+func (db *DB) applyLease(ctx context.Context, id string, raw wire.Diff, incoming *wire.IncomingTransaction) {
+	var l lease
+	if err := json.Unmarshal(must.OK1(json.Marshal(raw)), &l); err != nil {
+		tlog.Get(ctx).Warn("Ignoring invalid lease", zap.String("lease", id), zap.Object("txn", incoming), zap.Error(err))
+		return
+	}
+	if !l.heldBy(incoming.Source, incoming.Session) {
+		return // only the holder itself may write the lease
+	}
+
+	db.leases.mu.Lock()
+	defer db.leases.mu.Unlock()
+
+	cur := db.leases.byID[id]
+	if cur != nil && !cur.heldBy(l.Holder, l.Session) && incoming.TS != nil && incoming.TS.Before(cur.Expires) {
+		return // the lease has been taken by someone else in the meantime
+	}
+	if cur == nil || !cur.heldBy(l.Holder, l.Session) {
+		tlog.Get(ctx).Info("Lease acquired", zap.String("lease", id), zap.Object("holder", l.Holder),
+			zap.Int64("session", l.Session), zap.Time("expires", l.Expires))
+	}
+	db.leases.byID[id] = &l
+}
+
+// renewLease acquires the own lease if it is free or renews it if it is held
+// by this replica
+func (db *DB) renewLease(ctx context.Context) error {
+	now := db.clock.Now()
+
+	db.leases.mu.Lock()
+	cur := db.leases.byID[db.leases.own]
+	db.leases.mu.Unlock()
+
+	if cur != nil && !cur.heldBy(*db.source, db.session) && now.Before(cur.Expires) {
+		return nil // held by someone else
+	}
+	l := lease{Holder: *db.source, Session: db.session, Expires: now.Add(db.leases.duration)}
+	diff := wire.Diff{
+		"Holder":  must.OK1(json.Marshal(l.Holder)),
+		"Session": must.OK1(json.Marshal(l.Session)),
+		"Expires": must.OK1(json.Marshal(l.Expires)),
+	}
+	_, err := db.connection.Submit(ctx, wire.Transaction{
+		Source:  *db.source,
+		Session: db.session,
+		Seq:     db.seq.Add(1),
+		Changes: wire.Changes{leaseKind: wire.KindChanges{db.leases.own: diff}},
+	})
+	return err
+}
+
+// runLeases keeps acquiring or renewing the own lease
+func (db *DB) runLeases(ctx context.Context) error {
+	if err := db.WaitReady(ctx); err != nil {
+		return err
+	}
+	for {
+		if err := db.renewLease(ctx); err != nil {
+			return err
+		}
+		select {
+		case db.leases.tick <- struct{}{}: // let the processing loop notice expired leases
+		default:
+		}
+
+		tick := make(chan struct{})
+		timer := db.clock.AfterFunc(db.leases.duration/3, func() { close(tick) })
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-tick:
+		}
+	}
+}
+
+// view describes what this replica is responsible for: whether it is the
+// leader, or which shard it owns. When the view changes, WakeUp has to be
+// called for all (owned) entities.
+func (db *DB) view() string {
+	switch {
+	case db.election != nil:
+		if db.IsLeader() {
+			return "leader"
+		}
+		return "follower"
+	case db.sharding != nil:
+		return db.updateAssignment().String()
+	default:
+		return ""
+	}
+}
+
+// allEntities returns the IDs of all entities, to wake up a new leader or
+// shard owner
+func (db *DB) allEntities(s Snapshot) []typeddb.EID {
+	var res []typeddb.EID
+	for _, kind := range db.kinds {
+		iter := s.All(kind)
+		ptr := reflect.New(kind.Type)
+		for iter(ptr.Interface()) {
+			res = append(res, typeddb.EID{Kind: kind, ID: ptr.Elem().FieldByIndex(kind.Identity().Index).String()})
+		}
+	}
+	return res
+}
+
+// leaseTick returns the channel signaled after every lease renewal attempt,
+// or nil if leases are not used
+func (db *DB) leaseTick() <-chan struct{} {
+	if db.leases == nil {
+		return nil
+	}
+	return db.leases.tick
+}
@@ -0,0 +1,166 @@
+package limestone
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/clock"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/stretchr/testify/require"
+)
+
+const leaseDuration = 30 * time.Second
+
+type replica struct {
+	db      *DB
+	cancel  context.CancelFunc
+	mu      sync.Mutex
+	wakeUps int
+}
+
+func (r *replica) woken() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.wakeUps
+}
+
+func TestElection(t *testing.T) {
+	group := test.GroupWithTimeout(t, 10*time.Second)
+	fc := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	k := mock.NewWithClock(fc)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog",
+		foo{fooA: fooA{ID: "f1", A: 1}},
+	))
+
+	replicas := map[string]*replica{}
+	for _, instance := range []string{"1", "2"} {
+		r := &replica{}
+		r.db = New(Config{
+			Client:   client.NewKafkaClient(k),
+			Entities: KindList{kindFoo, kindBar},
+			Source:   Source{Producer: "a", Instance: instance},
+			Logger:   tlog.Get(group.Context()),
+			Session:  1,
+			Clock:    fc,
+			Election: &Election{Duration: leaseDuration},
+			WakeUp: func(ctx context.Context, txn Transaction, entities []any) {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				r.wakeUps++
+			},
+		})
+		ctx, cancel := context.WithCancel(group.Context())
+		r.cancel = cancel
+		go func() {
+			_ = r.db.Run(ctx)
+		}()
+		replicas[instance] = r
+	}
+
+	leader := func() (*replica, *replica) {
+		var leader, follower *replica
+		for {
+			for _, r := range replicas {
+				if r.db.IsLeader() {
+					leader = r
+				} else {
+					follower = r
+				}
+			}
+			if leader != nil && follower != nil {
+				require.NoError(t, leader.db.WaitIdle(group.Context()))
+				require.NoError(t, follower.db.WaitIdle(group.Context()))
+				return leader, follower
+			}
+			leader, follower = nil, nil
+			select {
+			case <-group.Context().Done():
+				require.FailNow(t, "no leader elected")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	for _, r := range replicas {
+		require.NoError(t, r.db.WaitReady(group.Context()))
+	}
+	l, f := leader()
+	require.Equal(t, 1, l.woken())
+	require.Zero(t, f.woken())
+	_, err := f.db.DoE(func(txn Transaction) error { return nil })
+	require.ErrorIs(t, err, ErrNotLeader)
+	require.Panics(t, func() { f.db.Do(func(txn Transaction) {}) })
+	l.db.Do(func(txn Transaction) {
+		txn.Set(foo{fooA: fooA{ID: "f2", A: 2}})
+	})
+
+	// A transaction written by a replica not holding the lease is ignored
+	require.NoError(t, client.PublishKafkaTransaction(group.Context(), k, "txlog", wire.Transaction{
+		Source:  Source{Producer: "a", Instance: "3"},
+		Session: 1,
+		Changes: wire.Changes{"foo": wire.KindChanges{"f3": wire.Diff{"ID": json.RawMessage(`"f3"`)}}},
+	}))
+	pos, err := l.db.DoE(func(txn Transaction) error {
+		txn.Set(foo{fooA: fooA{ID: "f4"}})
+		return nil
+	})
+	require.NoError(t, err)
+	for _, r := range replicas {
+		require.NoError(t, r.db.WaitPosition(group.Context(), pos))
+		require.True(t, r.db.Snapshot().Get(fooID("f4"), new(foo)))
+		require.False(t, r.db.Snapshot().Get(fooID("f3"), new(foo)))
+	}
+
+	// waitFor polls until cond is true
+	waitFor := func(msg string, cond func() bool) {
+		for !cond() {
+			select {
+			case <-group.Context().Done():
+				require.FailNow(t, msg)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	// The leader keeps renewing the lease
+	for i := 0; i < 6; i++ {
+		fc.Advance(leaseDuration / 3)
+		waitFor("lease not renewed", func() bool {
+			for _, r := range replicas {
+				r.db.leases.mu.Lock()
+				expires := r.db.leases.byID[r.db.leases.own].Expires
+				r.db.leases.mu.Unlock()
+				if !expires.Equal(fc.Now().Add(leaseDuration)) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	l2, _ := leader()
+	require.Same(t, l, l2)
+
+	// Failover after the leader dies and its lease expires
+	l.cancel()
+	// The leader steps down a bit before its lease expires, to allow for clock skew
+	require.True(t, l.db.IsLeader())
+	fc.Advance(leaseDuration - leaseDuration/10)
+	require.False(t, l.db.IsLeader())
+	for i := 0; i < 4 && !f.db.IsLeader(); i++ {
+		fc.Advance(leaseDuration / 3)
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor("no failover", f.db.IsLeader)
+	require.NoError(t, f.db.WaitIdle(group.Context()))
+	require.Equal(t, 1, f.woken())
+	f.db.Do(func(txn Transaction) {
+		MustGet(txn, fooID("f2"), new(foo))
+	})
+}
@@ -0,0 +1,30 @@
+package meta
+
+import (
+	"encoding/json"
+	"reflect"
+)
+
+// New returns a new addressable value of the structure type filled with
+// default values.
+//
+// If the type has a Defaults method returning the same type, its result is
+// used as the starting point. Then the fields declared with the default=
+// option are set to their default values.
+func (s Struct) New() reflect.Value {
+	v := reflect.New(s.Type).Elem()
+	if s.defaults {
+		v.Set(reflect.Zero(s.Type).MethodByName("Defaults").Call(nil)[0])
+	}
+	for _, field := range s.Fields {
+		if field.Default == nil {
+			continue
+		}
+		f := v.FieldByIndex(field.Index)
+		f.Set(reflect.Zero(field.Type)) // prevent reuse of maps and structs
+		if err := json.Unmarshal(field.Default, f.Addr().Interface()); err != nil {
+			panicf("invalid default value for field %s of %s: %v", field, s, err) // validated by Survey
+		}
+	}
+	return v
+}
@@ -0,0 +1,92 @@
+package meta
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type withDefaults struct {
+	Meta    `limestone:"name=foo"`
+	ID      string `limestone:"identity"`
+	Count   int    `limestone:"default=3"`
+	Status  string `limestone:"default=new"`
+	Labels  map[string]string
+	Enabled bool
+}
+
+func (withDefaults) Defaults() withDefaults {
+	return withDefaults{Count: 1, Labels: map[string]string{"a": "b"}, Enabled: true}
+}
+
+func TestNew(t *testing.T) {
+	type Foo struct {
+		Meta   `limestone:"name=foo"`
+		ID     string   `limestone:"identity"`
+		Count  int      `limestone:"default=42"`
+		Status string   `limestone:"default=new"`
+		Tags   []string `limestone:"default=[\"a\"]"`
+		Other  int
+	}
+	s := Survey(reflect.TypeOf(Foo{}))
+	require.Equal(t, Foo{Count: 42, Status: "new", Tags: []string{"a"}}, s.New().Interface())
+
+	v := s.New()
+	v.FieldByName("Tags").Index(0).SetString("b")
+	require.Equal(t, Foo{Count: 42, Status: "new", Tags: []string{"a"}}, s.New().Interface())
+}
+
+func TestNewDefaultsMethod(t *testing.T) {
+	s := Survey(reflect.TypeOf(withDefaults{}))
+	require.Equal(t, withDefaults{
+		Count:   3,
+		Status:  "new",
+		Labels:  map[string]string{"a": "b"},
+		Enabled: true,
+	}, s.New().Interface())
+}
+
+func TestSurveyInvalidDefault(t *testing.T) {
+	type Foo struct {
+		Meta  `limestone:"name=foo"`
+		ID    string `limestone:"identity"`
+		Count int    `limestone:"default=many"`
+	}
+	require.PanicsWithValue(t, "invalid default value for meta.Foo.Count: invalid character 'm' looking for beginning of value",
+		func() { Survey(reflect.TypeOf(Foo{})) })
+}
+
+func TestSurveyIdentityDefault(t *testing.T) {
+	type Foo struct {
+		Meta `limestone:"name=foo"`
+		ID   string `limestone:"identity,default=x"`
+	}
+	require.PanicsWithValue(t, "identity field meta.Foo.ID cannot have a default value",
+		func() { Survey(reflect.TypeOf(Foo{})) })
+}
+
+type wrongDefaults struct {
+	Meta `limestone:"name=foo"`
+	ID   string `limestone:"identity"`
+}
+
+func (wrongDefaults) Defaults() withDefaults {
+	return withDefaults{}
+}
+
+type pointerDefaults struct {
+	Meta `limestone:"name=foo"`
+	ID   string `limestone:"identity"`
+}
+
+func (*pointerDefaults) Defaults() pointerDefaults {
+	return pointerDefaults{}
+}
+
+func TestSurveyInvalidDefaultsMethod(t *testing.T) {
+	require.PanicsWithValue(t, "method meta.wrongDefaults.Defaults must have signature func() meta.wrongDefaults",
+		func() { Survey(reflect.TypeOf(wrongDefaults{})) })
+	require.PanicsWithValue(t, "method meta.pointerDefaults.Defaults must have a value receiver",
+		func() { Survey(reflect.TypeOf(pointerDefaults{})) })
+}
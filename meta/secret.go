@@ -0,0 +1,77 @@
+package meta
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	secretsMu sync.RWMutex
+	secrets   = map[string]map[string]bool{} // kind -> DB field name -> true
+)
+
+func registerSecrets(s Struct) {
+	var fields []string
+	for _, field := range s.Fields {
+		if field.Secret {
+			fields = append(fields, field.DBName)
+		}
+	}
+	RegisterSecrets(s.DBName, fields)
+}
+
+// RegisterSecrets declares the fields with the given DB names of the given
+// kind secret, as if a structure declaring them had been surveyed.
+//
+// Used by the Limestone server to learn the secret fields from its clients
+// (see wire.Request.Secrets).
+func RegisterSecrets(kind string, fields []string) {
+	if len(fields) == 0 {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	byName := secrets[kind]
+	if byName == nil {
+		byName = map[string]bool{}
+		secrets[kind] = byName
+	}
+	for _, field := range fields {
+		byName[field] = true
+	}
+}
+
+// Secrets returns the DB names of the secret fields known to this process by
+// kind, or nil if there are none
+func Secrets() map[string][]string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	if len(secrets) == 0 {
+		return nil
+	}
+	res := make(map[string][]string, len(secrets))
+	for kind, byName := range secrets {
+		fields := make([]string, 0, len(byName))
+		for field := range byName {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		res[kind] = fields
+	}
+	return res
+}
+
+// IsSecret returns true if the field with the given DB name has been declared
+// secret in the given kind, either by a structure surveyed by this process or
+// by RegisterSecrets.
+//
+// Used to redact secret values in logs.
+func IsSecret(kind, field string) bool {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+
+	return secrets[kind][field]
+}
@@ -0,0 +1,32 @@
+package meta
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsSecret(t *testing.T) {
+	type Foo struct {
+		Meta     `limestone:"name=secret_test"`
+		ID       string `limestone:"identity"`
+		Login    string
+		Password string `limestone:"secret,name=pwd"`
+		Token    string `limestone:"encrypted"`
+	}
+	Survey(reflect.TypeOf(Foo{}))
+
+	require.False(t, IsSecret("secret_test", "Login"))
+	require.False(t, IsSecret("secret_test", "Password"))
+	require.True(t, IsSecret("secret_test", "pwd"))
+	require.True(t, IsSecret("secret_test", "Token"))
+	require.False(t, IsSecret("", "pwd"))
+	require.False(t, IsSecret("other", "pwd"))
+	require.Equal(t, []string{"Token", "pwd"}, Secrets()["secret_test"])
+
+	RegisterSecrets("secret_test_other", []string{"pwd"})
+	require.True(t, IsSecret("secret_test_other", "pwd"))
+	require.False(t, IsSecret("secret_test_other", "Token"))
+	require.Equal(t, []string{"pwd"}, Secrets()["secret_test_other"])
+}
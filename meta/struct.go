@@ -1,6 +1,7 @@
 package meta
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 )
@@ -21,6 +22,10 @@ type Field struct {
 	Const     bool
 	Required  bool
 	Producers ProducerSet
+	Default   json.RawMessage // nil if no default= option
+	Patch     bool
+	Secret    bool
+	Encrypted bool // implies Secret
 }
 
 // String returns the Go and DB field names
@@ -37,7 +42,8 @@ type Struct struct {
 	DBName   string
 	Type     reflect.Type
 	Fields   []Field
-	identity int // index into Fields
+	identity int  // index into Fields
+	defaults bool // the type has a Defaults method
 }
 
 const noIdentity = -1
@@ -1,6 +1,7 @@
 package meta
 
 import (
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
@@ -29,6 +30,7 @@ func Survey(t reflect.Type) Struct {
 	if s.identity == noIdentity {
 		panicf("missing identity field in struct %v", s)
 	}
+	registerSecrets(s)
 	return s
 }
 
@@ -58,6 +60,15 @@ func surveyInternal(t reflect.Type, includeOld, includeNew bool) Struct {
 	dbNames := map[string]int{} // holds indexes into s.Fields
 	var producer string
 
+	if m, ok := t.MethodByName("Defaults"); ok {
+		if m.Type.NumIn() != 1 || m.Type.NumOut() != 1 || m.Type.Out(0) != t {
+			panicf("method %v.Defaults must have signature func() %v", t, t)
+		}
+		s.defaults = true
+	} else if _, ok := reflect.PointerTo(t).MethodByName("Defaults"); ok {
+		panicf("method %v.Defaults must have a value receiver", t)
+	}
+
 loop:
 	for i := 0; i < n; i++ {
 		f := t.Field(i)
@@ -170,6 +181,18 @@ loop:
 					field.Const = true
 					field.Required = true
 					s.identity = len(s.Fields)
+				case "default=":
+					field.Default = parseDefault(t, field, opt.value)
+				case "patch":
+					if k := f.Type.Kind(); k != reflect.Map && k != reflect.Slice {
+						panicf("patch option for field %v.%s requires a map or slice type", t, field)
+					}
+					field.Patch = true
+				case "secret":
+					field.Secret = true
+				case "encrypted":
+					field.Secret = true
+					field.Encrypted = true
 				default:
 					panicf("invalid option for %v.%s: %s", t, field, opt)
 				}
@@ -177,6 +200,15 @@ loop:
 			if !f.IsExported() {
 				panicf("unexported field %v.%s must be skipped using a `limestone:\"-\"` tag", t, field)
 			}
+			if field.Default != nil && s.identity == len(s.Fields) {
+				panicf("identity field %v.%s cannot have a default value", t, field)
+			}
+			if field.Secret && s.identity == len(s.Fields) {
+				panicf("identity field %v.%s cannot be secret", t, field)
+			}
+			if field.Patch && field.Encrypted {
+				panicf("options patch and encrypted for field %v.%s cannot be combined", t, field)
+			}
 			if field.DBName == "" {
 				field.DBName = field.GoName
 			}
@@ -203,3 +235,20 @@ loop:
 
 	return s
 }
+
+// parseDefault converts the value of a default= option into JSON. For
+// string-based fields, the value is taken literally. For other fields, it must
+// be a valid JSON representation of a value of the field type.
+func parseDefault(t reflect.Type, field Field, value string) json.RawMessage {
+	if field.Type.Kind() == reflect.String {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			panicf("invalid default value for %v.%s: %v", t, field, err)
+		}
+		return raw
+	}
+	if err := json.Unmarshal([]byte(value), reflect.New(field.Type).Interface()); err != nil {
+		panicf("invalid default value for %v.%s: %v", t, field, err)
+	}
+	return json.RawMessage(value)
+}
@@ -357,3 +357,32 @@ func TestSurveyFieldStartsDollar(t *testing.T) {
 	require.PanicsWithValue(t, "meta.Foo.Money: Kafka field name is not allowed to start with $",
 		func() { Survey(reflect.TypeOf(Foo{})) })
 }
+
+func TestSurveyInvalidPatch(t *testing.T) {
+	type Foo struct {
+		Meta  `limestone:"name=foo"`
+		ID    string `limestone:"identity"`
+		Count int    `limestone:"patch"`
+	}
+	require.PanicsWithValue(t, "patch option for field meta.Foo.Count requires a map or slice type",
+		func() { Survey(reflect.TypeOf(Foo{})) })
+}
+
+func TestSurveySecretIdentity(t *testing.T) {
+	type Foo struct {
+		Meta `limestone:"name=foo"`
+		ID   string `limestone:"identity,secret"`
+	}
+	require.PanicsWithValue(t, "identity field meta.Foo.ID cannot be secret",
+		func() { Survey(reflect.TypeOf(Foo{})) })
+}
+
+func TestSurveyEncryptedPatch(t *testing.T) {
+	type Foo struct {
+		Meta `limestone:"name=foo"`
+		ID   string   `limestone:"identity"`
+		Keys []string `limestone:"patch,encrypted"`
+	}
+	require.PanicsWithValue(t, "options patch and encrypted for field meta.Foo.Keys cannot be combined",
+		func() { Survey(reflect.TypeOf(Foo{})) })
+}
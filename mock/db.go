@@ -5,6 +5,7 @@ import (
 
 	"github.com/ridge/limestone"
 	"github.com/ridge/limestone/typeddb"
+	"github.com/ridge/limestone/wire"
 )
 
 // DBReadOnly is a read-only typeddb to be use in unittests
@@ -52,19 +53,20 @@ func (pDB *DBReadWrite) Snapshot() limestone.Snapshot {
 
 // Do executes the function on the transaction and saves the changes
 func (pDB *DBReadWrite) Do(fn func(txn limestone.Transaction)) {
-	_ = pDB.DoE(func(txn limestone.Transaction) error {
+	_, _ = pDB.DoE(func(txn limestone.Transaction) error {
 		fn(txn)
 		return nil
 	})
 }
 
-// DoE executes the function on the transaction and saves the changes
-func (pDB *DBReadWrite) DoE(fn func(txn limestone.Transaction) error) error {
+// DoE executes the function on the transaction and saves the changes. There is
+// no transaction log, so the position is always wire.Beginning.
+func (pDB *DBReadWrite) DoE(fn func(txn limestone.Transaction) error) (wire.Position, error) {
 	txn, txnctrl := pDB.DB.Transaction()
 	defer txnctrl.Cancel()
 
 	if err := fn(txn); err != nil {
-		return err
+		return wire.Beginning, err
 	}
 
 	changes := txnctrl.Changes()
@@ -73,5 +75,5 @@ func (pDB *DBReadWrite) DoE(fn func(txn limestone.Transaction) error) error {
 	}
 	txnctrl.Commit()
 
-	return nil
+	return wire.Beginning, nil
 }
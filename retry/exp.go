@@ -1,6 +1,7 @@
 package retry
 
 import (
+	"math/rand"
 	"time"
 )
 
@@ -9,7 +10,8 @@ type ExpConfig struct {
 	Min     time.Duration
 	Max     time.Duration
 	Scale   float64
-	Instant bool // If false, Delays() method will return 0 when first time called and backoff value otherwise.
+	Instant bool    // If false, Delays() method will return 0 when first time called and backoff value otherwise.
+	Jitter  float64 // Each delay is randomized by up to this fraction in both directions (0 for none)
 }
 
 // Delays implements interface Config
@@ -52,6 +54,9 @@ func (b *Exponential) Backoff() time.Duration {
 	if b.current > b.config.Max {
 		b.current = b.config.Max
 	}
+	if b.config.Jitter != 0 {
+		beforeScale = time.Duration(float64(beforeScale) * (1 + b.config.Jitter*(2*rand.Float64()-1))) //nolint:gosec // not for security
+	}
 	return beforeScale
 }
 
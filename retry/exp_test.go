@@ -26,3 +26,15 @@ func TestBackoff(t *testing.T) {
 	assert.Equal(t, backoff.Backoff(), testExpConfig.Min)
 	assert.Equal(t, backoff.Backoff(), 2*testExpConfig.Min)
 }
+
+func TestBackoffJitter(t *testing.T) {
+	config := testExpConfig
+	config.Jitter = 0.5
+	backoff := NewExpBackoff(config)
+	for i := 0; i < 100; i++ {
+		backoff.Reset()
+		d := backoff.Backoff()
+		assert.GreaterOrEqual(t, d, testExpConfig.Min/2)
+		assert.LessOrEqual(t, d, testExpConfig.Min*3/2)
+	}
+}
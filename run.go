@@ -26,6 +26,9 @@ func (db *DB) Run(ctx context.Context) error {
 		spawn("incoming", parallel.Fail, func(ctx context.Context) error {
 			return db.process(ctx, ch)
 		})
+		if db.leases != nil {
+			spawn("leases", parallel.Fail, db.runLeases)
+		}
 		return nil
 	})
 }
@@ -45,28 +48,83 @@ func (db *DB) process(ctx context.Context, ch <-chan *wire.IncomingTransaction)
 	defer db.scheduler.Clear()
 
 	attention := map[typeddb.EID]bool{}
+	touched := map[typeddb.EID]bool{} // entities changed by the current transaction, for derivations
 	caughtUpCount := 0
 	var lastPos wire.Position
+	atHotEnd := false
+	var idleWaiters []chan struct{}
+	view := db.view()
+	dedup := wire.NewDedup(wire.DedupWindow) // see the limitations in the doc of wire.Dedup
 
 	for {
+		if txn == nil {
+			db.setPosition(lastPos)
+		}
+		if atHotEnd && len(attention) == 0 && !db.scheduler.Fired() {
+			for _, reply := range idleWaiters {
+				close(reply)
+			}
+			idleWaiters = nil
+		}
+
 		var incoming *wire.IncomingTransaction
 		select {
 		case incoming = <-ch:
 			if incoming == nil {
 				logger.Debug("Reached hot end", zap.Any("position", lastPos))
 			}
+			atHotEnd = incoming == nil
 		case <-db.scheduler.Wait():
 			for _, key := range db.scheduler.Get() {
 				logger.Debug("Alarm", zap.Stringer("eid", key))
 				attention[key] = true
 			}
+		case reply := <-db.idleRequests:
+			idleWaiters = append(idleWaiters, reply)
+			continue
+		case <-db.leaseTick():
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 
+		if incoming != nil && len(incoming.Changes) == 0 {
+			// Nothing for this DB, such as wire.PositionOnly in place of a
+			// transaction filtered out entirely
+			lastPos = incoming.Position
+			continue
+		}
+		if incoming != nil && dedup.CheckTxn(incoming.Transaction) {
+			logger.Debug("Dropping duplicate transaction", zap.Object("txn", incoming))
+			lastPos = incoming.Position
+			continue
+		}
+		if incoming != nil {
+			db.applyLeases(ctx, incoming)
+		}
+		if v := db.view(); v != view {
+			logger.Info("Responsibilities changed", zap.String("from", view), zap.String("to", v))
+			view = v
+			var s Snapshot = db.tdb.Snapshot()
+			if txn != nil {
+				s = txn
+			}
+			for _, key := range db.allEntities(s) {
+				attention[key] = true
+			}
+		}
+
 		if incoming != nil {
 			lastPos = incoming.Position
-			if db.source != nil && incoming.Source == *db.source && incoming.Session == db.session {
+			echo := db.source != nil && incoming.Source == *db.source && incoming.Session == db.session
+			if db.fenced(incoming) {
+				if echo {
+					// Our own transaction has already been applied locally
+					return fmt.Errorf("transaction at %s has been written after the election lease was lost", incoming.Position)
+				}
+				logger.Warn("Ignoring transaction from a replica not holding the election lease", zap.Object("txn", incoming))
+				continue
+			}
+			if echo {
 				continue // ignoring echoed transaction
 			}
 			if db.ready {
@@ -88,6 +146,14 @@ func (db *DB) process(ctx context.Context, ch <-chan *wire.IncomingTransaction)
 				for id, diff := range byID {
 					key := typeddb.EID{Kind: kind, ID: id}
 					before := tc.GetByEID(key)
+					if wire.IsRemoved(diff) { // stopped matching the predicates
+						if before != nil {
+							tc.Prune(key)
+							delete(attention, key)
+							touched[key] = true
+						}
+						continue
+					}
 					if before == nil && diff[idName] == nil {
 						continue // An update for a pruned entity
 					}
@@ -120,18 +186,21 @@ func (db *DB) process(ctx context.Context, ch <-chan *wire.IncomingTransaction)
 						if before != nil {
 							tc.Prune(key)
 							delete(attention, key)
+							touched[key] = true
 						}
 						continue
 					}
 
 					tc.SetByEID(key, after)
 					attention[key] = true
+					touched[key] = true
 				}
 			}
 
 			if len(attention) == 0 { // no relevant changes
 				tc.Cancel()
 				txn = nil
+				touched = map[typeddb.EID]bool{}
 			}
 		} else {
 			// we can get here because we received nil from the client (hot end reached),
@@ -140,36 +209,52 @@ func (db *DB) process(ctx context.Context, ch <-chan *wire.IncomingTransaction)
 				if txn == nil {
 					txn, tc = db.incomingTransaction()
 				} else {
-					tc.Reset()
+					// Let WakeUp see the derived entities up to date
+					db.derive(txn, tc, touched)
+					tc.ResetBackdated(db.clock.Now())
+					touched = map[typeddb.EID]bool{}
 				}
 
-				if db.wakeUp != nil {
+				if db.wakeUp != nil && db.IsLeader() {
 					entities := make([]any, 0, len(attention))
 					var eids []string
 					if db.ready {
 						eids = make([]string, 0, len(attention))
 					}
 					for key := range attention {
-						entities = append(entities, tc.GetByEID(key))
+						entity := tc.GetByEID(key)
+						if !db.owns(key, entity) {
+							continue
+						}
+						entities = append(entities, entity)
 						if db.ready {
 							eids = append(eids, key.String())
 						}
 					}
-					if db.ready {
-						logger.Debug("Waking up", zap.Int("entities", len(entities)), zap.Strings("eids", eids))
-					} else {
-						logger.Debug("Waking up for the first time", zap.Int("entities", len(entities)))
-					}
 
-					if err := db.submit(ctx, tc); err != nil {
-						return err
-					}
+					if len(entities) != 0 {
+						if db.ready {
+							logger.Debug("Waking up", zap.Int("entities", len(entities)), zap.Strings("eids", eids))
+						} else {
+							logger.Debug("Waking up for the first time", zap.Int("entities", len(entities)))
+						}
+
+						db.wakeUp(ctx, txn, entities)
 
-					for key := range tc.Changes() {
-						attention[key] = true
+						if _, err := db.submit(ctx, tc); err != nil {
+							return err
+						}
+
+						for key := range tc.Changes() {
+							attention[key] = true
+							touched[key] = true
+						}
 					}
 				}
 
+				// Derive from the changes made by WakeUp
+				db.derive(txn, tc, touched)
+
 				if db.debugTap != nil {
 					db.debugTap <- txn.Snapshot()
 				}
@@ -178,9 +263,11 @@ func (db *DB) process(ctx context.Context, ch <-chan *wire.IncomingTransaction)
 					db.postProcess(tc, key, tc.GetByEID(key), txn.Time())
 				}
 				attention = map[typeddb.EID]bool{}
+				touched = map[typeddb.EID]bool{}
 
 				tc.Commit()
 				txn = nil
+				db.notifyUpdated()
 			}
 
 			if !db.ready {
@@ -193,5 +280,5 @@ func (db *DB) process(ctx context.Context, ch <-chan *wire.IncomingTransaction)
 }
 
 func (db *DB) incomingTransaction() (Transaction, typeddb.TransactionControl) {
-	return db.tdb.Transaction()
+	return db.tdb.TransactionBackdated(db.clock.Now())
 }
@@ -1,6 +1,12 @@
 package run
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
 	//
 	// This package bundles CA certificates for use in TLS connections.
 	//
@@ -11,3 +17,80 @@ import (
 	//
 	_ "golang.org/x/crypto/x509roots/fallback"
 )
+
+// CertPool returns the system CA pool (or the bundled one if the system has
+// none) extended with the certificates from the given PEM files
+func CertPool(caFiles ...string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, caFile := range caFiles {
+		if err := appendCerts(pool, caFile); err != nil {
+			return nil, err
+		}
+	}
+	return pool, nil
+}
+
+func appendCerts(pool *x509.CertPool, caFile string) error {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("failed to read CA certificates: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no CA certificates found in %s", caFile)
+	}
+	return nil
+}
+
+// TLSConfig returns the client TLS configuration trusting the system CAs and
+// the CAs from caFile, and presenting the certificate from certFile and keyFile
+// to the server. Any of the file names may be empty.
+func TLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	var caFiles []string
+	if caFile != "" {
+		caFiles = append(caFiles, caFile)
+	}
+	pool, err := CertPool(caFiles...)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ServerTLSConfig returns the server TLS configuration presenting the
+// certificate from certFile and keyFile. If clientCAFile is not empty, the
+// clients are required to present certificates signed by the CAs from it.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both certificate and key files are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		config.ClientCAs = x509.NewCertPool()
+		if err := appendCerts(config.ClientCAs, clientCAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
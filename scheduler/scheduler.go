@@ -5,13 +5,15 @@ import (
 
 	"time"
 
+	"github.com/ridge/limestone/clock"
 	"github.com/ridge/limestone/typeddb"
 )
 
 // A Scheduler keeps track of many upcoming alarms associated with entities,
 // at most one per EID
 type Scheduler struct {
-	alarms map[typeddb.EID]*time.Timer
+	clock  clock.Clock
+	alarms map[typeddb.EID]clock.Timer
 	fired  map[typeddb.EID]bool
 	ch     chan struct{}
 	mu     sync.Mutex
@@ -19,8 +21,14 @@ type Scheduler struct {
 
 // New creates a snew Scheduler
 func New() *Scheduler {
+	return NewWithClock(clock.Real)
+}
+
+// NewWithClock creates a new Scheduler using the given clock
+func NewWithClock(c clock.Clock) *Scheduler {
 	return &Scheduler{
-		alarms: map[typeddb.EID]*time.Timer{},
+		clock:  c,
+		alarms: map[typeddb.EID]clock.Timer{},
 		ch:     make(chan struct{}, 1),
 	}
 }
@@ -41,11 +49,11 @@ func (s *Scheduler) Schedule(key typeddb.EID, when time.Time) {
 			delete(s.alarms, key)
 		}
 	} else {
-		d := time.Until(when)
+		d := when.Sub(s.clock.Now())
 		if timer != nil {
 			timer.Reset(d)
 		} else {
-			s.alarms[key] = time.AfterFunc(d, func() {
+			s.alarms[key] = s.clock.AfterFunc(d, func() {
 				s.alarm(key)
 			})
 		}
@@ -90,6 +98,14 @@ func (s *Scheduler) Get() []typeddb.EID {
 	return res
 }
 
+// Fired returns true if some alarms have fired but have not been retrieved by
+// Get yet
+func (s *Scheduler) Fired() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.fired) != 0
+}
+
 // Clear removes all alarms
 func (s *Scheduler) Clear() {
 	s.mu.Lock()
@@ -98,6 +114,6 @@ func (s *Scheduler) Clear() {
 	for _, timer := range s.alarms {
 		timer.Stop()
 	}
-	s.alarms = map[typeddb.EID]*time.Timer{}
+	s.alarms = map[typeddb.EID]clock.Timer{}
 	s.fired = nil
 }
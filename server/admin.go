@@ -0,0 +1,199 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/thttp"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"go.uber.org/zap"
+)
+
+// admin serves the administrative API:
+//
+//	GET  /admin/manifests     manifest history, oldest first (client.ManifestRecord)
+//	POST /admin/manifests     publish the wire.Manifest in the body
+//	POST /admin/maintenance   republish the current manifest with the
+//	                          Maintenance flag and Audit from the body
+//	                          (maintenanceRequest)
+//	POST /admin/transactions  write an administrative transaction with the
+//	                          wire.Changes in the body into the topic of the
+//	                          current manifest (or the one given as the topic
+//	                          query parameter)
+//
+// Every request must carry the admin token as a bearer token. Every action is
+// logged along with the client address. The administrative transactions carry
+// the client address and the admin session in Audit (see adminAudit).
+//
+// The admin API is available even while the database is under maintenance.
+// Note that publishing a manifest restarts the server.
+type admin struct {
+	kafka    kafka.Client
+	upstream client.KafkaClient
+	token    string
+	session  int64 // identifies the server instance in the audit trail
+}
+
+// adminAudit is the Audit of the administrative transactions
+type adminAudit struct {
+	Admin    bool   // written through the admin API
+	RemoteIP string // of the admin client
+	Session  int64  // of the admin API, see admin.session
+}
+
+type maintenanceRequest struct {
+	Maintenance bool
+	Audit       json.RawMessage `json:",omitempty"`
+}
+
+func (a admin) register(router *mux.Router) {
+	router.Use(a.authenticate)
+	router.HandleFunc("/manifests", a.manifests).Methods(http.MethodGet)
+	router.HandleFunc("/manifests", a.publishManifest).Methods(http.MethodPost)
+	router.HandleFunc("/maintenance", a.maintenance).Methods(http.MethodPost)
+	router.HandleFunc("/transactions", a.transaction).Methods(http.MethodPost)
+}
+
+func (a admin) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := thttp.BearerToken(r.Header)
+		if err == nil && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			err = errors.New("invalid admin token")
+		}
+		if err != nil {
+			tlog.Get(r.Context()).Warn("Admin request rejected", zap.String("remoteAddr", r.RemoteAddr),
+				zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a admin) manifests(w http.ResponseWriter, r *http.Request) {
+	history, err := a.upstream.ManifestHistory(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if history == nil {
+		history = []client.ManifestRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(must.OK1(json.Marshal(history))); err != nil {
+		tlog.Get(r.Context()).Debug("Admin: failed to write response", zap.Error(err))
+	}
+}
+
+func (a admin) publishManifest(w http.ResponseWriter, r *http.Request) {
+	var manifest wire.Manifest
+	if err := json.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		http.Error(w, "failed to parse manifest: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := kafka.ValidateTopicName(manifest.Topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.publish(w, r, manifest)
+}
+
+func (a admin) maintenance(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "failed to parse request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	current, ok := a.current(w, r)
+	if !ok {
+		return
+	}
+	manifest := current
+	manifest.Maintenance = req.Maintenance
+	manifest.Audit = req.Audit
+	a.publish(w, r, manifest)
+}
+
+func (a admin) transaction(w http.ResponseWriter, r *http.Request) {
+	var txn wire.Transaction
+	if err := json.NewDecoder(r.Body).Decode(&txn.Changes); err != nil {
+		http.Error(w, "failed to parse changes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(txn.Changes) == 0 {
+		http.Error(w, "empty transaction", http.StatusBadRequest)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		current, ok := a.current(w, r)
+		if !ok {
+			return
+		}
+		topic = current.Topic
+	}
+	if err := kafka.ValidateTopicName(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	txn.Audit = must.OK1(json.Marshal(adminAudit{
+		Admin:    true,
+		RemoteIP: remoteIP(r),
+		Session:  a.session,
+	}))
+
+	logger := tlog.Get(r.Context()).With(zap.String("remoteAddr", r.RemoteAddr), zap.String("topic", topic), zap.Object("txn", txn))
+	logger.Info("Admin: writing administrative transaction")
+	if err := client.PublishKafkaTransaction(r.Context(), a.kafka, topic, txn); err != nil {
+		logger.Error("Admin: failed to write administrative transaction", zap.Error(err))
+		http.Error(w, "failed to write transaction", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Admin: wrote administrative transaction")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// remoteIP returns the IP address of the client
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// current returns the most recent manifest, maintenance or not. Reports an
+// error to the client if there is none.
+func (a admin) current(w http.ResponseWriter, r *http.Request) (wire.Manifest, bool) {
+	history, err := a.upstream.ManifestHistory(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return wire.Manifest{}, false
+	}
+	if len(history) == 0 {
+		http.Error(w, client.ErrNoManifest.Error(), http.StatusConflict)
+		return wire.Manifest{}, false
+	}
+	return history[len(history)-1].Manifest, true
+}
+
+func (a admin) publish(w http.ResponseWriter, r *http.Request, manifest wire.Manifest) {
+	logger := tlog.Get(r.Context()).With(zap.String("remoteAddr", r.RemoteAddr), zap.Object("manifest", manifest))
+	logger.Info("Admin: publishing manifest")
+	if err := client.PublishKafkaManifest(r.Context(), a.kafka, manifest); err != nil {
+		logger.Error("Admin: failed to publish manifest", zap.Error(err))
+		http.Error(w, "failed to publish manifest", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("Admin: published manifest")
+	w.WriteHeader(http.StatusNoContent)
+}
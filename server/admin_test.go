@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/thttp"
+	"github.com/ridge/limestone/tnet"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/require"
+)
+
+func (env *testEnv) admin(t *testing.T, method, path, token string, body any) (int, []byte) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(must.OK1(json.Marshal(body)))
+	}
+	req, err := http.NewRequestWithContext(env.group.Context(), method, fmt.Sprintf("http://%s/admin%s", env.addr, path), reader)
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := thttp.WithRequestsLogging(&http.Client{}).Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return res.StatusCode, data
+}
+
+func TestAdminUnauthorized(t *testing.T) {
+	env := testSetup(t)
+
+	status, _ := env.admin(t, http.MethodGet, "/manifests", "", nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = env.admin(t, http.MethodGet, "/manifests", "wrong", nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, _ = env.admin(t, http.MethodPost, "/maintenance", "wrong", maintenanceRequest{Maintenance: true})
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	history, err := client.NewKafkaClient(env.kafka).ManifestHistory(env.group.Context())
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+}
+
+func TestAdminManifests(t *testing.T) {
+	env := testSetup(t)
+
+	status, data := env.admin(t, http.MethodGet, "/manifests", testAdminToken, nil)
+	require.Equal(t, http.StatusOK, status)
+	var history []client.ManifestRecord
+	require.NoError(t, json.Unmarshal(data, &history))
+	require.Len(t, history, 1)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog"}, history[0].Manifest)
+
+	status, _ = env.admin(t, http.MethodPost, "/manifests", testAdminToken, wire.Manifest{Version: 2, Topic: "bad topic"})
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestAdminTransactions(t *testing.T) {
+	env := testSetup(t)
+
+	messages := make(chan *kafka.IncomingMessage)
+	env.group.Spawn("reader", parallel.Fail, func(ctx context.Context) error {
+		return env.kafka.Read(ctx, "txlog", 0, messages)
+	})
+	require.Nil(t, <-messages)
+
+	status, _ := env.admin(t, http.MethodPost, "/transactions", testAdminToken, wire.Changes{})
+	require.Equal(t, http.StatusBadRequest, status)
+
+	status, _ = env.admin(t, http.MethodPost, "/transactions", testAdminToken, testTxn1.Changes)
+	require.Equal(t, http.StatusNoContent, status)
+
+	msg := <-messages
+	var txn wire.Transaction
+	require.NoError(t, json.Unmarshal(msg.Value, &txn))
+	require.Equal(t, testTxn1.Changes, txn.Changes)
+	var audit adminAudit
+	require.NoError(t, json.Unmarshal(txn.Audit, &audit))
+	require.True(t, audit.Admin)
+	require.Equal(t, "127.0.0.1", audit.RemoteIP)
+	require.NotZero(t, audit.Session)
+	require.Nil(t, <-messages)
+}
+
+func TestAdminRequiresTLS(t *testing.T) {
+	err := Run(test.Context(t), Config{
+		Listener:   tnet.ListenOnRandomPort(),
+		Kafka:      mock.New(),
+		AdminToken: testAdminToken,
+	})
+	require.ErrorContains(t, err, "admin API requires TLS")
+}
+
+func TestReadAdminToken(t *testing.T) {
+	t.Setenv(adminTokenEnv, "from-env")
+	token, err := readAdminToken("")
+	require.NoError(t, err)
+	require.Equal(t, "from-env", token)
+
+	file := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(file, []byte("from-file\n"), 0o600))
+	token, err = readAdminToken(file)
+	require.NoError(t, err)
+	require.Equal(t, "from-file", token)
+
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	_, err = readAdminToken(file)
+	require.ErrorContains(t, err, "is empty")
+}
+
+func TestAdminLeaveMaintenance(t *testing.T) {
+	env := testSetupManifest(t, wire.Manifest{Version: 1, Topic: "txlog", Maintenance: true})
+
+	status, _ := env.admin(t, http.MethodPost, "/maintenance", testAdminToken, maintenanceRequest{
+		Maintenance: false,
+		Audit:       json.RawMessage(`{"who":"test"}`),
+	})
+	require.Equal(t, http.StatusNoContent, status)
+
+	history, err := client.NewKafkaClient(env.kafka).ManifestHistory(env.group.Context())
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	require.Equal(t, wire.Manifest{Version: 1, Topic: "txlog", Audit: json.RawMessage(`{"who":"test"}`)}, history[1].Manifest)
+
+	// The server starts serving clients once the maintenance is over
+	incoming, _ := env.spawnConnection(1, wire.Beginning, nil)
+	require.Nil(t, <-incoming)
+}
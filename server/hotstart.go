@@ -18,6 +18,8 @@ import (
 	"github.com/ridge/limestone/wire"
 	"github.com/ridge/must/v2"
 	"go.uber.org/zap"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"golang.org/x/oauth2/google"
 )
 
@@ -43,9 +45,69 @@ func parseGSURL(gsURL string) (bucket, object string, err error) {
 	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
 }
 
-func hotStartMessage(kind string, changes wire.KindChanges) []byte {
-	txn := wire.IncomingTransaction{Transaction: wire.Transaction{Changes: wire.Changes{kind: changes}}}
-	return must.OK1(json.Marshal(wire.Notification{Txn: &txn}))
+// hotStartData is the compacted state of the transaction log sent to the
+// clients before the transactions following it
+type hotStartData struct {
+	pos    wire.Position
+	live   bool
+	chunks []hotStartChunk // in a reproducible order, so that a client can resume
+}
+
+type hotStartChunk struct {
+	kind string
+	txn  json.RawMessage // marshaled wire.IncomingTransaction
+}
+
+// hotStartNotification is wire.Notification with a premarshaled transaction
+type hotStartNotification struct {
+	Txn      json.RawMessage
+	HotStart wire.HotStartChunk
+}
+
+func newHotStartData(pos wire.Position, live bool, byKind map[string][]json.RawMessage) *hotStartData {
+	data := &hotStartData{pos: pos, live: live}
+	kinds := maps.Keys(byKind)
+	slices.Sort(kinds)
+	for _, kind := range kinds {
+		for _, txn := range byKind[kind] {
+			data.chunks = append(data.chunks, hotStartChunk{kind: kind, txn: txn})
+		}
+	}
+	return data
+}
+
+// activeHotStartData converts an active set into hot start data
+func activeHotStartData(active wire.ActiveSet, pos wire.Position) *hotStartData {
+	byKind := map[string][]json.RawMessage{}
+	for kind, byID := range active {
+		changes := wire.KindChanges{}
+		ids := maps.Keys(byID)
+		slices.Sort(ids)
+		for _, id := range ids {
+			changes[id] = byID[id].Props
+			if len(changes) == objectsPerMessage {
+				byKind[kind] = append(byKind[kind], hotStartMessage(kind, changes))
+				changes = wire.KindChanges{}
+			}
+		}
+		if len(changes) != 0 {
+			byKind[kind] = append(byKind[kind], hotStartMessage(kind, changes))
+		}
+	}
+	return newHotStartData(pos, true, byKind)
+}
+
+// message returns the marshaled notification for the chunk with the given
+// number
+func (d *hotStartData) message(seq int) []byte {
+	return must.OK1(json.Marshal(hotStartNotification{
+		Txn:      d.chunks[seq].txn,
+		HotStart: wire.HotStartChunk{Position: d.pos, Live: d.live, Seq: seq},
+	}))
+}
+
+func hotStartMessage(kind string, changes wire.KindChanges) json.RawMessage {
+	return must.OK1(json.Marshal(wire.IncomingTransaction{Transaction: wire.Transaction{Changes: wire.Changes{kind: changes}}}))
 }
 
 func (s *server) pullHotStart(ctx context.Context, gsURL string) error {
@@ -98,7 +160,7 @@ func (s *server) pullHotStart(ctx context.Context, gsURL string) error {
 			return fmt.Errorf("expected version %d, found %d", s.version, header.Version)
 		}
 
-		messages := map[string][][]byte{}
+		messages := map[string][]json.RawMessage{}
 		current := wire.Changes{}
 		objects := 0
 
@@ -130,12 +192,11 @@ func (s *server) pullHotStart(ctx context.Context, gsURL string) error {
 				delete(current, ao.Kind)
 			}
 		}
-		for kind, changes := range current {
+		for kind, changes := range current { // one per kind, so the order of kinds doesn't matter
 			messages[kind] = append(messages[kind], hotStartMessage(kind, changes))
 		}
 
-		s.hotStart = messages
-		s.hotStartPos = header.Position
+		s.hotStart = newHotStartData(header.Position, false, messages)
 		tlog.Get(ctx).Info("Hot start data downloaded", zap.String("url", gsURL), zap.Int("objects", objects))
 		return nil
 	})
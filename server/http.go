@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 5 * time.Minute
+	maxPollEvents      = 1000
+)
+
+// errPollDone stops streaming when the poll response is ready
+var errPollDone = errors.New("poll done")
+
+// parseRequest parses a wire.Request from the query parameters of a plain
+// HTTP request:
+//
+//	version   database version (required)
+//	position  position of the last transaction seen (may be overridden by
+//	          the Last-Event-ID header)
+//	compact   true if compacted history is acceptable
+//	filter    kind or kind:prop1,prop2,... (may be repeated)
+//	where     JSON-encoded wire.Where
+func parseRequest(r *http.Request) (wire.Request, error) {
+	query := r.URL.Query()
+
+	var req wire.Request
+	var err error
+	req.Version, err = strconv.Atoi(query.Get("version"))
+	if err != nil {
+		return req, errors.New("failed to parse required query parameter: version")
+	}
+
+	req.Last = wire.Position(query.Get("position"))
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		req.Last = wire.Position(id)
+	}
+
+	if c := query.Get("compact"); c != "" {
+		req.Compact, err = strconv.ParseBool(c)
+		if err != nil {
+			return req, fmt.Errorf("failed to parse query parameter compact: %w", err)
+		}
+	}
+
+	for _, f := range query["filter"] {
+		if req.Filter == nil {
+			req.Filter = wire.Filter{}
+		}
+		kind, props, found := strings.Cut(f, ":")
+		if kind == "" {
+			return req, fmt.Errorf("invalid filter %q", f)
+		}
+		if !found {
+			req.Filter[kind] = nil
+			continue
+		}
+		if _, ok := req.Filter[kind]; ok && req.Filter[kind] == nil {
+			continue // all properties already requested
+		}
+		req.Filter[kind] = append(req.Filter[kind], strings.Split(props, ",")...)
+	}
+
+	if w := query.Get("where"); w != "" {
+		if err := json.Unmarshal([]byte(w), &req.Where); err != nil {
+			return req, fmt.Errorf("failed to parse query parameter where: %w", err)
+		}
+	}
+
+	return req, nil
+}
+
+// events serves the notifications as a stream of Server-Sent Events. Every
+// event carries a wire.Notification. The events with transactions have their
+// positions as IDs, so a reconnecting EventSource resumes automatically.
+func (s server) events(w http.ResponseWriter, r *http.Request) {
+	logger := tlog.Get(r.Context())
+
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info("Client connected", zap.Any("limestoneRequest", req))
+	defer logger.Info("Client disconnected")
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Error("Streaming not supported", zap.Error(err))
+		return
+	}
+
+	err = s.stream(r.Context(), req, func(ctx context.Context, ev event) error {
+		if ev.pos != "" {
+			if _, err := fmt.Fprintf(w, "id: %s\n", ev.pos); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", ev.data); err != nil {
+			return err
+		}
+		return rc.Flush()
+	})
+	if err != nil && !errors.Is(err, r.Context().Err()) {
+		logger.Debug("Streaming failed", zap.Error(err))
+	}
+}
+
+// poll serves the notifications by long polling. The response is a JSON array
+// of wire.Notification. It is sent once the hot end is reached after at least
+// one transaction, or when the timeout (query parameter timeout, a Go
+// duration) expires. To continue, the client passes the position of the last
+// transaction received.
+func (s server) poll(w http.ResponseWriter, r *http.Request) {
+	logger := tlog.Get(r.Context())
+
+	req, err := parseRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	timeout := defaultPollTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		timeout, err = time.ParseDuration(t)
+		if err != nil || timeout <= 0 || timeout > maxPollTimeout {
+			http.Error(w, "invalid query parameter: timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	res := []json.RawMessage{}
+	txns := 0
+	err = s.stream(ctx, req, func(ctx context.Context, ev event) error {
+		res = append(res, ev.data)
+		switch {
+		case ev.err:
+		case ev.hot:
+			if txns != 0 {
+				return errPollDone
+			}
+		default:
+			txns++
+			// Hot start notifications have no positions to continue from
+			if txns >= maxPollEvents && ev.pos != "" {
+				return errPollDone
+			}
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPollDone) && !errors.Is(err, context.DeadlineExceeded) {
+		if r.Context().Err() == nil {
+			logger.Error("Polling failed", zap.Error(err))
+			http.Error(w, "polling failed", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		logger.Debug("Failed to send response", zap.Error(err))
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRequest(t *testing.T) {
+	r := must.OK1(http.NewRequest(http.MethodGet, "/events?version=2&position=p1&compact=true&filter=apple&filter=orange:Color,Size&filter=orange:Mass", nil))
+	req, err := parseRequest(r)
+	require.NoError(t, err)
+	require.Equal(t, wire.Request{
+		Version: 2,
+		Last:    "p1",
+		Compact: true,
+		Filter:  wire.Filter{"apple": nil, "orange": {"Color", "Size", "Mass"}},
+	}, req)
+
+	r.Header.Set("Last-Event-ID", "p2")
+	req, err = parseRequest(r)
+	require.NoError(t, err)
+	require.Equal(t, wire.Position("p2"), req.Last)
+
+	_, err = parseRequest(must.OK1(http.NewRequest(http.MethodGet, "/events", nil)))
+	require.Error(t, err)
+}
+
+func TestEvents(t *testing.T) {
+	env := testSetup(t)
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn1))
+
+	req := must.OK1(http.NewRequestWithContext(env.group.Context(), http.MethodGet, fmt.Sprintf("http://%s/events?version=1", env.addr), nil))
+	req.Header.Set("Last-Event-ID", "0000000000000000-0000000000000000")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	lines := bufio.NewScanner(res.Body)
+	next := func() string {
+		require.True(t, lines.Scan())
+		return lines.Text()
+	}
+
+	// Resumed after testTxn1: hot end first
+	require.Equal(t, `data: {"Hot":true}`, next())
+	require.Equal(t, "", next())
+
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+	require.Equal(t, "id: 0000000000000000-0000000000000001", next())
+	data := next()
+	require.True(t, strings.HasPrefix(data, "data: "))
+	var notification wire.Notification
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &notification))
+	require.Equal(t, testTxn2.Changes, notification.Txn.Changes)
+	require.Equal(t, "", next())
+}
+
+func TestPoll(t *testing.T) {
+	env := testSetup(t)
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn1))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+
+	poll := func(query url.Values) []wire.Notification {
+		req := must.OK1(http.NewRequestWithContext(env.group.Context(), http.MethodGet, fmt.Sprintf("http://%s/poll?%s", env.addr, query.Encode()), nil))
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		var notifications []wire.Notification
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&notifications))
+		return notifications
+	}
+
+	notifications := poll(url.Values{"version": {"1"}, "filter": {"orange"}})
+	require.Len(t, notifications, 2)
+	require.Equal(t, testTxn2.Changes, notifications[0].Txn.Changes)
+	require.True(t, notifications[1].Hot)
+
+	// Up to date: waits for the timeout
+	notifications = poll(url.Values{"version": {"1"}, "position": {string(notifications[0].Txn.Position)}, "timeout": {"10ms"}})
+	require.Equal(t, []wire.Notification{{Hot: true}}, notifications)
+
+	notifications = poll(url.Values{"version": {"0"}})
+	require.Equal(t, []wire.Notification{{Err: wire.ErrVersionMismatch(0, 1)}}, notifications)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/parallel"
+	"go.uber.org/zap"
+)
+
+// liveSet is the active set maintained by the server itself from the
+// transaction log. It serves as hot start data that is always fresh.
+//
+// The server cannot evaluate the Survive methods of the entities, so the live
+// set keeps all objects ever created, except those deleted by a tombstone (see
+// wire.RemovedDiff). If the number of objects exceeds the limit, the live set
+// is disabled.
+type liveSet struct {
+	limit int // maximum number of objects, 0 if unlimited
+
+	mu     sync.Mutex
+	active wire.ActiveSet
+	size   int           // number of objects in active
+	dedup  *wire.Dedup   // retried transactions are not applied twice
+	pos    wire.Position // position of the last transaction applied
+	ready  bool          // reached the hot end at least once
+	failed bool
+	done   chan struct{} // closed when ready or failed
+
+	cached *hotStartData // for the position pos, if built
+}
+
+// errLiveSetFull is returned when the live set exceeds its limit
+var errLiveSetFull = errors.New("too many objects in the live set")
+
+func newLiveSet(limit int) *liveSet {
+	return &liveSet{limit: limit, active: wire.ActiveSet{}, dedup: wire.NewDedup(wire.DedupWindow), done: make(chan struct{})}
+}
+
+// run keeps the live set up to date. Returns nil if the live set is no longer
+// usable because of a mismatch (such as a new manifest) or because it has
+// grown too large.
+func (ls *liveSet) run(ctx context.Context, conn client.Connection) error {
+	logger := tlog.Get(ctx)
+	err := parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		txns := make(chan *wire.IncomingTransaction)
+		spawn("upstream", parallel.Fail, func(ctx context.Context) error {
+			return conn.Run(ctx, txns)
+		})
+		spawn("apply", parallel.Fail, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case txn := <-txns:
+					if err := ls.apply(ctx, txn); err != nil {
+						return err
+					}
+				}
+			}
+		})
+		return nil
+	})
+
+	var mismatch wire.ErrMismatch
+	if errors.As(err, &mismatch) || errors.Is(err, errLiveSetFull) {
+		logger.Warn("Live compaction disabled", zap.Error(err))
+		ls.mu.Lock()
+		ls.failed = true
+		ls.active = nil // release the memory
+		ls.cached = nil
+		if !ls.ready {
+			close(ls.done)
+		}
+		ls.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+func (ls *liveSet) apply(ctx context.Context, txn *wire.IncomingTransaction) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if txn == nil {
+		if !ls.ready {
+			tlog.Get(ctx).Info("Live compaction caught up", zap.String("position", string(ls.pos)), zap.Int("objects", ls.size))
+			ls.ready = true
+			close(ls.done)
+		}
+		return nil
+	}
+	ls.pos = txn.Position
+	if ls.dedup.CheckTxn(txn.Transaction) {
+		return nil
+	}
+	for kind := range txn.Changes {
+		ls.size -= len(ls.active[kind])
+	}
+	if err := ls.active.Apply(txn.Transaction, time.Time{}, nil); err != nil {
+		tlog.Get(ctx).Warn("Skipped invalid changes in live compaction", zap.String("position", string(txn.Position)), zap.Error(err))
+	}
+	for kind := range txn.Changes {
+		ls.size += len(ls.active[kind])
+	}
+	if ls.limit > 0 && ls.size > ls.limit {
+		return fmt.Errorf("%w: more than %d at %s", errLiveSetFull, ls.limit, txn.Position)
+	}
+	return nil
+}
+
+// snapshot returns the hot start data. Waits for the live set to catch up.
+// Returns nil if the live set is not usable.
+func (ls *liveSet) snapshot(ctx context.Context) *hotStartData {
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-ls.done:
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.failed {
+		return nil
+	}
+	if ls.cached == nil || ls.cached.pos != ls.pos {
+		ls.cached = activeHotStartData(ls.active, ls.pos)
+	}
+	return ls.cached
+}
+
+// snapshotAt returns the hot start data for the given position if it is the
+// latest one built, or nil
+func (ls *liveSet) snapshotAt(pos wire.Position) *hotStartData {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.cached == nil || ls.cached.pos != pos {
+		return nil
+	}
+	return ls.cached
+}
+
+// replayActive rebuilds the active set of the live set at the given position
+// by reading the transaction log from the beginning
+func replayActive(ctx context.Context, source client.Client, version int, pos wire.Position) (wire.ActiveSet, error) {
+	active := wire.ActiveSet{}
+	if pos == wire.Beginning {
+		return active, nil
+	}
+	dedup := wire.NewDedup(wire.DedupWindow)
+	err := parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		txns := make(chan *wire.IncomingTransaction)
+		spawn("upstream", parallel.Fail, func(ctx context.Context) error {
+			return source.Connect(version, wire.Beginning, nil, false).Run(ctx, txns)
+		})
+		spawn("apply", parallel.Exit, func(ctx context.Context) error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case txn := <-txns:
+					if txn == nil {
+						return wire.ErrMismatch(fmt.Sprintf("position %s not found", pos))
+					}
+					if !dedup.CheckTxn(txn.Transaction) { // not a retry
+						if err := active.Apply(txn.Transaction, time.Time{}, nil); err != nil {
+							tlog.Get(ctx).Warn("Skipped invalid changes in live compaction", zap.String("position", string(txn.Position)), zap.Error(err))
+						}
+					}
+					if txn.Position == pos {
+						return nil
+					}
+				}
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return active, nil
+}
@@ -2,18 +2,26 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/ridge/limestone/client"
 	"github.com/ridge/limestone/kafka"
 	"github.com/ridge/limestone/run"
 	"github.com/ridge/limestone/thttp"
+	"github.com/ridge/limestone/tlog"
 	"github.com/ridge/limestone/tnet"
 	"github.com/ridge/limestone/wire"
 	"github.com/ridge/parallel"
 	"github.com/spf13/pflag"
+	"go.uber.org/zap"
 )
 
 // Config contains the server parameters
@@ -21,15 +29,67 @@ type Config struct {
 	Listener        net.Listener
 	Kafka           kafka.Client
 	HotStartStorage string
+
+	// TLS enables TLS on the listener (see run.ServerTLSConfig). Nil means
+	// plaintext.
+	TLS *tls.Config
+
+	// CacheSize is the number of recent transactions kept in memory and
+	// shared by all clients. The cache is filled starting from about CacheSize
+	// transactions before the hot end at startup. The clients whose positions
+	// are older are served directly from Kafka. Zero disables the cache.
+	CacheSize int
+
+	// LiveCompaction enables maintaining the compacted state of the
+	// transaction log in memory. Clients requesting compacted history get
+	// the current state instead of the data from HotStartStorage.
+	//
+	// The server cannot evaluate the Survive methods, so the compacted state
+	// keeps every entity ever created unless it is deleted by a tombstone
+	// (see wire.RemovedDiff), and the memory used grows accordingly.
+	LiveCompaction bool
+
+	// LiveCompactionLimit is the maximum number of entities kept by live
+	// compaction. When it is exceeded, live compaction is disabled and the
+	// data from HotStartStorage is used instead. Zero means no limit.
+	LiveCompactionLimit int
+
+	// AdminToken enables the admin API (see admin) for the clients presenting
+	// it as a bearer token. Empty means the admin API is disabled.
+	//
+	// The admin API requires TLS, so that the token is not sent in the clear.
+	AdminToken string
+
+	// AdminInsecure allows the admin API without TLS, such as behind a proxy
+	// terminating TLS, or in local testing
+	AdminInsecure bool
 }
 
+// adminTokenEnv is the environment variable to pass the admin token in if
+// --admin-token-file is not given
+const adminTokenEnv = "LIMESTONE_ADMIN_TOKEN"
+
 // Main handles the command line and runs the server
 func Main(args []string) {
 	run.Server(func(ctx context.Context) error {
 		var addr, hotStartStorage, kafkaURL string
+		var cacheSize int
+		var liveCompaction bool
+		var liveCompactionLimit int
+		var tlsCert, tlsKey, tlsClientCA string
+		var adminTokenFile string
+		var adminInsecure bool
 		pflag.StringVar(&addr, "addr", ":10007", "address to listen on")
 		pflag.StringVar(&hotStartStorage, "hot-start", "", "Google Cloud Storage URL prefix (gs://...) for hot start data")
 		pflag.StringVar(&kafkaURL, "kafka-url", "", "Kafka URL")
+		pflag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file (enables TLS)")
+		pflag.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+		pflag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file to verify client certificates against (requires client certificates)")
+		pflag.BoolVar(&liveCompaction, "live-compaction", false, "maintain compacted state in memory for hot start")
+		pflag.IntVar(&liveCompactionLimit, "live-compaction-limit", 1000000, "maximum number of entities in the compacted state in memory (0 for no limit)")
+		pflag.StringVar(&adminTokenFile, "admin-token-file", "", "file containing the bearer token for the admin API (default: $"+adminTokenEnv+", disabled if empty)")
+		pflag.BoolVar(&adminInsecure, "admin-insecure", false, "allow the admin API without TLS")
+		pflag.IntVar(&cacheSize, "cache-size", 0, "number of recent transactions to keep in memory for all clients (0 to disable)")
 		_ = pflag.CommandLine.Parse(args[1:])
 
 		kafka, err := kafka.FromURI(kafkaURL)
@@ -42,16 +102,99 @@ func Main(args []string) {
 			return err
 		}
 
+		adminToken, err := readAdminToken(adminTokenFile)
+		if err != nil {
+			return err
+		}
+
+		var tlsConfig *tls.Config
+		if tlsCert != "" {
+			tlsConfig, err = run.ServerTLSConfig(tlsCert, tlsKey, tlsClientCA)
+			if err != nil {
+				return err
+			}
+		}
+
 		return Run(ctx, Config{
-			Listener:        listener,
-			Kafka:           kafka,
-			HotStartStorage: hotStartStorage,
+			Listener:            listener,
+			Kafka:               kafka,
+			HotStartStorage:     hotStartStorage,
+			TLS:                 tlsConfig,
+			CacheSize:           cacheSize,
+			LiveCompaction:      liveCompaction,
+			LiveCompactionLimit: liveCompactionLimit,
+			AdminToken:          adminToken,
+			AdminInsecure:       adminInsecure,
 		})
 	})
 }
 
+// readAdminToken reads the admin token from the file, or from the environment
+// if the file is not given. The token is not accepted on the command line,
+// where it would be visible to other users.
+func readAdminToken(file string) (string, error) {
+	if file == "" {
+		return os.Getenv(adminTokenEnv), nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read admin token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("failed to read admin token: %s is empty", file)
+	}
+	return token, nil
+}
+
 // Run runs the server
 func Run(ctx context.Context, config Config) error {
+	if config.AdminToken != "" && config.TLS == nil && !config.AdminInsecure {
+		return errors.New("admin API requires TLS (use --admin-insecure to override)")
+	}
+
+	// The admin API is served while waiting for a usable manifest, so that
+	// the database can be taken out of maintenance. Other requests wait.
+	ready := make(chan struct{})
+	var serve http.Handler // set before ready is closed
+	router := mux.NewRouter()
+	if config.AdminToken != "" {
+		admin{
+			kafka:    config.Kafka,
+			upstream: client.NewKafkaClient(config.Kafka),
+			token:    config.AdminToken,
+			session:  time.Now().UnixNano(),
+		}.register(router.PathPrefix("/admin").Subrouter())
+	}
+	router.PathPrefix("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ready:
+		}
+		serve.ServeHTTP(w, r)
+	})
+	listener := config.Listener
+	if config.TLS != nil {
+		listener = tls.NewListener(listener, config.TLS)
+	}
+	httpServer := thttp.NewServer(listener, thttp.StandardMiddleware(router))
+
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("http", parallel.Fail, httpServer.Run)
+		spawn("main", parallel.Fail, func(ctx context.Context) error {
+			return runMain(ctx, config, func(handler http.Handler) {
+				serve = handler
+				close(ready)
+			})
+		})
+		return nil
+	})
+}
+
+// runMain serves the database once a usable manifest is published. Passes the
+// handler for the non-admin requests to start when it is ready.
+func runMain(ctx context.Context, config Config, start func(handler http.Handler)) error {
 	upstream := client.NewKafkaClient(config.Kafka)
 	manifest, err := upstream.RetrieveManifest(ctx, true)
 	if err != nil {
@@ -61,6 +204,7 @@ func Run(ctx context.Context, config Config) error {
 		upstream: upstream,
 		master:   upstream.Connect(manifest.Version, wire.Beginning, nil, false),
 		version:  manifest.Version,
+		pushed:   newPushed(),
 	}
 
 	if config.HotStartStorage != "" {
@@ -69,26 +213,129 @@ func Run(ctx context.Context, config Config) error {
 		}
 	}
 
+	if config.CacheSize > 0 {
+		pos, err := cacheStart(ctx, config.Kafka, manifest, config.CacheSize)
+		if err != nil {
+			return err
+		}
+		server.cache = client.NewSplitterWithBuffer(upstream, config.CacheSize)
+		server.cache.Connect(manifest.Version, pos, nil, false)
+	}
+
+	if config.LiveCompaction {
+		server.live = newLiveSet(config.LiveCompactionLimit)
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/pull", server.pull)
 	router.HandleFunc("/push", server.push)
-	httpServer := thttp.NewServer(config.Listener, thttp.StandardMiddleware(router))
+	router.HandleFunc("/events", server.events).Methods(http.MethodGet)
+	router.HandleFunc("/poll", server.poll).Methods(http.MethodGet)
+	start(router)
 
 	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
 		spawn("server", parallel.Fail, server.Run)
-		spawn("http", parallel.Fail, httpServer.Run)
+		if server.cache != nil {
+			// After a mismatch (such as a new manifest) the clients are
+			// served directly from Kafka, see source
+			spawn("cache", parallel.Continue, func(ctx context.Context) error {
+				err := server.cache.Run(ctx)
+				var mismatch wire.ErrMismatch
+				if errors.As(err, &mismatch) {
+					tlog.Get(ctx).Warn("Cache disabled", zap.Error(err))
+					return nil
+				}
+				return err
+			})
+		}
+		if server.live != nil {
+			spawn("live", parallel.Continue, func(ctx context.Context) error {
+				return server.live.run(ctx, server.source(server.version).Connect(server.version, wire.Beginning, nil, false))
+			})
+		}
 		return nil
 	})
 }
 
+// cacheStart returns the position to fill the cache from, so that it gets
+// the last size transactions of the log, or a bit fewer if the log contains
+// padding
+func cacheStart(ctx context.Context, k kafka.Client, manifest wire.Manifest, size int) (wire.Position, error) {
+	history, err := client.NewKafkaClient(k).ManifestHistory(ctx)
+	if err != nil {
+		return wire.Beginning, err
+	}
+	if len(history) == 0 || history[len(history)-1].Manifest.Version != manifest.Version {
+		// A new manifest has been published: the cache will fail anyway
+		return wire.Beginning, nil
+	}
+	next, err := k.LastOffset(ctx, manifest.Topic)
+	if err != nil {
+		return wire.Beginning, err
+	}
+	if next <= int64(size) {
+		return wire.Beginning, nil
+	}
+	// The position of the last transaction before the cached ones
+	return client.KafkaPosition(history[len(history)-1].Offset, next-int64(size)-1), nil
+}
+
 type server struct {
 	upstream client.KafkaClient
 	master   client.Connection
+	cache    *client.Splitter // nil if disabled
+	live     *liveSet         // nil if disabled
 
 	version int
+	pushed  *pushed
+
+	hotStart *hotStartData // downloaded from HotStartStorage, nil if none
+}
 
-	hotStart    map[string][][]byte // kind -> messages
-	hotStartPos wire.Position
+// source returns the client to read the transaction log of the given version
+// from
+func (s server) source(version int) client.Client {
+	if s.cache != nil && version == s.version && s.cache.Err() == nil {
+		return s.cache
+	}
+	return s.upstream
+}
+
+// hotStartData returns the hot start data, or nil if there is none
+func (s server) hotStartData(ctx context.Context) *hotStartData {
+	if s.live != nil {
+		if data := s.live.snapshot(ctx); data != nil {
+			return data
+		}
+	}
+	return s.hotStart
+}
+
+// resumeHotStart returns the hot start data an interrupted hot start has been
+// sent from, possibly by another server
+func (s server) resumeHotStart(ctx context.Context, chunk wire.HotStartChunk) (*hotStartData, error) {
+	if !chunk.Live {
+		if s.hotStart != nil && s.hotStart.pos == chunk.Position {
+			return s.hotStart, nil
+		}
+		return nil, wire.ErrMismatch(fmt.Sprintf("cannot resume hot start at %s: hot start data not available", chunk.Position))
+	}
+	if s.live != nil {
+		if data := s.live.snapshotAt(chunk.Position); data != nil {
+			return data, nil
+		}
+	}
+	// The live state is reproducible: rebuild it at the required position
+	tlog.Get(ctx).Info("Rebuilding live state to resume hot start", zap.String("position", string(chunk.Position)))
+	active, err := replayActive(ctx, s.source(s.version), s.version, chunk.Position)
+	if err != nil {
+		var mismatch wire.ErrMismatch
+		if errors.As(err, &mismatch) {
+			return nil, wire.ErrMismatch(fmt.Sprintf("cannot resume hot start: %s", mismatch))
+		}
+		return nil, err
+	}
+	return activeHotStartData(active, chunk.Position), nil
 }
 
 func (s server) Run(ctx context.Context) error {
@@ -7,7 +7,11 @@ import (
 	"io"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/meta"
 	"github.com/ridge/limestone/tlog"
 	"github.com/ridge/limestone/tws"
 	"github.com/ridge/limestone/wire"
@@ -33,6 +37,9 @@ func (s server) pull(w http.ResponseWriter, r *http.Request) {
 				return err
 			}
 		}
+		for kind, fields := range req.Secrets {
+			meta.RegisterSecrets(kind, fields)
+		}
 		// FIXME (alexey): request field temporarily renamed to limestoneRequest to
 		// work around Elasticsearch restriction that the same field name cannot be
 		// used for a string value in one message and for an object in any other
@@ -40,110 +47,210 @@ func (s server) pull(w http.ResponseWriter, r *http.Request) {
 		logger.Info("Client connected", zap.Any("limestoneRequest", req))
 		defer logger.Info("Client disconnected")
 
-		// 2. Connect to Kafka
-		pos := req.Last
-		if req.Compact && req.Last == wire.Beginning {
-			pos = s.hotStartPos
+		// Tell the client what this server supports
+		hello := wire.Notification{Where: req.Where != nil, Submit: true}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case outgoing <- tws.Message{Data: must.OK1(json.Marshal(hello))}:
 		}
-		conn := s.upstream.Connect(req.Version, pos, req.Filter, req.Compact)
 
-		filter := compileFilter(req.Filter)
-		txns := make(chan *wire.IncomingTransaction)
 		return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
-			spawn("client", parallel.Continue, func(ctx context.Context) error {
-				err := conn.Run(ctx, txns)
-				var mismatch wire.ErrMismatch
-				if errors.As(err, &mismatch) {
+			// 2. Stream the notifications. After a mismatch is reported, wait
+			// for the client to disconnect.
+			spawn("stream", parallel.Continue, func(ctx context.Context) error {
+				return s.stream(ctx, req, func(ctx context.Context, ev event) error {
 					select {
 					case <-ctx.Done():
-						return err
-					case outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Notification{Err: mismatch}))}:
+						return ctx.Err()
+					case outgoing <- tws.Message{Data: ev.data}:
 						return nil
 					}
-				}
-				return err
+				})
 			})
 
-			// 3. Push hot start data, then handle kafka updates
-			spawn("down", parallel.Fail, func(ctx context.Context) error {
-				if req.Compact && req.Version == s.version && req.Last == wire.Beginning {
-					filtered := 0
-					for kind, messages := range s.hotStart {
-						if _, ok := req.Filter[kind]; ok || req.Filter == nil {
-							for _, msg := range messages {
-								select {
-								case <-ctx.Done():
-									return ctx.Err()
-								case outgoing <- tws.Message{Data: msg}:
-									filtered++
-								}
-							}
-						}
-					}
-					if filtered != 0 {
-						logger.Debug("Sent hot start data", zap.Int("filtered", filtered))
-					}
-				}
-
-				hot := false
-				unfiltered := 0
-				filtered := 0
+			// 3. Handle the submitted transactions one by one, so that they
+			// are written and acknowledged in the order of submission
+			spawn("up", parallel.Exit, func(ctx context.Context) error {
 				for {
-					var notification wire.Notification
+					var msg wire.Request
 					select {
 					case <-ctx.Done():
 						return ctx.Err()
-					case txn := <-txns:
-						if txn == nil {
-							if hot {
-								continue
-							}
-							logger.Debug("Filtered a batch of transactions and reached hot end", zap.Int("unfiltered", unfiltered), zap.Int("filtered", filtered))
-							unfiltered = 0
-							filtered = 0
-							notification.Hot = true
-						} else {
-							unfiltered++
-							txn.Changes = filter(txn.Changes)
-							if txn.Changes == nil {
-								continue
-							}
-							filtered++
-							notification.Txn = txn
+					case m, ok := <-incoming:
+						if !ok {
+							return nil
+						}
+						if err := json.Unmarshal(m.Data, &msg); err != nil {
+							return err
 						}
 					}
-
+					if msg.Submit == nil {
+						return errors.New("unexpected message from client")
+					}
+					ack := s.submit(ctx, req.Version, *msg.Submit)
 					select {
 					case <-ctx.Done():
 						return ctx.Err()
-					case outgoing <- tws.Message{Data: must.OK1(json.Marshal(notification))}:
+					case outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Notification{Ack: &ack}))}:
 					}
-
-					hot = notification.Hot
 				}
 			})
 
-			// 4. Watch the incoming stream
-			spawn("up", parallel.Exit, func(ctx context.Context) error {
+			return nil
+		})
+	})
+}
+
+// event is a notification ready to be sent to a client
+type event struct {
+	data []byte        // marshaled wire.Notification
+	pos  wire.Position // position of the transaction, if any
+	hot  bool          // hot end notification
+	err  bool          // mismatch notification, the last one
+}
+
+// stream sends the notifications for the request until ctx is closed or a
+// mismatch is reported (in which case nil is returned)
+func (s server) stream(ctx context.Context, req wire.Request, send func(ctx context.Context, ev event) error) error {
+	logger := tlog.Get(ctx)
+
+	// 1. Connect to Kafka
+	//
+	// Hot start data is not used for subscriptions with predicates: those
+	// need to see the whole history to route each entity. Each such
+	// connection replays the transaction log from the beginning, even when
+	// resumed, and keeps the properties of all entities of the restricted
+	// kinds in memory.
+	hotStart := req.Compact && req.Version == s.version && req.Last == wire.Beginning && req.Where == nil
+	var data *hotStartData
+	next := 0 // number of the first hot start message to send
+	switch {
+	case req.Resume != nil:
+		var err error
+		if hotStart {
+			data, err = s.resumeHotStart(ctx, *req.Resume)
+		} else {
+			err = wire.ErrMismatch("cannot resume hot start: not a hot start request")
+		}
+		var mismatch wire.ErrMismatch
+		if errors.As(err, &mismatch) {
+			return send(ctx, event{data: must.OK1(json.Marshal(wire.Notification{Err: mismatch})), err: true})
+		}
+		if err != nil {
+			return err
+		}
+		next = req.Resume.Seq + 1
+		logger.Info("Resuming hot start", zap.Int("seq", next), zap.String("position", string(data.pos)))
+	case hotStart:
+		data = s.hotStartData(ctx)
+	}
+	hotStartPos := wire.Beginning
+	if data != nil {
+		hotStartPos = data.pos
+	}
+	source := s.source(req.Version)
+	var conn client.Connection
+	switch {
+	case req.Where != nil:
+		conn = client.ConnectWhere(source, req.Version, req.Last, req.Filter, req.Where, req.Compact)
+	case hotStart:
+		conn = source.Connect(req.Version, hotStartPos, req.Filter, req.Compact)
+	default:
+		conn = source.Connect(req.Version, req.Last, req.Filter, req.Compact)
+	}
+
+	filter := wire.CompileFilter(req.Filter)
+	txns := make(chan *wire.IncomingTransaction)
+	return parallel.Run(ctx, func(ctx context.Context, spawn parallel.SpawnFn) error {
+		spawn("client", parallel.Exit, func(ctx context.Context) error {
+			err := conn.Run(ctx, txns)
+			var mismatch wire.ErrMismatch
+			if errors.As(err, &mismatch) {
+				return send(ctx, event{data: must.OK1(json.Marshal(wire.Notification{Err: mismatch})), err: true})
+			}
+			return err
+		})
+
+		// 2. Push hot start data, then handle kafka updates
+		spawn("down", parallel.Fail, func(ctx context.Context) error {
+			if data != nil {
+				filtered := 0
+				for seq := next; seq < len(data.chunks); seq++ {
+					if _, ok := req.Filter[data.chunks[seq].kind]; ok || req.Filter == nil {
+						if err := send(ctx, event{data: data.message(seq)}); err != nil {
+							return err
+						}
+						filtered++
+					}
+				}
+				if filtered != 0 {
+					logger.Debug("Sent hot start data", zap.Int("filtered", filtered))
+				}
+			}
+
+			hot := false
+			unfiltered := 0
+			filtered := 0
+			// The transactions filtered out entirely are sent as
+			// position-only ones. Before the hot end, only the last of them
+			// is sent, right before the hot end marker.
+			skipped := wire.Beginning
+			for {
+				var notification wire.Notification
 				select {
 				case <-ctx.Done():
 					return ctx.Err()
-				case _, ok := <-incoming:
-					if ok {
-						return errors.New("unexpected message from client")
+				case txn := <-txns:
+					if txn == nil {
+						if hot {
+							continue
+						}
+						if skipped != wire.Beginning {
+							ev := event{data: must.OK1(json.Marshal(wire.Notification{Txn: wire.PositionOnly(skipped)})), pos: skipped}
+							if err := send(ctx, ev); err != nil {
+								return err
+							}
+							skipped = wire.Beginning
+						}
+						logger.Debug("Filtered a batch of transactions and reached hot end", zap.Int("unfiltered", unfiltered), zap.Int("filtered", filtered))
+						unfiltered = 0
+						filtered = 0
+						notification.Hot = true
+					} else {
+						unfiltered++
+						txn.Changes = filter(txn.Changes)
+						switch {
+						case txn.Changes != nil:
+							filtered++
+							skipped = wire.Beginning
+						case !hot:
+							skipped = txn.Position
+							continue
+						default:
+							txn = wire.PositionOnly(txn.Position)
+						}
+						notification.Txn = txn
 					}
-					return nil
 				}
-			})
 
-			return nil
+				ev := event{data: must.OK1(json.Marshal(notification)), hot: notification.Hot}
+				if notification.Txn != nil {
+					ev.pos = notification.Txn.Position
+				}
+				if err := send(ctx, ev); err != nil {
+					return err
+				}
+
+				hot = notification.Hot
+			}
 		})
+
+		return nil
 	})
 }
 
 func (s server) push(w http.ResponseWriter, r *http.Request) {
-	logger := tlog.Get(r.Context())
-
 	version, err := strconv.Atoi(r.URL.Query().Get("version"))
 	if err != nil {
 		http.Error(w, "failed to parse required query parameter: version", http.StatusBadRequest)
@@ -164,11 +271,104 @@ func (s server) push(w http.ResponseWriter, r *http.Request) {
 
 	var txn wire.Transaction
 	must.OK(json.Unmarshal(must.OK1(io.ReadAll(r.Body)), &txn))
-	logger.Debug("Submitting transaction", zap.Object("txn", txn))
-	if err := s.master.Submit(r.Context(), txn); err != nil {
-		logger.Error("Failed to submit transaction", zap.Error(err))
+	pos, err := s.write(r.Context(), txn)
+	if err != nil {
 		http.Error(w, "failed to submit transaction", http.StatusInternalServerError)
 		return
 	}
+	if pos != wire.Beginning {
+		w.Header().Set(wire.PositionHeader, string(pos))
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// submit handles a transaction submitted over a WS connection
+func (s server) submit(ctx context.Context, version int, sub wire.Submit) wire.Ack {
+	ack := wire.Ack{ID: sub.ID}
+	if version != s.version {
+		ack.Err = wire.ErrVersionMismatch(version, s.version).Error()
+		return ack
+	}
+	pos, err := s.write(ctx, sub.Txn)
+	if err != nil {
+		ack.Err = "failed to submit transaction"
+		return ack
+	}
+	ack.Position = pos
+	return ack
+}
+
+// write writes a transaction unless it is a retry of a recent one, and returns
+// its position. A retry arriving while the original is being written waits for
+// the outcome.
+func (s server) write(ctx context.Context, txn wire.Transaction) (wire.Position, error) {
+	logger := tlog.Get(ctx)
+
+	key, hasKey := txn.Key()
+	for hasKey {
+		pos, written, inflight := s.pushed.claim(key)
+		if written {
+			logger.Debug("Ignoring retried transaction", zap.Object("txn", txn))
+			return pos, nil
+		}
+		if inflight == nil {
+			break // claimed
+		}
+		select {
+		case <-ctx.Done():
+			return wire.Beginning, ctx.Err()
+		case <-inflight:
+		}
+	}
+	logger.Debug("Submitting transaction", zap.Object("txn", txn))
+	pos, err := s.master.Submit(ctx, txn)
+	if hasKey {
+		s.pushed.finish(key, pos, err == nil)
+	}
+	if err != nil {
+		logger.Error("Failed to submit transaction", zap.Error(err))
+		return wire.Beginning, err
+	}
+	return pos, nil
+}
+
+// pushed remembers the positions of the transactions recently written by push
+// and submit, so that a transaction retried after a lost response is not
+// written twice, as well as the transactions being written
+type pushed struct {
+	mu       sync.Mutex
+	written  *wire.Dedup                   // with the positions, by the time of writing
+	inflight map[wire.TxnKey]chan struct{} // closed when the write is finished
+}
+
+func newPushed() *pushed {
+	return &pushed{written: wire.NewDedup(wire.DedupWindow), inflight: map[wire.TxnKey]chan struct{}{}}
+}
+
+// claim returns the position of the transaction with the given key if it has
+// been written. Otherwise, if the transaction is being written, it returns a
+// channel closed when the write is finished. Otherwise it marks the
+// transaction as being written by the caller, who must call finish.
+func (p *pushed) claim(key wire.TxnKey) (wire.Position, bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pos, ok := p.written.Lookup(key, time.Now()); ok {
+		return pos, true, nil
+	}
+	if ch, ok := p.inflight[key]; ok {
+		return wire.Beginning, false, ch
+	}
+	p.inflight[key] = make(chan struct{})
+	return wire.Beginning, false, nil
+}
+
+// finish records the outcome of the write claimed by claim
+func (p *pushed) finish(key wire.TxnKey, pos wire.Position, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	close(p.inflight[key])
+	delete(p.inflight, key)
+	if ok {
+		p.written.AddAt(key, time.Now(), pos)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/ridge/limestone/client"
 	"github.com/ridge/limestone/kafka"
 	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/meta"
 	"github.com/ridge/limestone/test"
 	"github.com/ridge/limestone/thttp"
 	"github.com/ridge/limestone/tnet"
@@ -30,7 +31,13 @@ type testEnv struct {
 	conns int
 }
 
+const testAdminToken = "secret"
+
 func testSetup(t *testing.T) *testEnv {
+	return testSetupManifest(t, wire.Manifest{Version: 1, Topic: "txlog"})
+}
+
+func testSetupManifest(t *testing.T, manifest wire.Manifest) *testEnv {
 	var env testEnv
 
 	env.group = test.Group(t)
@@ -39,12 +46,16 @@ func testSetup(t *testing.T) *testEnv {
 	env.addr = listener.Addr().String()
 
 	env.kafka = mock.New()
-	require.NoError(t, client.PublishKafkaManifest(env.group.Context(), env.kafka, wire.Manifest{Version: 1, Topic: "txlog"}))
+	require.NoError(t, client.PublishKafkaManifest(env.group.Context(), env.kafka, manifest))
 
 	env.group.Spawn("server", parallel.Fail, func(ctx context.Context) error {
 		return Run(ctx, Config{
-			Listener: listener,
-			Kafka:    env.kafka,
+			Listener:       listener,
+			Kafka:          env.kafka,
+			CacheSize:      1, // small enough to exercise fallback to Kafka
+			LiveCompaction: true,
+			AdminToken:     testAdminToken,
+			AdminInsecure:  true,
 		})
 	})
 
@@ -52,6 +63,10 @@ func testSetup(t *testing.T) *testEnv {
 }
 
 func (env *testEnv) spawnConnection(version int, pos wire.Position, filter wire.Filter) (<-chan *wire.IncomingTransaction, <-chan error) {
+	return env.spawnRequest(wire.Request{Version: version, Last: pos, Filter: filter})
+}
+
+func (env *testEnv) spawnRequest(req wire.Request) (<-chan *wire.IncomingTransaction, <-chan error) {
 	res := make(chan *wire.IncomingTransaction)
 	errors := make(chan error)
 	env.conns++
@@ -61,7 +76,7 @@ func (env *testEnv) spawnConnection(version int, pos wire.Position, filter wire.
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Request{Version: version, Last: pos, Filter: filter}))}:
+			case outgoing <- tws.Message{Data: must.OK1(json.Marshal(req))}:
 			}
 
 			for {
@@ -179,6 +194,146 @@ func TestPull(t *testing.T) {
 	require.EqualError(t, <-errors, wire.ErrContinuityBroken.Error())
 }
 
+func TestPullFilteredOut(t *testing.T) {
+	env := testSetup(t)
+
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn1))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+
+	incoming, _ := env.spawnConnection(1, wire.Beginning, wire.Filter{"apple": nil})
+
+	// Before the hot end, only the last position is sent
+	require.Equal(t, testTxn1.Changes, (<-incoming).Changes)
+	require.Equal(t, wire.PositionOnly("0000000000000000-0000000000000003"), <-incoming)
+	require.Nil(t, <-incoming)
+
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+	require.Equal(t, wire.PositionOnly("0000000000000000-0000000000000004"), <-incoming)
+}
+
+func TestPullCompact(t *testing.T) {
+	env := testSetup(t)
+
+	create := wire.Transaction{
+		Source: testTxn1.Source,
+		Changes: wire.Changes{
+			"apple": wire.KindChanges{
+				"a": wire.Diff{"ID": json.RawMessage(`"a"`), "Color": json.RawMessage(`"red"`)},
+			},
+		},
+	}
+	update := wire.Transaction{
+		Source: testTxn1.Source,
+		Changes: wire.Changes{
+			"apple": wire.KindChanges{
+				"a": wire.Diff{"Color": json.RawMessage(`"green"`), "Size": json.RawMessage(`1`)},
+			},
+		},
+	}
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", create))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", update))
+
+	incoming, _ := env.spawnRequest(wire.Request{Version: 1, Compact: true})
+
+	in := <-incoming
+	require.NotNil(t, in)
+	require.Equal(t, wire.Position(""), in.Position)
+	require.Nil(t, in.TS)
+	require.Equal(t, wire.Changes{
+		"apple": wire.KindChanges{
+			"a": wire.Diff{"ID": json.RawMessage(`"a"`), "Color": json.RawMessage(`"green"`), "Size": json.RawMessage(`1`)},
+		},
+	}, in.Changes)
+	require.Nil(t, <-incoming)
+
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+	in = <-incoming
+	require.Equal(t, wire.Position("0000000000000000-0000000000000002"), in.Position)
+	require.Equal(t, testTxn2.Changes, in.Changes)
+	require.Nil(t, <-incoming)
+}
+
+func TestPullResumeHotStart(t *testing.T) {
+	env := testSetup(t)
+
+	apple := wire.Transaction{
+		Source: testTxn1.Source,
+		Changes: wire.Changes{
+			"apple": wire.KindChanges{"a": wire.Diff{"ID": json.RawMessage(`"a"`)}},
+		},
+	}
+	banana := wire.Transaction{
+		Source: testTxn1.Source,
+		Changes: wire.Changes{
+			"banana": wire.KindChanges{"b": wire.Diff{"ID": json.RawMessage(`"b"`)}},
+		},
+	}
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", banana))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", apple))
+
+	// The hot start messages are ordered by kind: apple is #0, banana is #1
+	incoming, _ := env.spawnRequest(wire.Request{Version: 1, Compact: true, Resume: &wire.HotStartChunk{
+		Position: "0000000000000000-0000000000000001",
+		Live:     true,
+		Seq:      0,
+	}})
+	in := <-incoming
+	require.NotNil(t, in)
+	require.Equal(t, banana.Changes, in.Changes)
+	require.Nil(t, <-incoming)
+
+	_, errors := env.spawnRequest(wire.Request{Version: 1, Compact: true, Resume: &wire.HotStartChunk{
+		Position: "0000000000000000-0000000000000001",
+		Seq:      0,
+	}})
+	require.ErrorContains(t, <-errors, "cannot resume hot start")
+}
+
+func TestLiveSet(t *testing.T) {
+	group := test.Group(t)
+	k := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(group.Context(), k, wire.Manifest{Version: 1, Topic: "txlog"}))
+	publish := func(changes wire.KindChanges) {
+		require.NoError(t, client.PublishKafkaTransaction(group.Context(), k, "txlog", wire.Transaction{
+			Source:  testTxn1.Source,
+			Changes: wire.Changes{"apple": changes},
+		}))
+	}
+	publish(wire.KindChanges{"a": wire.Diff{"ID": json.RawMessage(`"a"`)}, "b": wire.Diff{"ID": json.RawMessage(`"b"`), "List": json.RawMessage(`[1]`)}})
+	publish(wire.KindChanges{"a": wire.RemovedDiff()})
+	// A retried patch is applied once
+	for i := 0; i < 2; i++ {
+		require.NoError(t, client.PublishKafkaTransaction(group.Context(), k, "txlog", wire.Transaction{
+			Source:  testTxn1.Source,
+			Session: 1,
+			Seq:     1,
+			Changes: wire.Changes{"apple": wire.KindChanges{"b": wire.Diff{"List": json.RawMessage(`{"$patch":{"append":[2]}}`)}}},
+		}))
+	}
+
+	ls := newLiveSet(2)
+	done := make(chan error, 1)
+	group.Spawn("live", parallel.Continue, func(ctx context.Context) error {
+		done <- ls.run(ctx, client.NewKafkaClient(k).Connect(1, wire.Beginning, nil, false))
+		return nil
+	})
+
+	// The tombstone deletes the entity
+	data := ls.snapshot(group.Context())
+	require.NotNil(t, data)
+	require.Len(t, data.chunks, 1)
+	require.Contains(t, string(data.chunks[0].txn), `"b"`)
+	require.NotContains(t, string(data.chunks[0].txn), `"a"`)
+	require.Contains(t, string(data.chunks[0].txn), `"List":[1,2]}`)
+
+	// Too many entities: live compaction is disabled
+	publish(wire.KindChanges{"c": wire.Diff{"ID": json.RawMessage(`"c"`)}, "d": wire.Diff{"ID": json.RawMessage(`"d"`)}})
+	require.NoError(t, <-done)
+	require.Nil(t, ls.snapshot(group.Context()))
+}
+
 func TestPullMismatch(t *testing.T) {
 	env := testSetup(t)
 
@@ -205,6 +360,7 @@ func TestPush(t *testing.T) {
 	require.NoError(t, err)
 	defer res.Body.Close()
 	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	require.Equal(t, "0000000000000000-0000000000000000", res.Header.Get(wire.PositionHeader))
 
 	msg := <-messages
 	var txn wire.Transaction
@@ -252,3 +408,193 @@ func TestPushMismatchBackward(t *testing.T) {
 	require.Equal(t, http.StatusConflict, res.StatusCode)
 	require.Equal(t, wire.ErrVersionMismatch(0, 1).Error(), strings.TrimSpace(string(must.OK1(io.ReadAll(res.Body)))))
 }
+
+func TestPushRetried(t *testing.T) {
+	env := testSetup(t)
+
+	messages := make(chan *kafka.IncomingMessage)
+	env.group.Spawn("reader", parallel.Fail, func(ctx context.Context) error {
+		return env.kafka.Read(ctx, "txlog", 0, messages)
+	})
+	require.Nil(t, <-messages)
+
+	txn := testTxn1
+	txn.Seq = 1
+	httpClient := thttp.WithRequestsLogging(&http.Client{})
+	push := func(txn wire.Transaction) string {
+		req, err := http.NewRequestWithContext(env.group.Context(), http.MethodPost, fmt.Sprintf("http://%s/push?version=1", env.addr),
+			bytes.NewReader(must.OK1(json.Marshal(txn))))
+		require.NoError(t, err)
+		res, err := httpClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusNoContent, res.StatusCode)
+		return res.Header.Get(wire.PositionHeader)
+	}
+	require.Equal(t, "0000000000000000-0000000000000000", push(txn))
+	require.Equal(t, "0000000000000000-0000000000000000", push(txn)) // the response to the first one was "lost"
+	txn.Seq = 2
+	require.Equal(t, "0000000000000000-0000000000000001", push(txn))
+
+	next := func() wire.Transaction {
+		for msg := range messages {
+			if msg != nil {
+				var txn wire.Transaction
+				require.NoError(t, json.Unmarshal(msg.Value, &txn))
+				return txn
+			}
+		}
+		panic("unreachable")
+	}
+	require.Equal(t, int64(1), next().Seq)
+	require.Equal(t, int64(2), next().Seq)
+}
+
+func TestPushedInflight(t *testing.T) {
+	p := newPushed()
+	key := wire.TxnKey{Source: testTxn1.Source, Session: 1, Seq: 1}
+
+	_, written, inflight := p.claim(key)
+	require.False(t, written)
+	require.Nil(t, inflight)
+
+	// A retry waits for the original write
+	_, written, inflight = p.claim(key)
+	require.False(t, written)
+	require.NotNil(t, inflight)
+
+	// The write failed: the retry writes the transaction itself
+	p.finish(key, wire.Beginning, false)
+	<-inflight
+	_, written, inflight = p.claim(key)
+	require.False(t, written)
+	require.Nil(t, inflight)
+
+	p.finish(key, "0000000000000000-0000000000000001", true)
+	pos, written, _ := p.claim(key)
+	require.True(t, written)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000001"), pos)
+}
+
+func TestCacheStart(t *testing.T) {
+	env := testSetup(t)
+	ctx := env.group.Context()
+	manifest := wire.Manifest{Version: 1, Topic: "txlog"}
+
+	for _, txn := range []wire.Transaction{testTxn1, testTxn2, testTxn1} {
+		require.NoError(t, client.PublishKafkaTransaction(ctx, env.kafka, "txlog", txn))
+	}
+	pos, err := cacheStart(ctx, env.kafka, manifest, 2)
+	require.NoError(t, err)
+	require.Equal(t, wire.Position("0000000000000000-0000000000000000"), pos)
+	pos, err = cacheStart(ctx, env.kafka, manifest, 3)
+	require.NoError(t, err)
+	require.Equal(t, wire.Beginning, pos)
+
+	// Another manifest
+	pos, err = cacheStart(ctx, env.kafka, wire.Manifest{Version: 2, Topic: "txlog"}, 2)
+	require.NoError(t, err)
+	require.Equal(t, wire.Beginning, pos)
+}
+
+func TestPullWhere(t *testing.T) {
+	env := testSetup(t)
+
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn1))
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+
+	notifications := make(chan wire.Notification)
+	env.group.Spawn("conn", parallel.Continue, func(ctx context.Context) error {
+		return tws.Dial(ctx, fmt.Sprintf("ws://%s/pull", env.addr), nil, tws.StreamerConfig, func(ctx context.Context, incoming <-chan tws.Message, outgoing chan<- tws.Message) error {
+			outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Request{
+				Version: 1,
+				Where:   wire.Where{"apple": {{Prop: "Color", In: []json.RawMessage{json.RawMessage(`"green"`)}}}},
+			}))}
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case msg, ok := <-incoming:
+					if !ok {
+						return nil
+					}
+					var notification wire.Notification
+					must.OK(json.Unmarshal(msg.Data, &notification))
+					notifications <- notification
+				}
+			}
+		})
+	})
+
+	// The predicates are acknowledged first
+	require.Equal(t, wire.Notification{Where: true, Submit: true}, <-notifications)
+	notification := <-notifications
+	require.NotNil(t, notification.Txn)
+	require.Equal(t, testTxn2.Changes, notification.Txn.Changes)
+	require.True(t, (<-notifications).Hot)
+}
+
+func TestSubmitOverWS(t *testing.T) {
+	env := testSetup(t)
+
+	require.NoError(t, client.PublishKafkaTransaction(env.group.Context(), env.kafka, "txlog", testTxn2))
+
+	txn := testTxn1
+	txn.Seq = 1
+	submits := make(chan wire.Submit)
+	acks := make(chan wire.Ack)
+	env.group.Spawn("conn", parallel.Continue, func(ctx context.Context) error {
+		return tws.Dial(ctx, fmt.Sprintf("ws://%s/pull", env.addr), nil, tws.StreamerConfig, func(ctx context.Context, incoming <-chan tws.Message, outgoing chan<- tws.Message) error {
+			outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Request{Version: 1}))}
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case sub := <-submits:
+					outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Request{Submit: &sub}))}
+				case msg, ok := <-incoming:
+					if !ok {
+						return nil
+					}
+					var notification wire.Notification
+					must.OK(json.Unmarshal(msg.Data, &notification))
+					if notification.Ack != nil {
+						acks <- *notification.Ack
+					}
+				}
+			}
+		})
+	})
+
+	submits <- wire.Submit{ID: 7, Txn: txn}
+	require.Equal(t, wire.Ack{ID: 7, Position: "0000000000000000-0000000000000001"}, <-acks)
+	submits <- wire.Submit{ID: 8, Txn: txn} // the ack to the first one was "lost"
+	require.Equal(t, wire.Ack{ID: 8, Position: "0000000000000000-0000000000000001"}, <-acks)
+	txn.Seq = 2
+	submits <- wire.Submit{ID: 9, Txn: txn}
+	require.Equal(t, wire.Ack{ID: 9, Position: "0000000000000000-0000000000000002"}, <-acks)
+}
+
+func TestSecretsFromRequest(t *testing.T) {
+	env := testSetup(t)
+
+	hello := make(chan wire.Notification)
+	env.group.Spawn("conn", parallel.Continue, func(ctx context.Context) error {
+		return tws.Dial(ctx, fmt.Sprintf("ws://%s/pull", env.addr), nil, tws.StreamerConfig, func(ctx context.Context, incoming <-chan tws.Message, outgoing chan<- tws.Message) error {
+			outgoing <- tws.Message{Data: must.OK1(json.Marshal(wire.Request{
+				Version: 1,
+				Secrets: map[string][]string{"server_secret_test": {"pwd"}},
+			}))}
+			var notification wire.Notification
+			must.OK(json.Unmarshal((<-incoming).Data, &notification))
+			hello <- notification
+			<-ctx.Done()
+			return ctx.Err()
+		})
+	})
+
+	<-hello
+	require.True(t, meta.IsSecret("server_secret_test", "pwd"))
+	require.False(t, meta.IsSecret("server_secret_test", "login"))
+	require.False(t, meta.IsSecret("other", "pwd"))
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/run"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/tnet"
+	"github.com/ridge/limestone/wire"
+	"github.com/ridge/must/v2"
+	"github.com/ridge/parallel"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSelfSigned writes a self-signed certificate for 127.0.0.1 and its key
+// into dir
+func writeSelfSigned(t *testing.T, dir string) (certFile, keyFile string) {
+	key := must.OK1(ecdsa.GenerateKey(elliptic.P256(), rand.Reader))
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "limestone-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der := must.OK1(x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key))
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: must.OK1(x509.MarshalECPrivateKey(key))}), 0o600))
+	return certFile, keyFile
+}
+
+func TestTLS(t *testing.T) {
+	group := test.Group(t)
+	certFile, keyFile := writeSelfSigned(t, t.TempDir())
+
+	k := mock.New()
+	require.NoError(t, client.PublishKafkaManifest(group.Context(), k, wire.Manifest{Version: 1, Topic: "txlog"}))
+
+	// The same certificate serves as the server certificate and the client CA
+	serverTLS, err := run.ServerTLSConfig(certFile, keyFile, certFile)
+	require.NoError(t, err)
+	listener := tnet.ListenOnRandomPort()
+	group.Spawn("server", parallel.Fail, func(ctx context.Context) error {
+		return Run(ctx, Config{Listener: listener, Kafka: k, TLS: serverTLS})
+	})
+
+	clientTLS, err := run.TLSConfig(certFile, certFile, keyFile)
+	require.NoError(t, err)
+	c := client.NewWithOptions(listener.Addr().String(), client.Options{
+		TLS:         clientTLS,
+		TokenSource: client.StaticToken("secret"),
+	})
+	conn := c.Connect(1, wire.Beginning, nil, false)
+	incoming := make(chan *wire.IncomingTransaction)
+	group.Spawn("conn", parallel.Fail, func(ctx context.Context) error {
+		return conn.Run(ctx, incoming)
+	})
+	require.Nil(t, <-incoming)
+
+	_, err = conn.Submit(group.Context(), testTxn1)
+	require.NoError(t, err)
+	in := <-incoming
+	require.Equal(t, testTxn1.Changes, in.Changes)
+
+	// A client without a certificate is rejected
+	noCert, err := run.TLSConfig(certFile, "", "")
+	require.NoError(t, err)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: noCert}}
+	req := must.OK1(http.NewRequestWithContext(group.Context(), http.MethodGet, fmt.Sprintf("https://%s/poll?version=1", listener.Addr()), nil))
+	_, err = httpClient.Do(req) //nolint:bodyclose // fails
+	require.Error(t, err)
+
+	_, err = run.ServerTLSConfig(certFile, "", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,106 @@
+package limestone
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ridge/limestone/typeddb"
+)
+
+// ShardKeyFn returns the shard key of an entity. Entities with equal shard
+// keys are owned by the same replica.
+type ShardKeyFn func(entity any) string
+
+// Sharding configures sharded processing across the replicas of a service.
+//
+// Every replica keeps the entire state, but calls WakeUp and schedules
+// Deadline alarms only for the entities it owns. The space of 32-bit FNV-1a
+// hashes of the shard keys is divided into equal contiguous ranges, one per
+// live replica, in the order of their Source.Instance values (which must
+// differ).
+//
+// Each replica announces itself with a membership lease stored in the
+// transaction log, renewed every third of Duration. A replica leaves the
+// group when its lease expires. Whenever the group changes, the ranges are
+// rebalanced and WakeUp is called for all newly owned entities, as on startup.
+// Replicas may briefly disagree on the ownership while they catch up with the
+// transaction log or see a lease expire, so WakeUp must tolerate being called
+// for the same entity by two replicas.
+type Sharding struct {
+	// Name identifies the shard group. Defaults to the producer name.
+	Name string
+
+	// Duration is the time the membership lease is valid for after it has
+	// been renewed. The ranges of a dead replica are reassigned within
+	// Duration.
+	Duration time.Duration
+
+	// Keys optionally specifies a shard key function per kind. The entity ID
+	// is the shard key of the kinds not listed.
+	Keys map[*Kind]ShardKeyFn
+}
+
+// assignment is the ownership of hash ranges as seen by this replica
+type assignment struct {
+	members []string // IDs of the live membership leases, sorted
+	self    int      // index of this replica in members, -1 if absent
+}
+
+func (a assignment) String() string {
+	return fmt.Sprintf("%d/%s", a.self, strings.Join(a.members, ","))
+}
+
+// owns returns true if the shard key falls into the range of this replica
+func (a assignment) owns(key string) bool {
+	if a.self < 0 {
+		return false
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(uint64(h.Sum32())*uint64(len(a.members))>>32) == a.self
+}
+
+// updateAssignment recalculates the assignment from the membership leases
+func (db *DB) updateAssignment() assignment {
+	db.leases.mu.Lock()
+	defer db.leases.mu.Unlock()
+
+	now := db.clock.Now()
+	a := assignment{self: -1}
+	for id, l := range db.leases.byID {
+		if now.Before(l.Expires) {
+			a.members = append(a.members, id)
+		}
+	}
+	sort.Strings(a.members)
+	for i, id := range a.members {
+		if id == db.leases.own && db.holdsLease(db.leases.byID[id]) {
+			a.self = i
+		}
+	}
+	db.assignment = a
+	return a
+}
+
+// owns returns true if this replica is responsible for calling WakeUp and
+// scheduling alarms for the entity
+func (db *DB) owns(eid typeddb.EID, obj any) bool {
+	if db.sharding == nil {
+		return true
+	}
+	key := eid.ID
+	if fn := db.sharding.Keys[eid.Kind]; fn != nil && obj != nil {
+		key = fn(obj)
+	}
+
+	db.leases.mu.Lock()
+	defer db.leases.mu.Unlock()
+	return db.assignment.owns(key)
+}
+
+func shardMemberID(name string, source Source) string {
+	return name + "/" + source.Instance
+}
@@ -0,0 +1,138 @@
+package limestone
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/client"
+	"github.com/ridge/limestone/clock"
+	"github.com/ridge/limestone/kafka/mock"
+	"github.com/ridge/limestone/test"
+	"github.com/ridge/limestone/tlog"
+	"github.com/ridge/limestone/wire"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignment(t *testing.T) {
+	members := []string{"s/1", "s/2", "s/3"}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners := 0
+		for self := range members {
+			if (assignment{members: members, self: self}).owns(key) {
+				owners++
+			}
+		}
+		require.Equal(t, 1, owners, key)
+	}
+	require.False(t, assignment{members: members, self: -1}.owns("key"))
+}
+
+type shardReplica struct {
+	db     *DB
+	cancel context.CancelFunc
+	mu     sync.Mutex
+	woken  map[string]bool
+}
+
+func (r *shardReplica) take() map[string]bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := r.woken
+	r.woken = map[string]bool{}
+	return res
+}
+
+func (r *shardReplica) members() int {
+	r.db.leases.mu.Lock()
+	defer r.db.leases.mu.Unlock()
+	if r.db.assignment.self < 0 {
+		return 0
+	}
+	return len(r.db.assignment.members)
+}
+
+func TestSharding(t *testing.T) {
+	group := test.GroupWithTimeout(t, 10*time.Second)
+	fc := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	k := mock.NewWithClock(fc)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog"))
+
+	waitFor := func(msg string, cond func() bool) {
+		for !cond() {
+			select {
+			case <-group.Context().Done():
+				require.FailNow(t, msg)
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	var replicas []*shardReplica
+	for _, instance := range []string{"1", "2"} {
+		r := &shardReplica{woken: map[string]bool{}}
+		r.db = New(Config{
+			Client:   client.NewKafkaClient(k),
+			Entities: KindList{kindFoo, kindBar},
+			Source:   Source{Producer: "a", Instance: instance},
+			Logger:   tlog.Get(group.Context()),
+			Session:  1,
+			Clock:    fc,
+			Sharding: &Sharding{Duration: leaseDuration},
+			WakeUp: func(ctx context.Context, txn Transaction, entities []any) {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				for _, e := range entities {
+					r.woken[string(e.(foo).ID)] = true
+				}
+			},
+		})
+		ctx, cancel := context.WithCancel(group.Context())
+		r.cancel = cancel
+		go func() {
+			_ = r.db.Run(ctx)
+		}()
+		replicas = append(replicas, r)
+	}
+	a, b := replicas[0], replicas[1]
+	waitFor("replicas have not joined", func() bool { return a.members() == 2 && b.members() == 2 })
+
+	changes := wire.KindChanges{}
+	for i := 0; i < 20; i++ {
+		id := fmt.Sprintf("f%d", i)
+		changes[id] = wire.Diff{"ID": []byte(fmt.Sprintf("%q", id))}
+	}
+	require.NoError(t, client.PublishKafkaTransaction(group.Context(), k, "txlog", wire.Transaction{
+		Changes: wire.Changes{"foo": changes},
+	}))
+	waitFor("entities not woken up", func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(a.woken)+len(b.woken) >= 20
+	})
+	require.NoError(t, a.db.WaitIdle(group.Context()))
+	require.NoError(t, b.db.WaitIdle(group.Context()))
+
+	wokenA, wokenB := a.take(), b.take()
+	require.NotEmpty(t, wokenA)
+	require.NotEmpty(t, wokenB)
+	require.Len(t, wokenA, 20-len(wokenB)) // each entity is woken up by one replica
+	for id := range wokenA {
+		require.False(t, wokenB[id])
+	}
+
+	// Rebalance after replica b dies
+	b.cancel()
+	for i := 0; i < 4 && a.members() != 1; i++ {
+		fc.Advance(leaseDuration / 3)
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor("no rebalance", func() bool { return a.members() == 1 })
+	require.NoError(t, a.db.WaitIdle(group.Context()))
+	require.Len(t, a.take(), 20)
+}
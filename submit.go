@@ -30,6 +30,9 @@ func (db *DB) prepareDiff(eid typeddb.EID, change typeddb.Change) wire.Diff {
 func (db *DB) prepareChanges(changes map[typeddb.EID]typeddb.Change) wire.Changes {
 	res := wire.Changes{}
 	for eid, change := range changes {
+		if db.isDerived(eid.Kind) {
+			continue // derived entities are never exported
+		}
 		diff := db.prepareDiff(eid, change)
 		if diff == nil {
 			continue
@@ -44,14 +47,17 @@ func (db *DB) prepareChanges(changes map[typeddb.EID]typeddb.Change) wire.Change
 	return res
 }
 
-func (db *DB) submit(ctx context.Context, tc typeddb.TransactionControl) error {
+// submit returns the position of the submitted transaction, or wire.Beginning
+// if there is nothing to submit
+func (db *DB) submit(ctx context.Context, tc typeddb.TransactionControl) (wire.Position, error) {
 	changes := db.prepareChanges(tc.Changes())
 	if len(changes) == 0 {
-		return nil
+		return wire.Beginning, nil
 	}
 	wireTransaction := wire.Transaction{
 		Source:  *db.source,
 		Session: db.session,
+		Seq:     db.seq.Add(1),
 		Changes: changes,
 	}
 
@@ -61,9 +67,10 @@ func (db *DB) submit(ctx context.Context, tc typeddb.TransactionControl) error {
 	}
 
 	tlog.Get(ctx).Debug("Submitting transaction", zap.Object("txn", wireTransaction))
-	if err := db.connection.Submit(ctx, wireTransaction); err != nil {
-		return fmt.Errorf("failed to submit transaction: %w", err)
+	pos, err := db.connection.Submit(ctx, wireTransaction)
+	if err != nil {
+		return wire.Beginning, fmt.Errorf("failed to submit transaction: %w", err)
 	}
 
-	return nil
+	return pos, nil
 }
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/typeddb"
+	"github.com/stretchr/testify/assert"
+)
+
+// SnapshotWaiter is a database that can wait for a condition to hold for its
+// snapshot, such as limestone.DB
+type SnapshotWaiter interface {
+	WaitFor(ctx context.Context, cond func(typeddb.Snapshot) bool) (typeddb.Snapshot, error)
+}
+
+// AssertEventually asserts that cond holds for a snapshot of db within the
+// timeout. On failure, the last snapshot checked is included in the message.
+func AssertEventually(t *testing.T, db SnapshotWaiter, timeout time.Duration, cond func(typeddb.Snapshot) bool, msgAndArgs ...any) bool {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(Context(t), timeout)
+	defer cancel()
+
+	snapshot, err := db.WaitFor(ctx, cond)
+	if err != nil {
+		return assert.Fail(t, fmt.Sprintf("condition not satisfied within %s: %v\n%s", timeout, err, formatSnapshot(snapshot)), msgAndArgs...)
+	}
+	return true
+}
+
+// AssertEventuallyField asserts that within the timeout the entity with the
+// given ID has the expected value of the field with the given Go name. The
+// entity kind is deduced from the type of ptr, as in Snapshot.Get. On success,
+// the entity is stored into ptr. On failure, the last value of the entity and
+// the last snapshot checked are included in the message.
+func AssertEventuallyField(t *testing.T, db SnapshotWaiter, timeout time.Duration, id any, ptr any, field string, expected any, msgAndArgs ...any) bool {
+	t.Helper()
+
+	if _, ok := reflect.TypeOf(ptr).Elem().FieldByName(field); !ok {
+		panic(fmt.Sprintf("%T has no field %s", ptr, field))
+	}
+
+	ctx, cancel := context.WithTimeout(Context(t), timeout)
+	defer cancel()
+
+	var found bool
+	snapshot, err := db.WaitFor(ctx, func(snapshot typeddb.Snapshot) bool {
+		found = snapshot.Get(id, ptr)
+		return found && assert.ObjectsAreEqual(expected, reflect.ValueOf(ptr).Elem().FieldByName(field).Interface())
+	})
+	if err == nil {
+		return true
+	}
+
+	last := "not found"
+	if found {
+		last = fmt.Sprintf("%+v", reflect.ValueOf(ptr).Elem().Interface())
+	}
+	return assert.Fail(t, fmt.Sprintf("entity %v never had %s = %#v within %s: %v\nlast value: %s\n%s",
+		id, field, expected, timeout, err, last, formatSnapshot(snapshot)), msgAndArgs...)
+}
+
+func formatSnapshot(snapshot typeddb.Snapshot) string {
+	if snapshot == nil {
+		return "no snapshot: database not ready"
+	}
+
+	kinds, ok := typeddb.LookupSnapshotKinds(snapshot)
+	if !ok { // can't list the entities
+		return fmt.Sprintf("last snapshot: %v", snapshot)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("last snapshot:")
+	for _, kind := range kinds {
+		iter := snapshot.All(kind)
+		ptr := reflect.New(kind.Type)
+		for iter(ptr.Interface()) {
+			fmt.Fprintf(&sb, "\n\t%s %+v", kind.DBName, ptr.Elem().Interface())
+		}
+	}
+	return sb.String()
+}
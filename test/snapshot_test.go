@@ -0,0 +1,70 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/limestone/typeddb"
+	"github.com/stretchr/testify/require"
+)
+
+type itemID string
+
+type item struct {
+	meta.Meta `limestone:"name=item"`
+	ID        itemID `limestone:"identity"`
+	N         int
+}
+
+var kindItem = typeddb.KindOf(item{})
+
+// pollingWaiter is a simple SnapshotWaiter over a TypedDB
+type pollingWaiter struct {
+	tdb *typeddb.TypedDB
+}
+
+func (pw pollingWaiter) WaitFor(ctx context.Context, cond func(typeddb.Snapshot) bool) (typeddb.Snapshot, error) {
+	for {
+		snapshot := pw.tdb.Snapshot()
+		if cond(snapshot) {
+			return snapshot, nil
+		}
+		select {
+		case <-ctx.Done():
+			return snapshot, ctx.Err()
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestAssertEventually(t *testing.T) {
+	tdb := typeddb.New([]*typeddb.Kind{kindItem})
+	db := pollingWaiter{tdb: tdb}
+
+	go func() {
+		for i := 1; i <= 3; i++ {
+			txn, tc := tdb.Transaction()
+			txn.Set(item{ID: "a", N: i})
+			tc.Commit()
+		}
+	}()
+
+	var it item
+	require.True(t, AssertEventuallyField(t, db, time.Second, itemID("a"), &it, "N", 3))
+	require.Equal(t, item{ID: "a", N: 3}, it)
+	require.True(t, AssertEventually(t, db, time.Second, func(snapshot typeddb.Snapshot) bool {
+		return snapshot.Get(itemID("a"), new(item))
+	}))
+
+	require.Equal(t, "last snapshot:\n\titem {Meta:{} ID:a N:3}", formatSnapshot(tdb.Snapshot()))
+	require.Equal(t, "no snapshot: database not ready", formatSnapshot(nil))
+	require.Equal(t, "last snapshot: {<nil> other}", formatSnapshot(otherSnapshot{name: "other"}))
+}
+
+// otherSnapshot is a Snapshot not created by TypedDB
+type otherSnapshot struct {
+	typeddb.Snapshot
+	name string
+}
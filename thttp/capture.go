@@ -6,7 +6,8 @@ import "net/http"
 // The status code will be written into *status.
 //
 // The returned ResponseWriter works the same way as the original one, including
-// the http.Hijacker functionality, if available.
+// the http.Hijacker functionality, if available, and the functionality
+// accessible through http.ResponseController.
 func CaptureStatus(w http.ResponseWriter, status *int) http.ResponseWriter {
 	cs := captureStatus{ResponseWriter: w, status: status}
 	if h, ok := w.(http.Hijacker); ok {
@@ -32,3 +33,8 @@ func (cs captureStatus) WriteHeader(statusCode int) {
 	*cs.status = statusCode
 	cs.ResponseWriter.WriteHeader(statusCode)
 }
+
+// Unwrap is used by http.ResponseController
+func (cs captureStatus) Unwrap() http.ResponseWriter {
+	return cs.ResponseWriter
+}
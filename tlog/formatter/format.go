@@ -148,6 +148,37 @@ func JSONLogMessage(logMessage []byte, prevTimestamp string, color bool) (retOut
 	return buf, ts, nil
 }
 
+// Line formats a record that is not a log message (such as a database
+// transaction) in the same style: timestamp, message and fields ordered by
+// name. Field values are the ones produced by encoding/json for the type any.
+//
+// The timestamp is omitted if empty. prevTimestamp is used the same way as in
+// JSONLogMessage.
+func Line(ts, prevTimestamp, msg string, fields map[string]any, color bool) *buffer.Buffer {
+	buf := bufferPool.Get()
+	style := consoleStyles[color]
+
+	if ts != "" {
+		if dateTimeRx.MatchString(ts) {
+			formatTimestamp(buf, ts, style, prevTimestamp)
+		} else {
+			formatString(buf, ts)
+		}
+		buf.AppendByte(' ')
+	}
+	style(buf, messageColor, msg)
+
+	fieldKeys := maps.Keys(fields)
+	slices.Sort(fieldKeys)
+	for _, field := range fieldKeys {
+		buf.AppendByte(' ')
+		style(buf, fieldColor, field+"=")
+		formatValue(buf, fields[field], style)
+	}
+	buf.AppendByte('\n')
+	return buf
+}
+
 func formatLevel(buf *buffer.Buffer, level string, style styleFn) {
 	switch level {
 	case "debug":
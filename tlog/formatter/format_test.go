@@ -147,3 +147,17 @@ func TestFormatWithPreviousDate(t *testing.T) {
 		})
 	}
 }
+
+func TestLine(t *testing.T) {
+	buffer := Line("2000-01-01T00:00:01Z", "2000-01-01T00:00:00Z", "apple/a", map[string]any{
+		"Color": "red",
+		"Size":  float64(3),
+		"Tags":  []any{"x"},
+	}, false)
+	defer buffer.Free()
+	assert.Equal(t, "2000-01-01T00:00:01Z apple/a Color=\"red\" Size=3 Tags=[\"x\"]\n", buffer.String())
+
+	buffer2 := Line("", "", "apple/a", nil, false)
+	defer buffer2.Free()
+	assert.Equal(t, "apple/a\n", buffer2.String())
+}
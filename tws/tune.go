@@ -6,12 +6,16 @@
 package tws
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
 	"syscall"
 )
 
 func setTCPOption(conn net.Conn, option, value int) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
 	raw, err := conn.(*net.TCPConn).SyscallConn()
 	if err != nil {
 		return fmt.Errorf("failed to set TCP socket option %d: %w", option, err)
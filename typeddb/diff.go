@@ -0,0 +1,236 @@
+package typeddb
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/hashicorp/go-memdb"
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/must/v2"
+)
+
+// DiffEntry describes how an entity differs between two snapshots
+type DiffEntry struct {
+	EID    EID
+	Before any          // nil if the entity has been added
+	After  any          // nil if the entity has been removed
+	Fields []meta.Field // modified fields; nil for added and removed entities
+}
+
+// Added returns true if the entity is present only in the second snapshot
+func (de DiffEntry) Added() bool {
+	return de.Before == nil
+}
+
+// Removed returns true if the entity is present only in the first snapshot
+func (de DiffEntry) Removed() bool {
+	return de.After == nil
+}
+
+// Diff compares two snapshots and returns the entities of the given kinds that
+// have been added, removed or changed from a to b. If no kinds are given, all
+// kinds of the database are compared.
+//
+// An entity is considered changed if any of its fields listed in
+// meta.Struct.Fields differ. Hidden fields are ignored.
+//
+// The result is ordered by kind (in the order given, or by DB name if no kinds
+// are given), then by ID.
+//
+// For snapshots taken from the same TypedDB, the identity index radix trees of
+// the snapshots are walked together, and the subtrees shared by both snapshots
+// are skipped, so the cost depends on the number of changes rather than on the
+// size of the database. Other snapshots are compared entity by entity.
+func Diff(a, b Snapshot, kinds ...*Kind) []DiffEntry {
+	if len(kinds) == 0 {
+		kinds = SnapshotKinds(a)
+	}
+
+	ta, tb := memdbTxn(a), memdbTxn(b)
+	var res []DiffEntry
+	for _, kind := range kinds {
+		if ta != nil && tb != nil {
+			d := treeDiffer{kind: kind, a: ta, b: tb}
+			d.walk("")
+			res = append(res, d.res...)
+		} else {
+			res = append(res, mergeDiff(a, b, kind)...)
+		}
+	}
+	return res
+}
+
+// memdbTxn returns the memdb transaction of a snapshot created by TypedDB, or
+// nil
+func memdbTxn(s Snapshot) *memdb.Txn {
+	switch s := s.(type) {
+	case snapshot:
+		return s.txn
+	case *snapshot:
+		return s.txn
+	case *transaction:
+		return s.txn
+	default:
+		return nil
+	}
+}
+
+// idOf returns the ID of an entity using the encoding of the identity index
+func idOf(kind *Kind, obj any) string {
+	_, key, err := kind.indexSchema["id"].Indexer.(memdb.SingleIndexer).FromObject(obj)
+	must.OK(err)
+	return string(key[:len(key)-1]) // strip the terminating zero
+}
+
+func diffEntry(kind *Kind, before, after any) (DiffEntry, bool) {
+	switch {
+	case before == nil && after == nil:
+		return DiffEntry{}, false
+	case before == nil:
+		return DiffEntry{EID: EID{Kind: kind, ID: idOf(kind, after)}, After: after}, true
+	case after == nil:
+		return DiffEntry{EID: EID{Kind: kind, ID: idOf(kind, before)}, Before: before}, true
+	}
+	fields := diffFields(kind, reflect.ValueOf(before), reflect.ValueOf(after))
+	if fields == nil {
+		return DiffEntry{}, false
+	}
+	return DiffEntry{EID: EID{Kind: kind, ID: idOf(kind, before)}, Before: before, After: after, Fields: fields}, true
+}
+
+// treeDiffer walks the identity index trees of two memdb snapshots.
+//
+// The radix tree nodes are not exposed by memdb, but every node has its own
+// watch channel, which is returned for the prefix query matching the node.
+// Nodes are immutable and shared between the snapshots until modified, so if
+// the watch channels for a prefix are the same in both snapshots, the entities
+// with IDs starting with the prefix are the same too.
+type treeDiffer struct {
+	kind *Kind
+	a, b *memdb.Txn
+	res  []DiffEntry
+}
+
+func (d *treeDiffer) walk(prefix string) {
+	if d.watch(d.a, prefix) == d.watch(d.b, prefix) {
+		return
+	}
+	if prefix != "" {
+		if de, ok := diffEntry(d.kind, d.get(d.a, prefix), d.get(d.b, prefix)); ok {
+			d.res = append(d.res, de)
+		}
+	}
+	// Descend into the subtrees for every next byte of the IDs present in
+	// either snapshot, in order
+	for from := 1; from <= 0xff; {
+		next, ok := d.nextByte(d.a, prefix, byte(from))
+		if nb, okB := d.nextByte(d.b, prefix, byte(from)); okB && (!ok || nb < next) {
+			next, ok = nb, true
+		}
+		if !ok {
+			break
+		}
+		d.walk(prefix + string([]byte{next}))
+		from = int(next) + 1
+	}
+}
+
+func (d *treeDiffer) watch(txn *memdb.Txn, prefix string) <-chan struct{} {
+	return must.OK1(txn.Get(d.kind.DBName, "id_prefix", prefix)).WatchCh()
+}
+
+func (d *treeDiffer) get(txn *memdb.Txn, id string) any {
+	return must.OK1(txn.First(d.kind.DBName, "id", id))
+}
+
+// nextByte returns the smallest byte not less than from that follows the
+// prefix in an ID
+func (d *treeDiffer) nextByte(txn *memdb.Txn, prefix string, from byte) (byte, bool) {
+	obj := must.OK1(txn.LowerBound(d.kind.DBName, "id", prefix+string([]byte{from}))).Next()
+	if obj == nil {
+		return 0, false
+	}
+	id := idOf(d.kind, obj)
+	if len(id) <= len(prefix) || id[:len(prefix)] != prefix {
+		return 0, false
+	}
+	return id[len(prefix)], true
+}
+
+// mergeDiff compares the entities of a kind in two snapshots of any kind,
+// visiting all the entities in identity order
+func mergeDiff(a, b Snapshot, kind *Kind) []DiffEntry {
+	var res []DiffEntry
+	iterA, iterB := a.All(kind), b.All(kind)
+	pa, pb := reflect.New(kind.Type), reflect.New(kind.Type)
+	okA, okB := iterA(pa.Interface()), iterB(pb.Interface())
+	for okA || okB {
+		var idA, idB string
+		if okA {
+			idA = idOf(kind, pa.Elem().Interface())
+		}
+		if okB {
+			idB = idOf(kind, pb.Elem().Interface())
+		}
+		var before, after any
+		switch {
+		case okA && (!okB || idA < idB):
+			before = pa.Elem().Interface()
+			okA = iterA(pa.Interface())
+		case okB && (!okA || idB < idA):
+			after = pb.Elem().Interface()
+			okB = iterB(pb.Interface())
+		default:
+			before, after = pa.Elem().Interface(), pb.Elem().Interface()
+			okA, okB = iterA(pa.Interface()), iterB(pb.Interface())
+		}
+		if de, ok := diffEntry(kind, before, after); ok {
+			res = append(res, de)
+		}
+	}
+	return res
+}
+
+func diffFields(kind *Kind, a, b reflect.Value) []meta.Field {
+	var fields []meta.Field
+	for _, field := range kind.Fields {
+		if !reflect.DeepEqual(a.FieldByIndex(field.Index).Interface(), b.FieldByIndex(field.Index).Interface()) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// SnapshotKinds returns all kinds of the database the snapshot has been taken
+// from, ordered by DB name. It panics if the snapshot has not been created by
+// TypedDB.
+func SnapshotKinds(s Snapshot) []*Kind {
+	kinds, ok := LookupSnapshotKinds(s)
+	if !ok {
+		panic(fmt.Sprintf("unable to list kinds of a snapshot of type %T", s))
+	}
+	return kinds
+}
+
+// LookupSnapshotKinds is like SnapshotKinds, but returns false instead of
+// panicking if the snapshot has not been created by TypedDB
+func LookupSnapshotKinds(s Snapshot) ([]*Kind, bool) {
+	var tdb *TypedDB
+	switch s := s.(type) {
+	case snapshot:
+		tdb = s.tdb
+	case *snapshot:
+		tdb = s.tdb
+	default:
+		return nil, false
+	}
+	kinds := make([]*Kind, 0, len(tdb.byStructType))
+	for _, kind := range tdb.byStructType {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].DBName < kinds[j].DBName
+	})
+	return kinds, true
+}
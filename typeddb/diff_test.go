@@ -0,0 +1,84 @@
+package typeddb
+
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/ridge/limestone/meta"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	db := testEnv()
+	before := db.Snapshot()
+
+	require.Empty(t, Diff(before, db.Snapshot()))
+
+	txn, ctrl := db.Transaction()
+	SetMany(txn,
+		foo{ID: "foo0"},
+		bar{ID: "bar1", FooID: "foo2"},
+		bar{ID: "bar2", FooID: "foo2"},
+	)
+	ctrl.Prune(EID{Kind: kindFoo, ID: "foo1"})
+	ctrl.Commit()
+	after := db.Snapshot()
+
+	fooIDField, _ := kindBar.Field("FooID")
+	require.Equal(t, []DiffEntry{
+		{
+			EID:    EID{Kind: kindBar, ID: "bar1"},
+			Before: bar{ID: "bar1", FooID: "foo1"},
+			After:  bar{ID: "bar1", FooID: "foo2"},
+			Fields: []meta.Field{fooIDField},
+		},
+		{EID: EID{Kind: kindFoo, ID: "foo0"}, After: foo{ID: "foo0"}},
+		{EID: EID{Kind: kindFoo, ID: "foo1"}, Before: foo{ID: "foo1"}},
+	}, Diff(before, after))
+
+	diff := Diff(after, before, kindFoo)
+	require.Len(t, diff, 2)
+	require.True(t, diff[0].Removed())
+	require.Equal(t, "foo0", diff[0].EID.ID)
+	require.True(t, diff[1].Added())
+	require.Equal(t, "foo1", diff[1].EID.ID)
+}
+
+type otherSnapshot struct {
+	Snapshot
+}
+
+func TestDiffRandom(t *testing.T) {
+	db := New([]*Kind{kindFoo, kindBar})
+	rnd := rand.New(rand.NewSource(1))
+	randomID := func() string {
+		return strconv.Itoa(rnd.Intn(300))
+	}
+
+	for i := 0; i < 20; i++ {
+		before := db.Snapshot()
+		txn, ctrl := db.Transaction()
+		for j := 0; j < rnd.Intn(30); j++ {
+			switch rnd.Intn(3) {
+			case 0:
+				txn.Set(bar{ID: barID(randomID()), FooID: fooID(randomID())})
+			case 1:
+				txn.Set(foo{ID: fooID(randomID())})
+			default:
+				ctrl.Prune(EID{Kind: kindBar, ID: randomID()})
+			}
+		}
+		// also compare with a snapshot of the transaction
+		require.Equal(t, Diff(otherSnapshot{before}, otherSnapshot{txn.Snapshot()}, kindBar, kindFoo), Diff(before, txn.Snapshot()))
+		ctrl.Commit()
+		after := db.Snapshot()
+
+		expected := Diff(otherSnapshot{before}, otherSnapshot{after}, kindBar, kindFoo)
+		require.Equal(t, expected, Diff(before, after, kindBar, kindFoo))
+		for _, de := range expected {
+			require.Equal(t, de.Before == nil, !before.Get(de.EID.ID, reflect.New(de.EID.Kind.Type).Interface()))
+		}
+	}
+}
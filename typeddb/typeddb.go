@@ -37,8 +37,14 @@ func (tc TransactionControl) Changes() map[EID]Change {
 // 1. Clears a list of changes that already happened in the transaction.
 // 2. Sets the time that will be returned by `txn.Time()` to the current time.
 func (tc TransactionControl) Reset() {
+	tc.ResetBackdated(time.Now())
+}
+
+// ResetBackdated is a version of Reset that allows the caller to override
+// the transaction timestamp
+func (tc TransactionControl) ResetBackdated(ts time.Time) {
 	tc.txn.changes = map[EID]Change{}
-	tc.txn.ts = time.Now()
+	tc.txn.ts = ts
 }
 
 // Prune removes an element from the in-memory DB
@@ -141,8 +147,14 @@ func (tdb *TypedDB) EIDOf(obj any) EID {
 
 // Snapshot returns a new r/o snapshot of the database.
 func (tdb *TypedDB) Snapshot() Snapshot {
+	return tdb.SnapshotBackdated(time.Now())
+}
+
+// SnapshotBackdated is a version of Snapshot that allows the caller to
+// override the snapshot timestamp that's made visible as `Time()`
+func (tdb *TypedDB) SnapshotBackdated(ts time.Time) Snapshot {
 	r := tdb.memdb.Txn(false)
-	return &snapshot{tdb: tdb, txn: r, ts: time.Now()}
+	return &snapshot{tdb: tdb, txn: r, ts: ts}
 }
 
 // Transaction returns a writable transaction over the DB,
@@ -0,0 +1,46 @@
+package limestone
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ridge/limestone/wire"
+	"github.com/stretchr/testify/require"
+)
+
+type optWhere wire.Where
+
+func (o optWhere) apply(c *Config) {
+	c.Where = wire.Where(o)
+}
+
+func TestWhere(t *testing.T) {
+	k, group := testEnv(t)
+	require.NoError(t, Bootstrap(group.Context(), k, 0, "txlog",
+		foo{fooA: fooA{ID: "f1", A: 1}},
+		foo{fooA: fooA{ID: "f2", A: 2}},
+	))
+
+	a := createDB(k, group, Source{Producer: "a"})
+	b := createDB(k, group, Source{Producer: "b"}, optWhere{
+		"foo": {{Prop: "A", In: []json.RawMessage{json.RawMessage("1"), json.RawMessage("3")}}},
+	})
+
+	_, err := b.WaitFor(group.Context(), func(snapshot Snapshot) bool {
+		return snapshot.Get(fooID("f1"), new(foo))
+	})
+	require.NoError(t, err)
+	require.False(t, b.Snapshot().Get(fooID("f2"), new(foo)))
+
+	require.NoError(t, a.WaitReady(group.Context()))
+	a.Do(func(txn Transaction) {
+		txn.Set(foo{fooA: fooA{ID: "f1", A: 2}})
+		txn.Set(foo{fooA: fooA{ID: "f2", A: 3}})
+	})
+
+	_, err = b.WaitFor(group.Context(), func(snapshot Snapshot) bool {
+		var f foo
+		return !snapshot.Get(fooID("f1"), new(foo)) && snapshot.Get(fooID("f2"), &f) && f.A == 3
+	})
+	require.NoError(t, err)
+}
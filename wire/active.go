@@ -1,6 +1,10 @@
 package wire
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // ActiveSetHeader is the header of the hot start file
 type ActiveSetHeader struct {
@@ -15,3 +19,64 @@ type ActiveObject struct {
 	TS    time.Time // last updated
 	Props Diff
 }
+
+// ActiveSet is the compacted transaction log: the current properties of every
+// object, kind -> ID -> object
+type ActiveSet map[string]map[string]*ActiveObject
+
+// SurviveFn decides whether an object stays in the active set
+type SurviveFn func(object ActiveObject, now time.Time) bool
+
+// Apply applies the transaction to the active set. txn.TS must not be nil.
+// Objects are deleted by RemovedDiff, and by survive unless it is nil.
+//
+// Apply does not recognize retried transactions: drop them with Dedup first,
+// otherwise patches such as appends are applied twice.
+//
+// Changes containing invalid patches are skipped, and an error describing them
+// is returned after the rest of the transaction has been applied.
+func (as ActiveSet) Apply(txn Transaction, now time.Time, survive SurviveFn) error {
+	var errs []error
+	for kind, kindChanges := range txn.Changes {
+		byID := as[kind]
+		if byID == nil {
+			byID = map[string]*ActiveObject{}
+			as[kind] = byID
+		}
+		for id, diff := range kindChanges {
+			if IsRemoved(diff) {
+				delete(byID, id)
+				continue
+			}
+			obj := byID[id]
+			if obj == nil {
+				if _, ok := diff["ID"]; !ok {
+					continue // update to a previously deleted object
+				}
+				obj = &ActiveObject{
+					Kind:  kind,
+					TS:    *txn.TS,
+					Props: Diff{},
+				}
+				byID[id] = obj
+			} else {
+				obj.TS = *txn.TS
+			}
+			for k, v := range diff {
+				if IsPatch(v) {
+					patched, err := ApplyDiffPatch(obj.Props[k], v)
+					if err != nil {
+						errs = append(errs, fmt.Errorf("%s %s field %s: %w", kind, id, k, err))
+						continue
+					}
+					v = patched
+				}
+				obj.Props[k] = v
+			}
+			if survive != nil && !survive(*obj, now) {
+				delete(byID, id)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
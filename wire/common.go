@@ -24,6 +24,6 @@ func (d Diff) Clone() Diff {
 // A ValidateFn receives the index of a field within meta.Struct.Fields
 // along with its old and new values, and has a chance
 // to fail encoding or decoding by returning an error.
-// When creating a new entity, before is a reflection of the zero value
-// of the field type.
+// When creating a new entity, before is a reflection of the default value
+// of the field (the zero value of the field type unless a default is declared).
 type ValidateFn func(index int, before, after reflect.Value) error
@@ -15,13 +15,24 @@ import (
 // copy of the existing entity or a new entity if existing is nil. Const fields
 // can only be modified when existing is nil.
 //
+// When a new entity is created, fields missing from the diff get their default
+// values (see meta.Struct.New).
+//
+// Patches to fields declared with the patch option, including escaped values,
+// are applied to the existing values (see IsPatch). Values of fields declared with the encrypted option are decrypted
+// using the key provider set by SetKeyProvider; plain values written before the
+// field became encrypted are accepted as is.
+//
 // If a validate function is specified, it is called for every modified field;
 // it should return an error if changing the field is not allowed.
 func Decode(metaStruct meta.Struct, existing any, diff Diff, validate ValidateFn) (any, error) {
-	v := reflect.New(metaStruct.Type).Elem()
+	var v reflect.Value
 	z := reflect.Zero(metaStruct.Type)
 	if existing != nil {
+		v = reflect.New(metaStruct.Type).Elem()
 		v.Set(reflect.ValueOf(existing))
+	} else {
+		v = metaStruct.New()
 	}
 
 	changed := false
@@ -31,8 +42,25 @@ func Decode(metaStruct meta.Struct, existing any, diff Diff, validate ValidateFn
 			continue
 		}
 
+		if field.Encrypted && IsEncrypted(raw) {
+			plain, err := decrypt(metaStruct, field, raw)
+			if err != nil {
+				return nil, fmt.Errorf("update decoding failed: field %s of %s: %w", field, metaStruct, err)
+			}
+			raw = plain
+		}
+
 		f := v.FieldByIndex(field.Index)
 		old := f.Interface()
+		if field.Patch && IsPatch(raw) {
+			value, err := json.Marshal(old)
+			if err == nil {
+				raw, err = ApplyPatch(value, raw)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("update decoding failed: field %s of %s: %w", field, metaStruct, err)
+			}
+		}
 		f.Set(z.FieldByIndex(field.Index)) // prevent reuse of maps and structs
 		if err := json.Unmarshal(raw, f.Addr().Interface()); err != nil {
 			return nil, fmt.Errorf("update decoding failed: field %s of %s: %w", field, metaStruct, err)
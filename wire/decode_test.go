@@ -177,3 +177,28 @@ func TestDecodeValidate(t *testing.T) {
 	})
 	require.EqualError(t, err, "update decoding failed: field Field of wire.foo (foo): foo")
 }
+
+func TestDecodeDefault(t *testing.T) {
+	type fooID string
+	type foo struct {
+		meta.Meta `limestone:"name=foo"`
+		ID        fooID  `limestone:"identity"`
+		Count     int    `limestone:"default=3"`
+		Status    string `limestone:"default=new"`
+	}
+	s := meta.Survey(reflect.TypeOf(foo{}))
+
+	res, err := Decode(s, nil, Diff{"ID": json.RawMessage(`"x"`)}, nil)
+	require.NoError(t, err)
+	require.Equal(t, foo{ID: "x", Count: 3, Status: "new"}, res)
+
+	res, err = Decode(s, nil, Diff{"ID": json.RawMessage(`"x"`), "Count": json.RawMessage(`0`)}, nil)
+	require.NoError(t, err)
+	require.Equal(t, foo{ID: "x", Status: "new"}, res)
+
+	current := res
+
+	res, err = Decode(s, current, Diff{"Status": json.RawMessage(`"old"`)}, nil)
+	require.NoError(t, err)
+	require.Equal(t, foo{ID: "x", Status: "old"}, res)
+}
@@ -0,0 +1,117 @@
+package wire
+
+import "time"
+
+// DedupWindow is the default time during which a retried transaction is
+// recognized as a duplicate
+const DedupWindow = 10 * time.Minute
+
+// TxnKey is the idempotency key of a transaction: a submitter assigns
+// increasing sequence numbers to the transactions of its session, so a retried
+// submit has the same key as the original one.
+type TxnKey struct {
+	Source  Source
+	Session int64
+	Seq     int64
+}
+
+// Dedup remembers the keys of recent transactions to recognize duplicates, and
+// optionally their positions.
+//
+// The keys are forgotten after the window expires. The readers of the
+// transaction log should use the transaction timestamps as the time, so that
+// all of them make the same decisions.
+//
+// A Dedup only knows the transactions it has been shown. A reader that starts
+// in the middle of the log, such as a DB that receives a compacted hot start
+// from the server, does not recognize a retry of a transaction written before
+// its starting position and applies it again. Retries are only submitted for a
+// short time after the original, so such duplicates are possible only near the
+// starting position, and only for transactions whose acknowledgement was lost.
+//
+// Not safe for concurrent use.
+type Dedup struct {
+	window time.Duration
+	seen   map[TxnKey]dedupSeen
+	order  []dedupEntry // by time of insertion
+}
+
+type dedupSeen struct {
+	ts  time.Time
+	pos Position
+}
+
+type dedupEntry struct {
+	key TxnKey
+	ts  time.Time
+}
+
+// NewDedup creates a Dedup with the given window
+func NewDedup(window time.Duration) *Dedup {
+	return &Dedup{
+		window: window,
+		seen:   map[TxnKey]dedupSeen{},
+	}
+}
+
+// Check returns true if the key has been seen within the window before ts.
+// Otherwise it remembers the key.
+func (d *Dedup) Check(key TxnKey, ts time.Time) bool {
+	if d.Seen(key, ts) {
+		return true
+	}
+	d.Add(key, ts)
+	return false
+}
+
+// Seen returns true if the key has been seen within the window before ts
+func (d *Dedup) Seen(key TxnKey, ts time.Time) bool {
+	_, ok := d.Lookup(key, ts)
+	return ok
+}
+
+// Lookup is Seen also returning the position remembered with the key by
+// AddAt (Beginning if none)
+func (d *Dedup) Lookup(key TxnKey, ts time.Time) (Position, bool) {
+	d.expire(ts)
+	seen, ok := d.seen[key]
+	return seen.pos, ok
+}
+
+// Add remembers the key as seen at ts
+func (d *Dedup) Add(key TxnKey, ts time.Time) {
+	d.AddAt(key, ts, Beginning)
+}
+
+// AddAt remembers the key as seen at ts, with the position of the transaction
+func (d *Dedup) AddAt(key TxnKey, ts time.Time, pos Position) {
+	d.expire(ts)
+	if _, ok := d.seen[key]; ok {
+		return
+	}
+	d.seen[key] = dedupSeen{ts: ts, pos: pos}
+	d.order = append(d.order, dedupEntry{key: key, ts: ts})
+}
+
+// CheckTxn is Check for transactions with timestamps. Transactions without keys
+// or timestamps are never duplicates.
+func (d *Dedup) CheckTxn(txn Transaction) bool {
+	key, ok := txn.Key()
+	if !ok || txn.TS == nil {
+		return false
+	}
+	return d.Check(key, *txn.TS)
+}
+
+func (d *Dedup) expire(now time.Time) {
+	n := 0
+	for n < len(d.order) && now.Sub(d.order[n].ts) > d.window {
+		if d.seen[d.order[n].key].ts == d.order[n].ts {
+			delete(d.seen, d.order[n].key)
+		}
+		n++
+	}
+	if n != 0 {
+		d.order = d.order[n:]
+	}
+}
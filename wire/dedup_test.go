@@ -0,0 +1,37 @@
+package wire
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d := NewDedup(time.Minute)
+	k1 := TxnKey{Source: Source{Producer: "a"}, Session: 1, Seq: 1}
+	k2 := TxnKey{Source: Source{Producer: "a"}, Session: 1, Seq: 2}
+
+	require.False(t, d.Check(k1, t0))
+	require.False(t, d.Check(k2, t0.Add(time.Second)))
+	require.True(t, d.Check(k1, t0.Add(time.Minute)))
+	require.False(t, d.Check(k1, t0.Add(time.Minute+time.Second))) // expired
+	require.True(t, d.Seen(k1, t0.Add(time.Minute+2*time.Second)))
+
+	d.AddAt(k2, t0.Add(2*time.Minute), "0000000000000000-0000000000000001")
+	pos, ok := d.Lookup(k2, t0.Add(2*time.Minute))
+	require.True(t, ok)
+	require.Equal(t, Position("0000000000000000-0000000000000001"), pos)
+	_, ok = d.Lookup(k2, t0.Add(3*time.Minute+time.Second)) // expired
+	require.False(t, ok)
+
+	txn := Transaction{Source: k2.Source, Session: k2.Session}
+	require.False(t, d.CheckTxn(txn)) // no key
+	txn.Seq = k2.Seq
+	require.False(t, d.CheckTxn(txn)) // no timestamp
+	ts := t0.Add(4 * time.Minute)
+	txn.TS = &ts
+	require.False(t, d.CheckTxn(txn))
+	require.True(t, d.CheckTxn(txn))
+}
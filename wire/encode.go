@@ -13,14 +13,26 @@ import (
 //
 // Returns nil if there is no difference.
 //
+// When before is nil, all fields except those equal both to their zero and
+// default values (see meta.Struct.New) are encoded, so the created entity does
+// not change if the defaults are changed later.
+//
+// For an existing entity, modified fields declared with the patch option are
+// encoded as patches when that is more compact. Values of such fields that look
+// like patches are escaped (see EscapePatch).
+//
+// Fields declared with the encrypted option are encrypted using the key
+// provider set by SetKeyProvider.
+//
 // If a validate function is specified, it is called for every modified field;
 // it should return an error if changing the field is not allowed.
 func Encode(metaStruct meta.Struct, before, after any, validate ValidateFn) (Diff, error) {
-	var v1 reflect.Value
+	var v1, z reflect.Value
 	if before != nil {
 		v1 = reflect.ValueOf(before)
 	} else {
-		v1 = reflect.Zero(metaStruct.Type)
+		v1 = metaStruct.New()
+		z = reflect.Zero(metaStruct.Type)
 	}
 	v2 := reflect.ValueOf(after)
 	if v1.Type() != metaStruct.Type || v2.Type() != metaStruct.Type {
@@ -33,7 +45,7 @@ func Encode(metaStruct meta.Struct, before, after any, validate ValidateFn) (Dif
 		f2 := v2.FieldByIndex(field.Index)
 		i1 := f1.Interface()
 		i2 := f2.Interface()
-		if reflect.DeepEqual(i1, i2) {
+		if reflect.DeepEqual(i1, i2) && (before != nil || reflect.DeepEqual(z.FieldByIndex(field.Index).Interface(), i2)) {
 			continue
 		}
 		if field.Const && before != nil {
@@ -48,6 +60,21 @@ func Encode(metaStruct meta.Struct, before, after any, validate ValidateFn) (Dif
 		if err != nil {
 			return nil, fmt.Errorf("update encoding failed: field %s of %s: %w", field, metaStruct, err)
 		}
+		patched := false
+		if field.Patch && before != nil {
+			if p, ok := makePatch(f1, f2, raw); ok {
+				raw, patched = p, true
+			}
+		}
+		if field.Patch && !patched {
+			raw = EscapePatch(raw)
+		}
+		if field.Encrypted {
+			raw, err = encrypt(metaStruct, field, raw)
+			if err != nil {
+				return nil, fmt.Errorf("update encoding failed: field %s of %s: %w", field, metaStruct, err)
+			}
+		}
 		if diff == nil {
 			diff = Diff{}
 		}
@@ -244,3 +244,26 @@ func TestEncodeValidate(t *testing.T) {
 		})
 	require.NoError(t, err)
 }
+
+func TestEncodeDefault(t *testing.T) {
+	type fooID string
+	type foo struct {
+		meta.Meta `limestone:"name=foo"`
+		ID        fooID  `limestone:"identity"`
+		Count     int    `limestone:"default=3"`
+		Status    string `limestone:"default=new"`
+	}
+	s := meta.Survey(reflect.TypeOf(foo{}))
+
+	res, err := Encode(s, nil, foo{ID: "x", Count: 3, Status: "new"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, Diff{"ID": json.RawMessage(`"x"`), "Count": json.RawMessage(`3`), "Status": json.RawMessage(`"new"`)}, res)
+
+	res, err = Encode(s, nil, foo{ID: "x"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, Diff{"ID": json.RawMessage(`"x"`), "Count": json.RawMessage(`0`), "Status": json.RawMessage(`""`)}, res)
+
+	res, err = Encode(s, foo{ID: "x", Count: 3}, foo{ID: "x", Count: 3, Status: "new"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, Diff{"Status": json.RawMessage(`"new"`)}, res)
+}
@@ -1,10 +1,13 @@
-package server
+package wire
 
-import "github.com/ridge/limestone/wire"
-
-func compileFilter(filter wire.Filter) func(wire.Changes) wire.Changes {
+// CompileFilter returns a function that strips the changes not matching the
+// filter. The function returns nil if nothing is left.
+//
+// Diffs removing entities (see RemovedDiff) are kept for every kind selected
+// by the filter.
+func CompileFilter(filter Filter) func(Changes) Changes {
 	if filter == nil {
-		return func(changes wire.Changes) wire.Changes {
+		return func(changes Changes) Changes {
 			return changes
 		}
 	}
@@ -22,8 +25,8 @@ func compileFilter(filter wire.Filter) func(wire.Changes) wire.Changes {
 		}
 	}
 
-	return func(changes wire.Changes) wire.Changes {
-		res := wire.Changes{}
+	return func(changes Changes) Changes {
+		res := Changes{}
 		for kind, byID := range changes {
 			props, ok := prepared[kind]
 			switch {
@@ -32,9 +35,13 @@ func compileFilter(filter wire.Filter) func(wire.Changes) wire.Changes {
 			case props == nil:
 				res[kind] = byID
 			default:
-				newByID := wire.KindChanges{}
+				newByID := KindChanges{}
 				for id, diff := range byID {
-					newDiff := wire.Diff{}
+					if IsRemoved(diff) {
+						newByID[id] = diff
+						continue
+					}
+					newDiff := Diff{}
 					for prop, value := range diff {
 						if props[prop] {
 							newDiff[prop] = value
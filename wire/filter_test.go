@@ -0,0 +1,46 @@
+package wire
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilter(t *testing.T) {
+	changes := Changes{
+		"apple": KindChanges{
+			"a": Diff{
+				"Color": json.RawMessage(`"red"`),
+				"Size":  json.RawMessage(`1`),
+			},
+			"b": Diff{
+				"Size": json.RawMessage(`2`),
+			},
+		},
+		"orange": KindChanges{
+			"a": Diff{
+				"Color": json.RawMessage(`"orange"`),
+				"Mass":  json.RawMessage(`3`),
+			},
+			"b": Diff{
+				"Mass": json.RawMessage(`4`),
+			},
+		},
+	}
+
+	require.Equal(t, changes, CompileFilter(nil)(changes))
+	require.Equal(t, Changes{"apple": changes["apple"]},
+		CompileFilter(Filter{"apple": nil, "kiwi": nil})(changes))
+	require.Nil(t, CompileFilter(Filter{"kiwi": nil})(changes))
+	require.Equal(t, Changes{
+		"orange": KindChanges{
+			"a": Diff{
+				"Color": json.RawMessage(`"orange"`),
+			},
+		},
+	}, CompileFilter(Filter{
+		"apple":  []string{"Shape"},
+		"orange": []string{"Shape", "Color"},
+	})(changes))
+}
@@ -3,6 +3,7 @@ package wire
 import (
 	"sort"
 
+	"github.com/ridge/limestone/meta"
 	"github.com/ridge/must/v2"
 	"go.uber.org/zap/zapcore"
 )
@@ -25,6 +26,9 @@ func (txn Transaction) MarshalLogObject(e zapcore.ObjectEncoder) error {
 	}
 	must.OK(e.AddObject("source", txn.Source))
 	e.AddInt64("session", txn.Session)
+	if txn.Seq != 0 {
+		e.AddInt64("seq", txn.Seq)
+	}
 	must.OK(e.AddObject("changes", txn.Changes))
 	if txn.Audit != nil {
 		e.AddString("audit", string(txn.Audit))
@@ -38,45 +42,83 @@ func (txn IncomingTransaction) MarshalLogObject(e zapcore.ObjectEncoder) error {
 	return txn.Transaction.MarshalLogObject(e)
 }
 
+// Placeholders for values of secret and encrypted fields in logs
+const (
+	redactedForLog  = "[redacted]"
+	encryptedForLog = "[encrypted]"
+)
+
 // MarshalLogObject implements zapcore.ObjectMarshaler to allow logging of Changes with zap.Object
 func (c Changes) MarshalLogObject(e zapcore.ObjectEncoder) error {
 	for kind, byID := range c {
-		must.OK(e.AddArray(kind, byID))
+		must.OK(e.AddArray(kind, kindChangesForLog{kind: kind, kc: byID}))
 	}
 	return nil
 }
 
 type kindChangesForLog struct {
+	kind string
+	kc   KindChanges
+}
+
+func (kcfl kindChangesForLog) MarshalLogArray(e zapcore.ArrayEncoder) error {
+	ids := make([]string, 0, len(kcfl.kc))
+	for id := range kcfl.kc {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		must.OK(e.AppendObject(diffForLog{kind: kcfl.kind, id: id, diff: kcfl.kc[id]}))
+	}
+	return nil
+}
+
+type diffForLog struct {
+	kind string
 	id   string
 	diff Diff
 }
 
-func (kcfl kindChangesForLog) MarshalLogObject(e zapcore.ObjectEncoder) error {
-	e.AddString("id", kcfl.id)
-	return e.AddObject("diff", kcfl.diff)
+func (dfl diffForLog) MarshalLogObject(e zapcore.ObjectEncoder) error {
+	e.AddString("id", dfl.id)
+	return e.AddObject("diff", redactedDiff{kind: dfl.kind, diff: dfl.diff})
 }
 
-// MarshalLogArray implements zapcore.ArrayMarshaler to allow logging of KindChanges with zap.Object
-func (kc KindChanges) MarshalLogArray(e zapcore.ArrayEncoder) error {
-	kcfls := make([]kindChangesForLog, 0, len(kc))
-	for id, diff := range kc {
-		kcfls = append(kcfls, kindChangesForLog{id, diff})
-	}
-	sort.Slice(kcfls, func(i, j int) bool {
-		return kcfls[i].id < kcfls[j].id
-	})
-	for _, kcfl := range kcfls {
-		must.OK(e.AppendObject(kcfl))
+// redactedDiff hides the values of fields declared secret (see meta.IsSecret)
+// and of encrypted fields
+type redactedDiff struct {
+	kind string // empty if unknown
+	diff Diff
+}
+
+func (rd redactedDiff) MarshalLogObject(e zapcore.ObjectEncoder) error {
+	for prop, value := range rd.diff {
+		switch {
+		case IsEncrypted(value):
+			e.AddString(prop, encryptedForLog)
+		case meta.IsSecret(rd.kind, prop):
+			e.AddString(prop, redactedForLog)
+		default:
+			e.AddString(prop, string(value))
+		}
 	}
 	return nil
 }
 
-// MarshalLogObject implements zapcore.ObjectMarshaler to allow logging of Diff with zap.Object
+// MarshalLogArray implements zapcore.ArrayMarshaler to allow logging of KindChanges with zap.Object.
+//
+// Since the kind is unknown, only encrypted values are redacted. Log Changes
+// to have secret fields redacted as well.
+func (kc KindChanges) MarshalLogArray(e zapcore.ArrayEncoder) error {
+	return kindChangesForLog{kc: kc}.MarshalLogArray(e)
+}
+
+// MarshalLogObject implements zapcore.ObjectMarshaler to allow logging of Diff with zap.Object.
+//
+// Since the kind is unknown, only encrypted values are redacted. Log Changes
+// to have secret fields redacted as well.
 func (d Diff) MarshalLogObject(e zapcore.ObjectEncoder) error {
-	for prop, value := range d {
-		e.AddString(prop, string(value))
-	}
-	return nil
+	return redactedDiff{diff: d}.MarshalLogObject(e)
 }
 
 // MarshalLogObject implements zapcore.ObjectMarshaler to allow logging of Notification with zap.Object
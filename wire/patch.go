@@ -0,0 +1,242 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/ridge/must/v2"
+)
+
+// A patch is an alternative representation of a new field value in a Diff,
+// used for fields declared with the patch option. Instead of the entire new
+// value, it describes how to obtain it from the old one.
+//
+// A patch is an object with the single key "$patch". A map field patch is a
+// shallow JSON merge patch:
+//
+//	{"$patch": {"merge": {"added": 1, "changed": 2, "deleted": null}}}
+//
+// A slice field patch lists the elements to be removed (the first equal element
+// for each entry) followed by the elements to be appended:
+//
+//	{"$patch": {"remove": ["a"], "append": ["b", "c"]}}
+//
+// A value of a patch field that looks like a patch itself is escaped by Encode
+// as
+//
+//	{"$patch": {"set": VALUE}}
+//
+// so a patch can never be confused with a field value. The values of other
+// fields are never treated as patches by Decode.
+type patch struct {
+	Set    json.RawMessage            `json:"set,omitempty"`
+	Merge  map[string]json.RawMessage `json:"merge,omitempty"`
+	Remove []json.RawMessage          `json:"remove,omitempty"`
+	Append []json.RawMessage          `json:"append,omitempty"`
+}
+
+type patchEnvelope struct {
+	Patch *patch `json:"$patch"`
+}
+
+var null = json.RawMessage("null")
+
+// IsPatch returns true if the raw value of a field in a Diff is a patch rather
+// than an entire new value. The patch may still be invalid (see ApplyPatch).
+func IsPatch(raw json.RawMessage) bool {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '{' {
+		return false
+	}
+	var ops map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &ops); err != nil || len(ops) != 1 {
+		return false
+	}
+	_, ok := ops["$patch"]
+	return ok
+}
+
+// EscapePatch returns the raw value of a field, escaped if it looks like a
+// patch
+func EscapePatch(raw json.RawMessage) json.RawMessage {
+	if !IsPatch(raw) {
+		return raw
+	}
+	return must.OK1(json.Marshal(patchEnvelope{Patch: &patch{Set: raw}}))
+}
+
+// parsePatch parses and validates a patch
+func parsePatch(raw json.RawMessage) (patch, error) {
+	var env patchEnvelope
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&env); err != nil {
+		return patch{}, fmt.Errorf("invalid patch %s: %w", raw, err)
+	}
+	if env.Patch == nil {
+		return patch{}, fmt.Errorf("invalid patch %s: no operations", raw)
+	}
+	p := *env.Patch
+	ops := 0
+	if p.Set != nil {
+		ops++
+	}
+	if p.Merge != nil {
+		ops++
+	}
+	if p.Remove != nil || p.Append != nil {
+		ops++
+	}
+	if ops != 1 {
+		return patch{}, fmt.Errorf("invalid patch %s: exactly one of set, merge or remove/append expected", raw)
+	}
+	return p, nil
+}
+
+// ApplyPatch applies a patch to the raw value of a map or slice field and
+// returns the raw new value. The empty or null value is treated as an empty
+// map or slice. Returns an error if the patch is invalid or does not apply to
+// the value.
+func ApplyPatch(value, raw json.RawMessage) (json.RawMessage, error) {
+	p, err := parsePatch(raw)
+	if err != nil {
+		return nil, err
+	}
+	if p.Set != nil {
+		return p.Set, nil
+	}
+	if len(value) == 0 {
+		value = null
+	}
+
+	if p.Merge != nil {
+		var m map[string]json.RawMessage
+		if err := json.Unmarshal(value, &m); err != nil {
+			return nil, fmt.Errorf("failed to apply merge patch: %w", err)
+		}
+		if m == nil {
+			m = map[string]json.RawMessage{}
+		}
+		for k, v := range p.Merge {
+			if bytes.Equal(bytes.TrimSpace(v), null) {
+				delete(m, k)
+			} else {
+				m[k] = v
+			}
+		}
+		return json.Marshal(m)
+	}
+
+	var s []json.RawMessage
+	if err := json.Unmarshal(value, &s); err != nil {
+		return nil, fmt.Errorf("failed to apply slice patch: %w", err)
+	}
+	if s == nil {
+		s = []json.RawMessage{}
+	}
+	for _, r := range p.Remove {
+		for i, el := range s {
+			if sameJSON(el, r) {
+				s = append(s[:i:i], s[i+1:]...)
+				break
+			}
+		}
+	}
+	s = append(s, p.Append...)
+	return json.Marshal(s)
+}
+
+// ApplyDiffPatch is ApplyPatch for a value kept in the form of a Diff, such as
+// the compacted props of an entity: the value may be escaped, and so is the
+// result (see EscapePatch)
+func ApplyDiffPatch(value, raw json.RawMessage) (json.RawMessage, error) {
+	if IsPatch(value) {
+		if p, err := parsePatch(value); err == nil && p.Set != nil {
+			value = p.Set
+		}
+	}
+	res, err := ApplyPatch(value, raw)
+	if err != nil {
+		return nil, err
+	}
+	return EscapePatch(res), nil
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	var ca, cb bytes.Buffer
+	if json.Compact(&ca, a) != nil || json.Compact(&cb, b) != nil {
+		return false
+	}
+	return bytes.Equal(ca.Bytes(), cb.Bytes())
+}
+
+// makePatch returns a patch that transforms the old value of a map or slice
+// field into the new one, or false if the entire new value should be sent
+// instead (because the values are not patchable or the patch is not smaller)
+func makePatch(before, after reflect.Value, full json.RawMessage) (json.RawMessage, bool) {
+	if before.IsNil() || after.IsNil() {
+		return nil, false
+	}
+	old, err := json.Marshal(before.Interface())
+	if err != nil {
+		return nil, false
+	}
+
+	var p patch
+	switch after.Kind() {
+	case reflect.Map:
+		var m1, m2 map[string]json.RawMessage
+		if json.Unmarshal(old, &m1) != nil || json.Unmarshal(full, &m2) != nil {
+			return nil, false
+		}
+		p.Merge = map[string]json.RawMessage{}
+		for k, v := range m2 {
+			if bytes.Equal(v, null) {
+				return nil, false // null means deletion in a merge patch
+			}
+			if !bytes.Equal(m1[k], v) {
+				p.Merge[k] = v
+			}
+		}
+		for k := range m1 {
+			if _, ok := m2[k]; !ok {
+				p.Merge[k] = null
+			}
+		}
+	case reflect.Slice:
+		var s1, s2 []json.RawMessage
+		if json.Unmarshal(old, &s1) != nil || json.Unmarshal(full, &s2) != nil {
+			return nil, false
+		}
+		j := 0
+		for _, el := range s1 {
+			if j < len(s2) && bytes.Equal(el, s2[j]) {
+				j++
+			} else {
+				p.Remove = append(p.Remove, el)
+			}
+		}
+		p.Append = s2[j:]
+	default:
+		return nil, false
+	}
+	if len(p.Merge) == 0 && len(p.Remove) == 0 && len(p.Append) == 0 {
+		return nil, false
+	}
+
+	raw, err := json.Marshal(patchEnvelope{Patch: &p})
+	if err != nil || len(raw) >= len(full) {
+		return nil, false
+	}
+	// Removal by value is ambiguous when the slice contains duplicates, so
+	// make sure that the patch produces exactly the new value
+	if res, err := ApplyPatch(old, raw); err != nil || !bytes.Equal(res, full) {
+		return nil, false
+	}
+	return raw, true
+}
@@ -0,0 +1,171 @@
+package wire
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ridge/limestone/meta"
+	"github.com/ridge/must/v2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPatch(t *testing.T) {
+	require.False(t, IsPatch(json.RawMessage(`null`)))
+	require.False(t, IsPatch(json.RawMessage(`[1,2]`)))
+	require.False(t, IsPatch(json.RawMessage(`{}`)))
+	require.False(t, IsPatch(json.RawMessage(`{"a":1}`)))
+	require.False(t, IsPatch(json.RawMessage(`{"$merge":{"a":1}}`)))
+	require.False(t, IsPatch(json.RawMessage(`{"$patch":{"merge":{"a":1}},"a":1}`)))
+	require.True(t, IsPatch(json.RawMessage(`{"$patch":{"merge":{"a":1}}}`)))
+	require.True(t, IsPatch(json.RawMessage(`{"$patch":{"append":[1]}}`)))
+	require.True(t, IsPatch(json.RawMessage(`{"$patch":5}`))) // invalid, see ApplyPatch
+}
+
+func TestApplyPatch(t *testing.T) {
+	res, err := ApplyPatch(json.RawMessage(`{"a":1,"b":2}`), json.RawMessage(`{"$patch":{"merge":{"b":null,"c":3}}}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1,"c":3}`, string(res))
+
+	res, err = ApplyPatch(nil, json.RawMessage(`{"$patch":{"merge":{"a":1}}}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"a":1}`, string(res))
+
+	res, err = ApplyPatch(json.RawMessage(`[1,2,1,3]`), json.RawMessage(`{"$patch":{"remove":[1,4],"append":[5]}}`))
+	require.NoError(t, err)
+	require.Equal(t, `[2,1,3,5]`, string(res))
+
+	res, err = ApplyPatch(json.RawMessage(`null`), json.RawMessage(`{"$patch":{"append":["a"]}}`))
+	require.NoError(t, err)
+	require.Equal(t, `["a"]`, string(res))
+
+	res, err = ApplyPatch(json.RawMessage(`[1]`), json.RawMessage(`{"$patch":{"set":{"$patch":1}}}`))
+	require.NoError(t, err)
+	require.Equal(t, `{"$patch":1}`, string(res))
+
+	_, err = ApplyPatch(json.RawMessage(`[1]`), json.RawMessage(`{"$patch":{"merge":{"a":1}}}`))
+	require.Error(t, err)
+
+	for _, invalid := range []string{
+		`{"$patch":5}`,
+		`{"$patch":null}`,
+		`{"$patch":{}}`,
+		`{"$patch":{"remove":5}}`,
+		`{"$patch":{"merge":{"a":1},"append":[1]}}`,
+		`{"$patch":{"insert":[1]}}`,
+	} {
+		_, err = ApplyPatch(json.RawMessage(`[1]`), json.RawMessage(invalid))
+		require.ErrorContains(t, err, "invalid patch", invalid)
+	}
+}
+
+func TestActiveSetInvalidPatch(t *testing.T) {
+	ts := time.Now()
+	as := ActiveSet{}
+	require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{
+		"foo": KindChanges{"x": Diff{"ID": json.RawMessage(`"x"`), "List": json.RawMessage(`[1]`)}},
+	}}, ts, nil))
+	err := as.Apply(Transaction{TS: &ts, Changes: Changes{
+		"foo": KindChanges{"x": Diff{"List": json.RawMessage(`{"$patch":{"remove":5}}`), "Other": json.RawMessage(`2`)}},
+	}}, ts, nil)
+	require.ErrorContains(t, err, "foo x field List: invalid patch")
+	require.Equal(t, Diff{"ID": json.RawMessage(`"x"`), "List": json.RawMessage(`[1]`), "Other": json.RawMessage(`2`)}, as["foo"]["x"].Props)
+}
+
+func TestPatch(t *testing.T) {
+	type fooID string
+	type foo struct {
+		meta.Meta `limestone:"name=foo"`
+		ID        fooID             `limestone:"identity"`
+		List      []string          `limestone:"patch"`
+		Map       map[string]string `limestone:"patch"`
+		Other     []string
+		Plain     map[string]string
+	}
+	s := meta.Survey(reflect.TypeOf(foo{}))
+
+	long := []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc", "dddddddddddddddd", "ffffffffffffffff"}
+	before := foo{ID: "x", List: long, Map: map[string]string{"a": "aaaaaaaaaaaaaaaa", "b": "bbbbbbbbbbbbbbbb", "c": "cccccccccccccccc"}, Other: long}
+
+	res, err := Encode(s, nil, before, nil)
+	require.NoError(t, err)
+	require.Equal(t, json.RawMessage(`["aaaaaaaaaaaaaaaa","bbbbbbbbbbbbbbbb","cccccccccccccccc","dddddddddddddddd","ffffffffffffffff"]`), res["List"])
+
+	after := foo{
+		ID:    "x",
+		List:  []string{"aaaaaaaaaaaaaaaa", "cccccccccccccccc", "dddddddddddddddd", "ffffffffffffffff", "e"},
+		Map:   map[string]string{"a": "aaaaaaaaaaaaaaaa", "c": "cccccccccccccccc", "d": "d"},
+		Other: []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc", "dddddddddddddddd", "ffffffffffffffff", "e"},
+	}
+	diff, err := Encode(s, before, after, nil)
+	require.NoError(t, err)
+	require.Equal(t, Diff{
+		"List":  json.RawMessage(`{"$patch":{"remove":["bbbbbbbbbbbbbbbb"],"append":["e"]}}`),
+		"Map":   json.RawMessage(`{"$patch":{"merge":{"b":null,"d":"d"}}}`),
+		"Other": json.RawMessage(`["aaaaaaaaaaaaaaaa","bbbbbbbbbbbbbbbb","cccccccccccccccc","dddddddddddddddd","ffffffffffffffff","e"]`),
+	}, diff)
+
+	res2, err := Decode(s, before, diff, nil)
+	require.NoError(t, err)
+	require.Equal(t, after, res2)
+
+	// not smaller than the entire value
+	diff, err = Encode(s, before, foo{ID: "x", List: []string{"z"}, Map: before.Map, Other: long}, nil)
+	require.NoError(t, err)
+	require.Equal(t, Diff{"List": json.RawMessage(`["z"]`)}, diff)
+
+	// ambiguous removal
+	dup := foo{ID: "x", List: []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "aaaaaaaaaaaaaaaa", "cccccccccccccccc"}}
+	diff, err = Encode(s, dup, foo{ID: "x", List: []string{"aaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbb", "cccccccccccccccc"}}, nil)
+	require.NoError(t, err)
+	require.Equal(t, Diff{"List": json.RawMessage(`["aaaaaaaaaaaaaaaa","bbbbbbbbbbbbbbbb","cccccccccccccccc"]`)}, diff)
+
+	// value looking like a patch
+	fake := foo{ID: "x", Map: map[string]string{"$patch": "x"}}
+	diff, err = Encode(s, nil, fake, nil)
+	require.NoError(t, err)
+	require.Equal(t, json.RawMessage(`{"$patch":{"set":{"$patch":"x"}}}`), diff["Map"])
+	res2, err = Decode(s, nil, diff, nil)
+	require.NoError(t, err)
+	require.Equal(t, fake, res2)
+
+	// ... stays escaped when compacted
+	ts := time.Now()
+	as := ActiveSet{}
+	require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{"foo": KindChanges{"x": diff}}}, ts, nil))
+	require.Equal(t, json.RawMessage(`{"$patch":{"set":{"$patch":"x"}}}`), as["foo"]["x"].Props["Map"])
+	res2, err = Decode(s, nil, as["foo"]["x"].Props, nil)
+	require.NoError(t, err)
+	require.Equal(t, fake, res2)
+	// ... and patched
+	long1 := foo{ID: "x", Map: map[string]string{"$patch": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}}
+	long2 := foo{ID: "x", Map: map[string]string{"$patch": "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx", "a": "a"}}
+	diff, err = Encode(s, fake, long1, nil)
+	require.NoError(t, err)
+	require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{"foo": KindChanges{"x": diff}}}, ts, nil))
+	for _, step := range []foo{long2, long1} {
+		before := must.OK1(Decode(s, nil, as["foo"]["x"].Props, nil))
+		diff, err = Encode(s, before, step, nil)
+		require.NoError(t, err)
+		require.True(t, IsPatch(diff["Map"]))
+		require.NotContains(t, string(diff["Map"]), `"set"`)
+		require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{"foo": KindChanges{"x": diff}}}, ts, nil))
+		res2, err = Decode(s, nil, as["foo"]["x"].Props, nil)
+		require.NoError(t, err)
+		require.Equal(t, step, res2)
+	}
+	require.Equal(t, json.RawMessage(`{"$patch":{"set":{"$patch":"xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"}}}`), as["foo"]["x"].Props["Map"])
+
+	// ... and is not escaped in other fields
+	plain := foo{ID: "x", Plain: map[string]string{"$patch": "x"}}
+	diff, err = Encode(s, nil, plain, nil)
+	require.NoError(t, err)
+	require.Equal(t, json.RawMessage(`{"$patch":"x"}`), diff["Plain"])
+	res2, err = Decode(s, nil, diff, nil)
+	require.NoError(t, err)
+	require.Equal(t, plain, res2)
+
+	_, err = Decode(s, before, Diff{"List": json.RawMessage(`{"$patch":{"remove":5}}`)}, nil)
+	require.ErrorContains(t, err, "invalid patch")
+}
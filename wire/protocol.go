@@ -10,12 +10,57 @@ package wire
 // A nil value of the map itself means all properties of all kinds are relevant.
 type Filter map[string][]string
 
-// A Request is sent from client to server as the mandatory first WS message
+// A Request is sent from client to server as the mandatory first WS message.
+//
+// The following messages only have Submit set.
 type Request struct {
 	Version int
 	Last    Position
 	Filter  Filter
-	Compact bool // OK to collapse series of transactions and strip events
+	Compact bool  // OK to collapse series of transactions and strip events
+	Where   Where `json:",omitempty"` // row-level predicates
+
+	// The last hot start message received before the connection was
+	// interrupted. The server continues the hot start after it.
+	Resume *HotStartChunk `json:",omitempty"`
+
+	// A transaction to submit, acknowledged by Notification.Ack
+	Submit *Submit `json:",omitempty"`
+
+	// The DB names of the secret fields known to the client by kind, so that
+	// the server redacts them in its logs (see meta.RegisterSecrets)
+	Secrets map[string][]string `json:",omitempty"`
+}
+
+// PositionHeader is the header of a successful response to a push (a
+// transaction submitted over HTTP) that carries the position of the written
+// transaction. Older servers don't send it.
+const PositionHeader = "Limestone-Position"
+
+// Submit is a transaction submitted over the WS connection
+type Submit struct {
+	ID  int64 // chosen by the client to match the Ack
+	Txn Transaction
+}
+
+// Ack acknowledges a submitted transaction
+type Ack struct {
+	ID int64
+
+	// Position of the written transaction. Empty if unknown.
+	Position Position `json:",omitempty"`
+
+	// The transaction may not have been written; the client may retry
+	Err string `json:",omitempty"`
+}
+
+// HotStartChunk identifies a hot start message. Hot start messages carry
+// transactions without positions, so the chunk is used instead to resume an
+// interrupted hot start.
+type HotStartChunk struct {
+	Position Position // where the transactions continue after the hot start
+	Live     bool     `json:",omitempty"` // produced from the server's live state rather than from stored data
+	Seq      int      // number of the message in the hot start, from 0
 }
 
 // Notification is a packet sent from server to client
@@ -27,9 +72,27 @@ type Notification struct {
 	// Reports a fatal error. The server disconnects immediately after.
 	Err ErrMismatch `json:",omitempty"`
 
+	// The server applies the predicates of the request. Sent in the first
+	// notification in reply to a request with Where. A server that does not
+	// send it ignores the predicates.
+	Where bool `json:",omitempty"`
+
+	// The server accepts transactions submitted over the connection (see
+	// Request.Submit). Sent in the first notification. A server that does not
+	// send it only accepts transactions over HTTP (POST /push).
+	Submit bool `json:",omitempty"`
+
 	// An incoming transaction
 	Txn *IncomingTransaction `json:",omitempty"`
 
+	// Set if Txn is a hot start message
+	HotStart *HotStartChunk `json:",omitempty"`
+
 	// The hot end of the stream has been reached
 	Hot bool `json:",omitempty"`
+
+	// A submitted transaction has been written. Acks are not ordered relative
+	// to the transactions: the transaction may arrive before or after its
+	// Ack.
+	Ack *Ack `json:",omitempty"`
 }
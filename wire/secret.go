@@ -0,0 +1,155 @@
+package wire
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ridge/limestone/meta"
+)
+
+// A KeyProvider supplies the keys for fields declared with the encrypted
+// option. Keys must be 16, 24 or 32 bytes long to select AES-128, AES-192 or
+// AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new values with, along with its ID
+	CurrentKey() (id string, key []byte, err error)
+
+	// Key returns the key with the given ID to decrypt a value
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider with a fixed set of keys
+type StaticKeys struct {
+	Current string            // ID of the key used for encryption
+	Keys    map[string][]byte // key ID -> key
+}
+
+// CurrentKey implements KeyProvider
+func (sk StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := sk.Key(sk.Current)
+	return sk.Current, key, err
+}
+
+// Key implements KeyProvider
+func (sk StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := sk.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+var (
+	keyProviderMu sync.RWMutex
+	keyProvider   KeyProvider
+)
+
+// SetKeyProvider sets the key provider used by Encode and Decode for fields
+// declared with the encrypted option. Call it during process initialization,
+// before any Limestone instances are started.
+func SetKeyProvider(kp KeyProvider) {
+	keyProviderMu.Lock()
+	defer keyProviderMu.Unlock()
+	keyProvider = kp
+}
+
+func getKeyProvider() (KeyProvider, error) {
+	keyProviderMu.RLock()
+	defer keyProviderMu.RUnlock()
+	if keyProvider == nil {
+		return nil, errors.New("no key provider set for encrypted fields")
+	}
+	return keyProvider, nil
+}
+
+// encryptedValue is the wire representation of the value of an encrypted field
+type encryptedValue struct {
+	Key        string `json:"$key"`
+	Ciphertext []byte `json:"$encrypted"` // nonce followed by AES-GCM sealed data
+}
+
+// IsEncrypted returns true if the raw value of a field in a Diff is encrypted
+func IsEncrypted(raw json.RawMessage) bool {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '{' {
+		return false
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || len(fields) != 2 {
+		return false
+	}
+	_, hasKey := fields["$key"]
+	_, hasCiphertext := fields["$encrypted"]
+	return hasKey && hasCiphertext
+}
+
+// additionalData binds the ciphertext to the field so that encrypted values
+// cannot be moved between fields
+func additionalData(metaStruct meta.Struct, field meta.Field) []byte {
+	return []byte(metaStruct.DBName + "/" + field.DBName)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(metaStruct meta.Struct, field meta.Field, plain json.RawMessage) (json.RawMessage, error) {
+	kp, err := getKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	id, key, err := kp.CurrentKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain encryption key: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key %q: %w", id, err)
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plain)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(encryptedValue{
+		Key:        id,
+		Ciphertext: gcm.Seal(nonce, nonce, plain, additionalData(metaStruct, field)),
+	})
+}
+
+func decrypt(metaStruct meta.Struct, field meta.Field, raw json.RawMessage) (json.RawMessage, error) {
+	var ev encryptedValue
+	if err := json.Unmarshal(raw, &ev); err != nil {
+		return nil, err
+	}
+	kp, err := getKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	key, err := kp.Key(ev.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain decryption key: %w", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decryption key %q: %w", ev.Key, err)
+	}
+	if len(ev.Ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	nonce, sealed := ev.Ciphertext[:gcm.NonceSize()], ev.Ciphertext[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, sealed, additionalData(metaStruct, field))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt with key %q: %w", ev.Key, err)
+	}
+	return plain, nil
+}
@@ -0,0 +1,95 @@
+package wire
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/ridge/limestone/meta"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+type secretFooID string
+type secretFoo struct {
+	meta.Meta `limestone:"name=secret_foo"`
+	ID        secretFooID `limestone:"identity"`
+	Login     string
+	Password  string `limestone:"secret"`
+	Token     string `limestone:"encrypted"`
+}
+
+var secretFooStruct = meta.Survey(reflect.TypeOf(secretFoo{}))
+
+func setupKeys(t *testing.T) {
+	SetKeyProvider(StaticKeys{
+		Current: "k2",
+		Keys: map[string][]byte{
+			"k1": []byte("0123456789abcdef"),
+			"k2": []byte("0123456789abcdef0123456789abcdef"),
+		},
+	})
+	t.Cleanup(func() { SetKeyProvider(nil) })
+}
+
+func TestEncrypted(t *testing.T) {
+	s := secretFooStruct
+
+	_, err := Encode(s, nil, secretFoo{ID: "x", Token: "t"}, nil)
+	require.EqualError(t, err, "update encoding failed: field Token of wire.secretFoo (secret_foo): no key provider set for encrypted fields")
+
+	setupKeys(t)
+
+	entity := secretFoo{ID: "x", Login: "l", Password: "p", Token: "t"}
+	diff, err := Encode(s, nil, entity, nil)
+	require.NoError(t, err)
+	require.Equal(t, json.RawMessage(`"p"`), diff["Password"])
+	require.True(t, IsEncrypted(diff["Token"]))
+	require.NotContains(t, string(diff["Token"]), `"t"`)
+
+	res, err := Decode(s, nil, diff, nil)
+	require.NoError(t, err)
+	require.Equal(t, entity, res)
+
+	// plain values written before the field became encrypted
+	res, err = Decode(s, nil, Diff{"ID": json.RawMessage(`"x"`), "Token": json.RawMessage(`"t"`)}, nil)
+	require.NoError(t, err)
+	require.Equal(t, secretFoo{ID: "x", Token: "t"}, res)
+
+	// an encrypted value cannot be moved to another field
+	moved := Diff{"ID": json.RawMessage(`"x"`), "Token": diff["Token"]}
+	otherStruct := s
+	otherStruct.DBName = "other"
+	_, err = Decode(otherStruct, nil, moved, nil)
+	require.Error(t, err)
+
+	SetKeyProvider(StaticKeys{Current: "k1", Keys: map[string][]byte{"k1": []byte("0123456789abcdef")}})
+	_, err = Decode(s, nil, diff, nil)
+	require.EqualError(t, err, `update decoding failed: field Token of wire.secretFoo (secret_foo): failed to obtain decryption key: unknown key "k2"`)
+}
+
+func TestRedactedLog(t *testing.T) {
+	setupKeys(t)
+
+	diff, err := Encode(secretFooStruct, nil, secretFoo{ID: "x", Login: "l", Password: "p", Token: "t"}, nil)
+	require.NoError(t, err)
+
+	e := zapcore.NewMapObjectEncoder()
+	require.NoError(t, Transaction{Changes: Changes{"secret_foo": KindChanges{"x": diff}}}.MarshalLogObject(e))
+	require.Equal(t, []any{
+		map[string]any{
+			"id": "x",
+			"diff": map[string]any{
+				"ID":       `"x"`,
+				"Login":    `"l"`,
+				"Password": redactedForLog,
+				"Token":    encryptedForLog,
+			},
+		},
+	}, e.Fields["changes"].(map[string]any)["secret_foo"])
+
+	e = zapcore.NewMapObjectEncoder()
+	require.NoError(t, diff.MarshalLogObject(e))
+	require.Equal(t, `"p"`, e.Fields["Password"]) // the kind is unknown
+	require.Equal(t, encryptedForLog, e.Fields["Token"])
+}
@@ -69,12 +69,22 @@ type Transaction struct {
 
 	Source  Source `json:",omitempty"`
 	Session int64  `json:",omitempty"` // for echo cancellation
+	Seq     int64  `json:",omitempty"` // sequence number within the session, for deduplication; 0 if none
 
 	Changes Changes
 
 	Audit json.RawMessage `json:",omitempty"` // remote IP, session ID etc; exact format decoupled from Limestone
 }
 
+// Key returns the idempotency key of the transaction. Returns false if the
+// transaction has no key (Seq is 0).
+func (txn Transaction) Key() (TxnKey, bool) {
+	if txn.Seq == 0 {
+		return TxnKey{}, false
+	}
+	return TxnKey{Source: txn.Source, Session: txn.Session, Seq: txn.Seq}, true
+}
+
 // A Position is an opaque token that can be used to resume reading from a
 // known location
 type Position string
@@ -83,9 +93,39 @@ type Position string
 // history
 const Beginning Position = ""
 
+// ComparePositions compares two positions in the same transaction log,
+// returning -1, 0 or 1 if a is before, the same as or after b.
+//
+// The positions are compared by length, then lexicographically. This orders the
+// positions produced by the Kafka client and the servers (fixed-width
+// hexadecimal numbers), as well as plain decimal offsets.
+func ComparePositions(a, b Position) int {
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
 // IncomingTransaction is a transaction annotated by its position.
 // Wire format only.
 type IncomingTransaction struct {
 	Transaction
 	Position Position
 }
+
+// PositionOnly returns a transaction with no changes at the given position.
+//
+// A connection delivers it in place of a transaction whose changes it has
+// filtered out entirely, so that the consumer still learns that it has seen
+// the position.
+func PositionOnly(pos Position) *IncomingTransaction {
+	return &IncomingTransaction{Position: pos}
+}
@@ -0,0 +1,16 @@
+package wire
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComparePositions(t *testing.T) {
+	require.Equal(t, 0, ComparePositions(Beginning, Beginning))
+	require.Equal(t, -1, ComparePositions(Beginning, "0000000000000000-0000000000000000"))
+	require.Equal(t, -1, ComparePositions("0000000000000000-000000000000000f", "0000000000000000-0000000000000010"))
+	require.Equal(t, 1, ComparePositions("0000000000000001-0000000000000000", "0000000000000000-0000000000000010"))
+	require.Equal(t, 1, ComparePositions("10", "9"))
+	require.Equal(t, 0, ComparePositions("42", "42"))
+}
@@ -0,0 +1,151 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// A Predicate is a row-level condition: the value of the property must be one
+// of the given values. An equality condition has a single value.
+type Predicate struct {
+	Prop string
+	In   []json.RawMessage
+}
+
+// Matches returns true if the raw property value satisfies the predicate.
+// A missing value never matches.
+func (p Predicate) Matches(value json.RawMessage) bool {
+	if value == nil {
+		return false
+	}
+	for _, v := range p.In {
+		if sameJSON(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where describes row-level predicates per kind. An entity of a kind listed is
+// relevant only if it satisfies all the predicates of its kind. Kinds not listed
+// are not restricted.
+//
+// A nil value of the map means no restrictions.
+type Where map[string][]Predicate
+
+// removedProp is the property of the diff that removes an entity
+const removedProp = "$removed"
+
+// RemovedDiff returns the diff telling the consumer to forget the entity, for
+// example because it has stopped matching the consumer's predicates.
+//
+// Written to the transaction log, it serves as a tombstone: the readers prune
+// the entity, and the compacted state (see ActiveSet) drops it.
+func RemovedDiff() Diff {
+	return Diff{removedProp: json.RawMessage("true")}
+}
+
+// IsRemoved returns true if the diff tells the consumer to forget the entity
+func IsRemoved(diff Diff) bool {
+	return len(diff) == 1 && bytes.Equal(diff[removedProp], json.RawMessage("true"))
+}
+
+// RowFilter applies row-level predicates to a stream of changes.
+//
+// For the kinds with predicates, RowFilter keeps the current properties of
+// every entity, matching or not, so that diffs omitting the predicate
+// properties are still routed correctly. When an entity starts matching, the
+// consumer receives all its properties. When it stops matching, the consumer
+// receives RemovedDiff.
+//
+// Not safe for concurrent use.
+type RowFilter struct {
+	where    Where
+	entities map[string]map[string]Diff // kind -> ID -> properties
+	matching map[string]map[string]bool // kind -> ID -> true
+}
+
+// NewRowFilter creates a RowFilter for the given predicates. The changes must
+// be fed to it from the beginning of the transaction log.
+func NewRowFilter(where Where) *RowFilter {
+	rf := &RowFilter{
+		where:    where,
+		entities: map[string]map[string]Diff{},
+		matching: map[string]map[string]bool{},
+	}
+	for kind := range where {
+		rf.entities[kind] = map[string]Diff{}
+		rf.matching[kind] = map[string]bool{}
+	}
+	return rf
+}
+
+// Apply updates the state with the changes and returns the changes relevant to
+// the consumer, or nil if there are none
+func (rf *RowFilter) Apply(changes Changes) Changes {
+	res := Changes{}
+	for kind, byID := range changes {
+		predicates, ok := rf.where[kind]
+		if !ok {
+			res[kind] = byID
+			continue
+		}
+
+		entities, matching := rf.entities[kind], rf.matching[kind]
+		out := KindChanges{}
+		for id, diff := range byID {
+			was := matching[id]
+			if IsRemoved(diff) {
+				delete(entities, id)
+				delete(matching, id)
+				if was {
+					out[id] = diff
+				}
+				continue
+			}
+
+			props := entities[id]
+			if props == nil {
+				props = Diff{}
+				entities[id] = props
+			}
+			for k, v := range diff {
+				if IsPatch(v) {
+					patched, err := ApplyDiffPatch(props[k], v)
+					if err != nil {
+						continue // invalid patch, ignored like by ActiveSet
+					}
+					v = patched
+				}
+				props[k] = v
+			}
+
+			now := true
+			for _, p := range predicates {
+				if !p.Matches(props[p.Prop]) {
+					now = false
+					break
+				}
+			}
+
+			switch {
+			case now && was:
+				out[id] = diff
+			case now:
+				matching[id] = true
+				out[id] = props.Clone()
+			case was:
+				delete(matching, id)
+				out[id] = RemovedDiff()
+			}
+		}
+		if len(out) != 0 {
+			res[kind] = out
+		}
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
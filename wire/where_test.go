@@ -0,0 +1,52 @@
+package wire
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRowFilter(t *testing.T) {
+	rf := NewRowFilter(Where{
+		"foo": {{Prop: "Color", In: []json.RawMessage{json.RawMessage(`"red"`), json.RawMessage(`"blue"`)}}},
+	})
+
+	// Kinds without predicates pass through
+	require.Equal(t, Changes{"bar": {"b1": {"X": json.RawMessage("1")}}},
+		rf.Apply(Changes{"bar": {"b1": {"X": json.RawMessage("1")}}}))
+
+	// Not matching
+	require.Nil(t, rf.Apply(Changes{"foo": {"f1": {"ID": json.RawMessage(`"f1"`), "Color": json.RawMessage(`"green"`), "N": json.RawMessage("1")}}}))
+	require.Nil(t, rf.Apply(Changes{"foo": {"f1": {"N": json.RawMessage("2")}}}))
+
+	// Starts matching: the whole entity is delivered
+	require.Equal(t, Changes{"foo": {"f1": {"ID": json.RawMessage(`"f1"`), "Color": json.RawMessage(`"red"`), "N": json.RawMessage("2")}}},
+		rf.Apply(Changes{"foo": {"f1": {"Color": json.RawMessage(`"red"`)}}}))
+
+	// Still matching: only the diff is delivered
+	require.Equal(t, Changes{"foo": {"f1": {"N": json.RawMessage("3")}}},
+		rf.Apply(Changes{"foo": {"f1": {"N": json.RawMessage("3")}}}))
+
+	// Stops matching
+	require.Equal(t, Changes{"foo": {"f1": RemovedDiff()}},
+		rf.Apply(Changes{"foo": {"f1": {"Color": json.RawMessage(`"green"`)}}}))
+	require.True(t, IsRemoved(RemovedDiff()))
+	require.False(t, IsRemoved(Diff{"ID": json.RawMessage(`"f1"`)}))
+}
+
+func TestActiveSetRemoved(t *testing.T) {
+	ts := time.Now()
+	as := ActiveSet{}
+	require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{
+		"foo": {"f1": {"ID": json.RawMessage(`"f1"`)}, "f2": {"ID": json.RawMessage(`"f2"`)}},
+	}}, ts, nil))
+	require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{"foo": {"f1": RemovedDiff()}}}, ts, nil))
+	require.Len(t, as["foo"], 1)
+	require.Contains(t, as["foo"], "f2")
+
+	// Later updates are ignored, as for any deleted object
+	require.NoError(t, as.Apply(Transaction{TS: &ts, Changes: Changes{"foo": {"f1": {"N": json.RawMessage("1")}}}}, ts, nil))
+	require.NotContains(t, as["foo"], "f1")
+}